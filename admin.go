@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+)
+
+// maxAdminBody caps the size of admin API request bodies.
+const maxAdminBody = 4 << 20
+
+// adminAuth guards the admin API. Requests are allowed with a matching
+// bearer token, or over TLS with a client certificate verified against the
+// configured client CA. With neither configured the admin API is disabled.
+type adminAuth struct {
+	token        string
+	clientCertOK bool
+}
+
+func (a adminAuth) enabled() bool {
+	return a.token != "" || a.clientCertOK
+}
+
+func (a adminAuth) allowed(r *http.Request) bool {
+	if a.clientCertOK && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if a.token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(a.token)) == 1
+}
+
+// requireAdmin wraps an admin API handler with authentication.
+func (s *pacService) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.admin.enabled() {
+			writeJSONError(w, http.StatusForbidden, "admin API disabled: set -admin-token or -admin-client-ca")
+			return
+		}
+		if !s.admin.allowed(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pac-server"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type listResponse struct {
+	List    string   `json:"list"`
+	Path    string   `json:"path"`
+	Count   int      `json:"count"`
+	Domains []string `json:"domains"`
+	ETag    string   `json:"etag,omitempty"`
+}
+
+type listRequest struct {
+	Domains []string `json:"domains"`
+}
+
+// listPath maps an admin API list name to the file backing it.
+func (s *pacService) listPath(name string) (string, bool) {
+	switch name {
+	case "proxy":
+		return s.domains, true
+	case "noproxy":
+		return s.noproxy, true
+	}
+	return "", false
+}
+
+// listHandler implements GET, POST (add), DELETE (remove) and PUT (replace)
+// on /api/v1/lists/{list}. Changes are written atomically to the same files
+// watchDomains monitors and the PAC is regenerated before responding.
+// The gfwlist list, every enabled source merged, can be read but not
+// modified.
+func (s *pacService) listHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("list")
+	if name == "gfwlist" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "the gfwlist source is read-only")
+			return
+		}
+		domains, err := s.loadDomains()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var locations []string
+		for _, src := range s.enabledSources() {
+			locations = append(locations, src.Location())
+		}
+		writeJSON(w, http.StatusOK, listResponse{List: name, Path: strings.Join(locations, ", "), Count: len(domains), Domains: domains, ETag: s.currentETag()})
+		return
+	}
+
+	path, ok := s.listPath(name)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown list %q: use proxy, noproxy or gfwlist", name))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.writeList(w, name, path)
+		return
+	}
+
+	var req listRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	entries, err := parseListEntries(req.Domains)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	var edit func([]string, []string) []string
+	switch r.Method {
+	case http.MethodPost:
+		edit = addListLines
+	case http.MethodDelete:
+		edit = removeListLines
+	case http.MethodPut:
+		edit = replaceListLines
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := editListFile(path, func(lines []string) []string { return edit(lines, entries) }); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := s.snapshot(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("list saved but PAC generation failed: %v", err))
+		return
+	}
+	s.writeList(w, name, path)
+}
+
+func (s *pacService) writeList(w http.ResponseWriter, name, path string) {
+	domains, _, err := sources.ReadList(path)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := listResponse{List: name, Path: path, Count: len(domains), Domains: []string{}, ETag: s.currentETag()}
+	for _, d := range domains {
+		resp.Domains = append(resp.Domains, canonicalEntry(d))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseListEntry validates a single domain list entry with the same parser
+// used for domains.txt and returns it in the form written to the file.
+// Unlike ParseDomains it rejects input it would only partially honor.
+func parseListEntry(raw string) (string, error) {
+	in := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(raw)), ".")
+	if in == "" {
+		return "", errors.New("empty domain")
+	}
+
+	domains := pacgen.ParseDomains(in)
+	if len(domains) != 1 {
+		return "", fmt.Errorf("%q is not a valid domain", raw)
+	}
+	entry := canonicalEntry(domains[0])
+	if in != entry && in != domains[0] {
+		return "", fmt.Errorf("%q is not a valid domain (parsed as %q)", raw, entry)
+	}
+	return entry, nil
+}
+
+func parseListEntries(raw []string) ([]string, error) {
+	var entries []string
+	var errs []error
+	for _, r := range raw {
+		entry, err := parseListEntry(r)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Join(errs...)
+}
+
+// canonicalEntry returns the file form of a parsed domain: TLD entries such
+// as "ai" are written as ".ai" so the parser keeps treating them as TLDs.
+func canonicalEntry(domain string) string {
+	if !strings.Contains(domain, ".") {
+		return "." + domain
+	}
+	return domain
+}
+
+// lineDomains returns the domains a single list file line contributes.
+func lineDomains(line string) []string {
+	return pacgen.ParseDomains(line)
+}
+
+// addListLines appends entries that are not already present.
+func addListLines(lines, entries []string) []string {
+	present := make(map[string]bool)
+	for _, line := range lines {
+		for _, d := range lineDomains(line) {
+			present[canonicalEntry(d)] = true
+		}
+	}
+	for _, e := range entries {
+		if !present[e] {
+			present[e] = true
+			lines = append(lines, e)
+		}
+	}
+	return lines
+}
+
+// removeListLines drops lines contributing any of entries. Other domains on
+// the same line are kept as separate lines.
+func removeListLines(lines, entries []string) []string {
+	remove := make(map[string]bool)
+	for _, e := range entries {
+		remove[e] = true
+	}
+
+	var out, keep []string
+	for _, line := range lines {
+		domains := lineDomains(line)
+		hit := false
+		for _, d := range domains {
+			if remove[canonicalEntry(d)] {
+				hit = true
+			}
+		}
+		if !hit {
+			out = append(out, line)
+			continue
+		}
+		for _, d := range domains {
+			if e := canonicalEntry(d); !remove[e] {
+				keep = append(keep, e)
+			}
+		}
+	}
+	return addListLines(out, keep)
+}
+
+// replaceListLines keeps comment and blank lines and replaces every domain
+// line with entries in sorted order.
+func replaceListLines(lines, entries []string) []string {
+	var out []string
+	for _, line := range lines {
+		if len(lineDomains(line)) == 0 {
+			out = append(out, line)
+		}
+	}
+	for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+
+	sorted := append([]string(nil), entries...)
+	sort.Strings(sorted)
+	return addListLines(out, sorted)
+}
+
+// editListFile applies edit to the lines of path and writes the result back
+// atomically, keeping the file's permissions. A missing file is created.
+func editListFile(path string, edit func([]string) []string) error {
+	perm := fs.FileMode(0o644)
+	var lines []string
+
+	content, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if st, err := os.Stat(path); err == nil {
+			perm = st.Mode().Perm()
+		}
+		s := bufio.NewScanner(strings.NewReader(string(content)))
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	lines = edit(lines)
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if err := writeFileAtomic(path, []byte(b.String()), perm); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
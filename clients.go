@@ -0,0 +1,286 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gsmlg-ci/pac-server/internal/metrics"
+)
+
+// maxClients bounds the inventory so clients sending random User-Agents
+// cannot grow it without limit. The least recently seen entry is evicted.
+// Entries are kept in the order they were last seen, so that is O(1).
+const maxClients = 100000
+
+type clientKey struct {
+	ip string
+	ua string
+}
+
+// clientRecord describes one device (client IP + User-Agent) that fetched
+// the PAC.
+type clientRecord struct {
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Fetches   int64     `json:"fetches"`
+	LastETag  string    `json:"last_etag"`
+}
+
+// clientInventory tracks which PAC version every client last received. It
+// is kept in memory and, when path is set, saved to a JSON file.
+type clientInventory struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	clients map[clientKey]*list.Element
+	// order holds the *clientRecord of every client, most recently seen
+	// at the front.
+	order *list.List
+	dirty bool
+}
+
+// newClientInventory creates an inventory, loading previously saved
+// records from path when it exists.
+func newClientInventory(path string, retention time.Duration) (*clientInventory, error) {
+	inv := &clientInventory{
+		path:      path,
+		retention: retention,
+		clients:   make(map[clientKey]*list.Element),
+		order:     list.New(),
+	}
+	if path == "" {
+		return inv, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return inv, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	var records []clientRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	for i := range records {
+		rec := &records[i]
+		key := clientKey{ip: rec.IP, ua: rec.UserAgent}
+		if _, ok := inv.clients[key]; !ok {
+			inv.clients[key] = inv.order.PushBack(rec)
+		}
+	}
+	inv.prune(time.Now())
+	return inv, nil
+}
+
+// record notes that the client identified by ip and ua was served etag.
+func (inv *clientInventory) record(ip, ua, etag string, at time.Time) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	key := clientKey{ip: ip, ua: ua}
+	var rec *clientRecord
+	if e, ok := inv.clients[key]; ok {
+		inv.order.MoveToFront(e)
+		rec = e.Value.(*clientRecord)
+	} else {
+		if len(inv.clients) >= maxClients {
+			inv.remove(inv.order.Back())
+		}
+		rec = &clientRecord{IP: ip, UserAgent: ua, FirstSeen: at}
+		inv.clients[key] = inv.order.PushFront(rec)
+	}
+	rec.LastSeen = at
+	rec.Fetches++
+	rec.LastETag = etag
+	inv.dirty = true
+}
+
+// remove drops the client held by e. inv.mu must be held.
+func (inv *clientInventory) remove(e *list.Element) {
+	rec := inv.order.Remove(e).(*clientRecord)
+	delete(inv.clients, clientKey{ip: rec.IP, ua: rec.UserAgent})
+}
+
+// prune drops clients not seen within the retention period.
+func (inv *clientInventory) prune(now time.Time) {
+	if inv.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-inv.retention)
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for e := inv.order.Back(); e != nil; {
+		prev := e.Prev()
+		if e.Value.(*clientRecord).LastSeen.Before(cutoff) {
+			inv.remove(e)
+			inv.dirty = true
+		}
+		e = prev
+	}
+}
+
+// list returns all records, most recently seen first.
+func (inv *clientInventory) list() []clientRecord {
+	inv.mu.Lock()
+	records := make([]clientRecord, 0, len(inv.clients))
+	for e := inv.order.Front(); e != nil; e = e.Next() {
+		records = append(records, *e.Value.(*clientRecord))
+	}
+	inv.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].LastSeen.Equal(records[j].LastSeen) {
+			return records[i].LastSeen.After(records[j].LastSeen)
+		}
+		if records[i].IP != records[j].IP {
+			return records[i].IP < records[j].IP
+		}
+		return records[i].UserAgent < records[j].UserAgent
+	})
+	return records
+}
+
+// counts returns how many clients last received etag and how many received
+// something older.
+func (inv *clientInventory) counts(etag string) (current, stale int) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for e := inv.order.Front(); e != nil; e = e.Next() {
+		if e.Value.(*clientRecord).LastETag == etag {
+			current++
+		} else {
+			stale++
+		}
+	}
+	return current, stale
+}
+
+// save writes the inventory to path if it changed since the last save.
+func (inv *clientInventory) save() error {
+	if inv.path == "" {
+		return nil
+	}
+
+	inv.mu.Lock()
+	if !inv.dirty {
+		inv.mu.Unlock()
+		return nil
+	}
+	inv.dirty = false
+	inv.mu.Unlock()
+
+	content, err := json.MarshalIndent(inv.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(inv.path, append(content, '\n'), 0o644); err != nil {
+		inv.mu.Lock()
+		inv.dirty = true
+		inv.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// run prunes and persists the inventory every interval until done is closed,
+// then saves it one last time.
+func (inv *clientInventory) run(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			if err := inv.save(); err != nil {
+				log.Printf("save client inventory: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			inv.prune(now)
+			if err := inv.save(); err != nil {
+				log.Printf("save client inventory: %v", err)
+			}
+		}
+	}
+}
+
+type clientsResponse struct {
+	ETag    string         `json:"etag"`
+	Total   int            `json:"total"`
+	Current int            `json:"current"`
+	Stale   int            `json:"stale"`
+	Clients []clientStatus `json:"clients"`
+}
+
+type clientStatus struct {
+	clientRecord
+	Current bool `json:"current"`
+}
+
+// clientsHandler lists known clients and whether they run the current PAC.
+// With ?stale=1 only clients on an older version are returned.
+func (s *pacService) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	etag := s.currentETag()
+	onlyStale := r.URL.Query().Get("stale") == "1"
+
+	resp := clientsResponse{ETag: etag, Clients: []clientStatus{}}
+	for _, rec := range s.clients.list() {
+		current := rec.LastETag == etag
+		if current {
+			resp.Current++
+		} else {
+			resp.Stale++
+		}
+		if onlyStale && current {
+			continue
+		}
+		resp.Clients = append(resp.Clients, clientStatus{clientRecord: rec, Current: current})
+	}
+	resp.Total = resp.Current + resp.Stale
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(resp)
+}
+
+func (s *pacService) currentETag() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cached == nil {
+		return ""
+	}
+	return s.cached.etag
+}
+
+// registerClientMetrics exports the number of clients on the current and on
+// stale PAC versions, computed at scrape time.
+func (s *pacService) registerClientMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("pac_server_clients",
+		"Known clients by whether the last PAC they fetched is the current one.",
+		[]string{"version"}, func() []metrics.Sample {
+			current, stale := s.clients.counts(s.currentETag())
+			return []metrics.Sample{
+				{LabelValues: []string{"current"}, Value: float64(current)},
+				{LabelValues: []string{"stale"}, Value: float64(stale)},
+			}
+		})
+}
@@ -4,71 +4,206 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/gsmlg-ci/pac-server/internal/pac"
 	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/rules"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
 )
 
 const defaultGFWListURL = "https://raw.githubusercontent.com/gfwlist/gfwlist/refs/heads/master/gfwlist.txt"
 
 func main() {
 	urlFlag := flag.String("url", defaultGFWListURL, "gfwlist source URL")
-	inFlag := flag.String("in", "", "optional local gfwlist.txt path (base64 encoded); use '-' for stdin")
-	outFlag := flag.String("out", "gfwlist.pac", "output PAC file path")
+	var inFlag stringList
+	flag.Var(&inFlag, "in", "local gfwlist.txt path instead of -url; use '-' for stdin, at most once. Repeat for more sources, checked in order")
+	inFormatFlag := flag.String("in-format", string(pacgen.FormatAuto), "input format: auto, gfwlist, plain, hosts, clash, surge, dnsmasq or v2fly")
+	sourcesFlag := flag.String("sources", "", "JSON file of ordered proxied sources, as for pac-server -sources; replaces -in and -url")
+	domainsFlag := flag.String("d", "", "domains.txt-style file of domains to always proxy, as for pac-server -d")
+	noproxyFlag := flag.String("n", "", "domains.txt-style file of domains to always connect DIRECT, as for pac-server -n")
+	outFlag := flag.String("out", "gfwlist.pac", "output file path, or '-' for stdout; defaults to the format's file name, e.g. clash.yaml, for rule formats")
+	formatFlag := flag.String("format", "pac", "output format: pac or a rule format ("+strings.Join(rules.Names(), ", ")+")")
+	policyFlag := flag.String("policy", "", "proxy policy name in rule formats that route to a named policy (default PROXY, or proxy for quantumultx and v2ray)")
+	dnsFlag := flag.String("dns", rules.DefaultDNS, "trusted DNS server for proxied domains in dnsmasq, unbound and smartdns formats")
+	ipsetFlag := flag.String("ipset", "", "ipset to add proxied domains' addresses to in dnsmasq and smartdns formats")
+	pacURLFlag := flag.String("pac-url", "", "PAC URL for the chrome, firefox, mobileconfig and windows formats")
+	nftsetFlag := flag.String("nftset", "", "nftables set, family#table#set, to add proxied domains' IPv4 addresses to in dnsmasq and smartdns formats")
 	proxyFlag := flag.String("s", pacgen.DefaultProxy, "proxy server value in PAC")
+	layoutFlag := flag.String("layout", string(pacgen.LayoutList), "PAC layout: list or trie")
+	templateFlag := flag.String("template", "", "render the PAC with this text/template file instead of the built-in template for -layout")
+	customJSFlag := flag.String("custom-js", "", "run the JavaScript in this file inside FindProxyForURL")
+	customJSPosFlag := flag.String("custom-js-position", string(pacgen.HookBefore), "where -custom-js runs: before or after the domain lists")
+	minifyFlag := flag.Bool("minify", false, "strip white space and shorten internal names")
+	maxSizeFlag := flag.Int("max-size", 0, "fail when the PAC exceeds this many kilobytes (0 for no limit)")
 	flag.Parse()
 
-	data, err := readInput(*inFlag, *urlFlag)
+	if format, ok := rules.Lookup(*formatFlag); ok {
+		if !isFlagSet("out") {
+			*outFlag = format.File
+		}
+	} else if *formatFlag != "pac" {
+		fail(fmt.Errorf("unknown format %q", *formatFlag))
+	}
+	inFormat, err := pacgen.ParseSourceFormat(*inFormatFlag)
+	if err != nil {
+		fail(err)
+	}
+	layout, err := pacgen.ParseLayout(*layoutFlag)
+	if err != nil {
+		fail(err)
+	}
+	var tmpl *pac.Template
+	if *templateFlag != "" {
+		if tmpl, err = pac.ParseTemplateFile(*templateFlag); err != nil {
+			fail(err)
+		}
+	}
+	customJSPos, err := pacgen.ParseHookPosition(*customJSPosFlag)
 	if err != nil {
 		fail(err)
 	}
+	var customJS string
+	if *customJSFlag != "" {
+		js, err := os.ReadFile(*customJSFlag)
+		if err != nil {
+			fail(fmt.Errorf("read custom JavaScript: %w", err))
+		}
+		customJS = string(js)
+	}
 
-	raw, err := pacgen.DecodeMaybeBase64(data)
+	srcs, err := inputSources(inFlag, *urlFlag, inFormat)
 	if err != nil {
-		fail(fmt.Errorf("decode gfwlist: %w", err))
+		fail(err)
+	}
+	if *sourcesFlag != "" {
+		if srcs, err = sources.ReadFile(*sourcesFlag); err != nil {
+			fail(err)
+		}
+	}
+	lists, err := loadLists(*noproxyFlag, *domainsFlag, srcs)
+	if err != nil {
+		fail(err)
 	}
 
-	domains := pacgen.ParseDomains(string(raw))
-	if len(domains) == 0 {
-		fail(errors.New("no domains parsed from gfwlist"))
+	if *formatFlag != "pac" {
+		out, err := rules.Render(*formatFlag, rules.NewSet(lists.NoProxy, lists.Custom, lists.PACSources()), rules.Options{
+			Policy: *policyFlag,
+			DNS:    *dnsFlag,
+			IPSet:  *ipsetFlag,
+			NFTSet: *nftsetFlag,
+			PACURL: *pacURLFlag,
+		})
+		if err != nil {
+			fail(err)
+		}
+		if err := writeOutput(*outFlag, out); err != nil {
+			fail(fmt.Errorf("write rules file: %w", err))
+		}
+		return
 	}
 
-	pac := pacgen.GeneratePAC(nil, nil, domains, *proxyFlag)
-	if err := os.WriteFile(*outFlag, []byte(pac), 0o644); err != nil {
+	pac, _, err := lists.Generate(pacgen.Options{
+		Proxy:            *proxyFlag,
+		Layout:           layout,
+		Template:         tmpl,
+		Minify:           *minifyFlag,
+		MaxSize:          *maxSizeFlag << 10,
+		CustomJS:         customJS,
+		CustomJSPosition: customJSPos,
+	})
+	if err != nil {
+		fail(err)
+	}
+	if err := writeOutput(*outFlag, []byte(pac)); err != nil {
 		fail(fmt.Errorf("write PAC file: %w", err))
 	}
 }
 
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func fail(err error) {
 	fmt.Fprintf(os.Stderr, "error: %v\n", err)
 	os.Exit(1)
 }
 
-func readInput(inPath, url string) ([]byte, error) {
-	switch inPath {
-	case "":
-		return download(url)
-	case "-":
-		return io.ReadAll(os.Stdin)
-	default:
-		return os.ReadFile(inPath)
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// inputSources returns the sources the -in files describe, or the -url
+// download when there are none. The first is named gfwlist, as the
+// server's -g source is, so both generate the same PAC. Standard input can
+// only be read once, so "-" may be given once.
+func inputSources(ins []string, url string, format pacgen.SourceFormat) ([]*sources.Source, error) {
+	if len(ins) == 0 {
+		return []*sources.Source{{Name: "gfwlist", URL: url, Format: format, Enabled: true}}, nil
+	}
+	srcs := make([]*sources.Source, len(ins))
+	stdin := false
+	for i, in := range ins {
+		if in == sources.Stdin {
+			if stdin {
+				return nil, errors.New("-in - given more than once")
+			}
+			stdin = true
+		}
+		name := "gfwlist"
+		if i > 0 {
+			name = fmt.Sprintf("gfwlist%d", i+1)
+		}
+		srcs[i] = &sources.Source{Name: name, Path: in, Format: format, Enabled: true}
 	}
+	return srcs, nil
 }
 
-func download(url string) ([]byte, error) {
+// loadLists downloads the URL sources and loads every input the way the
+// server does. Unlike the server, which skips a source it cannot
+// download, any failure is fatal.
+func loadLists(noproxy, custom string, srcs []*sources.Source) (sources.Lists, error) {
 	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
+	for _, src := range srcs {
+		if src.Enabled && src.URL != "" {
+			if _, err := src.Fetch(client); err != nil {
+				return sources.Lists{}, err
+			}
+		}
+	}
+	lists, err := sources.Load(noproxy, custom, srcs)
 	if err != nil {
-		return nil, fmt.Errorf("download %s: %w", url, err)
+		return sources.Lists{}, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("download %s: unexpected status %s", url, resp.Status)
+	if len(lists.Skipped) > 0 {
+		return sources.Lists{}, lists.Skipped[0].Err()
 	}
+	if len(lists.Domains()) == 0 {
+		return sources.Lists{}, errors.New("no domains parsed from input")
+	}
+	return lists, nil
+}
 
-	return io.ReadAll(resp.Body)
+// writeOutput writes data to path, or to stdout when path is "-".
+func writeOutput(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
 }
@@ -1,25 +1,73 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
 )
 
-func TestReadInputFromFile(t *testing.T) {
+func TestLoadListsFromFiles(t *testing.T) {
 	tmpDir := t.TempDir()
-	inPath := filepath.Join(tmpDir, "gfwlist.txt")
-	want := "sample-data"
-	if err := os.WriteFile(inPath, []byte(want), 0o644); err != nil {
-		t.Fatalf("write test file: %v", err)
+	write := func(name, content string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write test file: %v", err)
+		}
+		return path
 	}
+	first := write("gfwlist.txt", "||google.com\n||twitter.com\n")
+	second := write("extra.txt", "||example.org\n")
+	custom := write("domains.txt", "example.com\n")
+	noproxy := write("noproxy.txt", "maps.google.com\n")
 
-	got, err := readInput(inPath, "")
+	srcs, err := inputSources([]string{first, second}, "", pacgen.FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcs[0].Name != "gfwlist" || srcs[1].Name != "gfwlist2" {
+		t.Fatalf("unexpected source names %q, %q", srcs[0].Name, srcs[1].Name)
+	}
+	lists, err := loadLists(noproxy, custom, srcs)
 	if err != nil {
-		t.Fatalf("readInput returned error: %v", err)
+		t.Fatalf("loadLists returned error: %v", err)
 	}
+	if got := strings.Join(lists.Domains(), ","); got != "example.org,google.com,twitter.com" {
+		t.Fatalf("unexpected domains %s", got)
+	}
+	if strings.Join(lists.Custom, ",") != "example.com" || strings.Join(lists.NoProxy, ",") != "maps.google.com" {
+		t.Fatalf("unexpected custom %v or noproxy %v", lists.Custom, lists.NoProxy)
+	}
+	m := pacgen.NewSourceMatcher(lists.NoProxy, lists.Custom, lists.PACSources(), "")
+	if got := m.FindProxyForURL("", "maps.google.com"); got != "DIRECT" {
+		t.Fatalf("noproxy should win for maps.google.com, got %s", got)
+	}
+}
 
-	if string(got) != want {
-		t.Fatalf("readInput mismatch\nwant: %q\n got: %q", want, string(got))
+func TestLoadListsFailsOnDownloadError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	srcs, err := inputSources(nil, srv.URL, pacgen.FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLists("", "", srcs); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("want the download error, got %v", err)
+	}
+}
+
+func TestInputSourcesReadsStdinOnce(t *testing.T) {
+	if _, err := inputSources([]string{"-", "extra.txt", "-"}, "", pacgen.FormatAuto); err == nil {
+		t.Fatal("expected an error for -in - given twice")
+	}
+	if srcs, err := inputSources([]string{"-", "extra.txt"}, "", pacgen.FormatAuto); err != nil || len(srcs) != 2 {
+		t.Fatalf("want two sources, got %v, %v", srcs, err)
 	}
 }
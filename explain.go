@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+)
+
+// ruleSource is one list of the PAC in evaluation order, with every entry
+// and where it was read from.
+type ruleSource struct {
+	list    string
+	source  string
+	result  string
+	entries []pacgen.Entry
+}
+
+// ruleSources loads the lists the way GenerateSources checks them:
+// noproxy, then custom domains, then each enabled source in order.
+func (s *pacService) ruleSources() ([]ruleSource, error) {
+	proxy := s.proxy
+	if proxy == "" {
+		proxy = pacgen.DefaultProxy
+	}
+
+	noproxy, err := readListEntries(s.noproxy)
+	if err != nil {
+		return nil, err
+	}
+	custom, err := readListEntries(s.domains)
+	if err != nil {
+		return nil, err
+	}
+	lists, err := s.loadLists()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []ruleSource{
+		{list: "noproxy", source: s.noproxy, result: "DIRECT", entries: noproxy},
+		{list: "custom", source: s.domains, result: proxy, entries: custom},
+	}
+	for _, l := range lists.Sources {
+		result := l.Source.Proxy
+		if result == "" {
+			result = proxy
+		}
+		rules = append(rules, ruleSource{list: l.Source.Name, source: l.Name, result: result, entries: l.Entries})
+	}
+	return rules, nil
+}
+
+// readListEntries reads a domains.txt-style file. A missing file has no
+// entries, matching sources.ReadList.
+func readListEntries(path string) ([]pacgen.Entry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return pacgen.ParseDomainEntries(string(content)), nil
+}
+
+type ruleMatch struct {
+	List   string `json:"list"`
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Result string `json:"result"`
+}
+
+type explanation struct {
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Result   string      `json:"result"`
+	Match    *ruleMatch  `json:"match,omitempty"`
+	Shadowed []ruleMatch `json:"shadowed"`
+	// CustomJS says when -custom-js runs, if it can override Result.
+	CustomJS string `json:"custom_js,omitempty"`
+}
+
+// customHook returns where -custom-js runs, or "" without one.
+func (s *pacService) customHook() pacgen.HookPosition {
+	switch {
+	case s.customJS == "":
+		return ""
+	case s.customJSPos == "":
+		return pacgen.HookBefore
+	}
+	return s.customJSPos
+}
+
+// explain reports which rule decides the proxy for rawURL. The first match
+// in evaluation order wins; within a list the most specific entry is
+// reported. Every other matching entry is returned as shadowed. Custom
+// JavaScript at hook is not run; the explanation says when it may decide
+// instead.
+func explain(sources []ruleSource, hook pacgen.HookPosition, rawURL string) (explanation, error) {
+	host, err := hostFromURL(rawURL)
+	if err != nil {
+		return explanation{}, err
+	}
+
+	e := explanation{URL: rawURL, Host: host, Result: "DIRECT", Shadowed: []ruleMatch{}}
+	for _, src := range sources {
+		var matches []ruleMatch
+		for _, entry := range src.entries {
+			if host == entry.Domain || strings.HasSuffix(host, "."+entry.Domain) {
+				matches = append(matches, ruleMatch{
+					List:   src.list,
+					Rule:   canonicalEntry(entry.Domain),
+					Source: src.source,
+					Line:   entry.Line,
+					Text:   entry.Raw,
+					Result: src.result,
+				})
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool {
+			return len(matches[i].Rule) > len(matches[j].Rule)
+		})
+
+		for i := range matches {
+			if e.Match == nil {
+				e.Match = &matches[i]
+				e.Result = matches[i].Result
+				continue
+			}
+			e.Shadowed = append(e.Shadowed, matches[i])
+		}
+	}
+	switch {
+	case hook == pacgen.HookBefore:
+		e.CustomJS = "runs before the lists and can override this result"
+	case hook == pacgen.HookAfter && e.Match == nil:
+		e.CustomJS = "runs because no list matched and can override this result"
+	}
+	return e, nil
+}
+
+// hostFromURL extracts the lowercase host from a URL or bare host name.
+func hostFromURL(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("missing url parameter")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %w", err)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", fmt.Errorf("no host in %q", raw)
+	}
+	return host, nil
+}
+
+func (s *pacService) explainHandler(w http.ResponseWriter, r *http.Request) {
+	sources, err := s.ruleSources()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	e, err := explain(sources, s.customHook(), strings.TrimSpace(r.URL.Query().Get("url")))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// flagService returns a service for the list and source flags, as the
+// explain and lint subcommands use it.
+func flagService() (*pacService, error) {
+	format, err := pacgen.ParseSourceFormat(gfwlistFmt)
+	if err != nil {
+		return nil, err
+	}
+	hook, err := pacgen.ParseHookPosition(customJSPos)
+	if err != nil {
+		return nil, err
+	}
+	configured := []*sources.Source{gfwlistSource(gfwlistPath, format)}
+	if sourcesPath != "" {
+		if configured, err = sources.ReadFile(sourcesPath); err != nil {
+			return nil, err
+		}
+	}
+	return &pacService{
+		proxy:       proxyServer,
+		customJS:    customJS,
+		customJSPos: hook,
+		sources:     configured,
+		domains:     domainsPath,
+		noproxy:     noproxyPath,
+	}, nil
+}
+
+// runExplain implements `pac-server explain [flags] URL...`.
+func runExplain(args []string) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: pac-server explain [flags] URL...")
+		return 2
+	}
+
+	service, err := flagService()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	service.fetchSources()
+	rules, err := service.ruleSources()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	for i, u := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		e, err := explain(rules, service.customHook(), u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", u, err)
+			status = 1
+			continue
+		}
+		printExplanation(os.Stdout, e)
+	}
+	return status
+}
+
+func printExplanation(w io.Writer, e explanation) {
+	fmt.Fprintf(w, "%s\n", e.URL)
+	fmt.Fprintf(w, "  host:     %s\n", e.Host)
+	fmt.Fprintf(w, "  result:   %s\n", e.Result)
+	if e.CustomJS != "" {
+		fmt.Fprintf(w, "  custom:   -custom-js %s\n", e.CustomJS)
+	}
+	if e.Match == nil {
+		fmt.Fprintf(w, "  rule:     none, no list matched\n")
+		return
+	}
+	fmt.Fprintf(w, "  rule:     %s\n", formatMatch(*e.Match))
+	for _, m := range e.Shadowed {
+		fmt.Fprintf(w, "  shadowed: %s\n", formatMatch(m))
+	}
+}
+
+func formatMatch(m ruleMatch) string {
+	return fmt.Sprintf("%s (%s, %s:%d: %s)", m.Rule, m.List, m.Source, m.Line, m.Text)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gsmlg-ci/pac-server/internal/rules"
+)
+
+// rulesHandler serves the lists of the current snapshot as a rule set for
+// a proxy client, /rules/clash.yaml for example. ?policy= names the proxy
+// in formats that route to a named policy; ?dns=, ?ipset= and ?nftset=
+// configure the DNS formats. Policy formats point at -pac-url, or at
+// /proxy.pac on the host the request was made to.
+func (s *pacService) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	format, ok := rules.ByFile(r.PathValue("file"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	snap, err := s.snapshot()
+	if snap == nil {
+		http.Error(w, fmt.Sprintf("failed to generate rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	set := rules.NewSet(snap.noproxy, snap.custom, snap.sources)
+	query := r.URL.Query()
+	body, err := rules.Render(format.Name, set, rules.Options{
+		Policy: query.Get("policy"),
+		DNS:    query.Get("dns"),
+		IPSet:  query.Get("ipset"),
+		NFTSet: query.Get("nftset"),
+		PACURL: s.publicPACURL(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
+
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	_, _ = w.Write(body)
+}
+
+// publicPACURL is the URL clients should fetch the PAC from: -pac-url if
+// set, or /proxy.pac on the host and scheme of r.
+func (s *pacService) publicPACURL(r *http.Request) string {
+	if s.pacURL != "" {
+		return s.pacURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/proxy.pac"
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Socket handoff relies on inheriting file descriptors across exec and on
+// SIGUSR2, neither of which is available on this platform.
+var upgradeSignals []os.Signal
+
+func inheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+func notifyParentReady() error {
+	return nil
+}
+
+func handoffListener(net.Listener) error {
+	return errors.New("socket handoff is not supported on this platform")
+}
@@ -0,0 +1,127 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// inheritedListener rebuilds the listener passed by a parent process through
+// envListenFD. It returns nil when the process was started normally.
+func inheritedListener() (net.Listener, error) {
+	v := os.Getenv(envListenFD)
+	if v == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(envListenFD)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s=%q: %w", envListenFD, v, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener fd %d: %w", fd, err)
+	}
+	return ln, nil
+}
+
+// notifyParentReady tells the parent process that handed us the listener
+// that we are serving, so it can start draining.
+func notifyParentReady() error {
+	v := os.Getenv(envReadyFD)
+	if v == "" {
+		return nil
+	}
+	_ = os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: %w", envReadyFD, v, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// handoffListener re-execs the current binary with the same arguments and
+// passes it the listening socket. It returns once the child reports it is
+// serving, or an error if the child exits or does not become ready in time.
+func handoffListener(ln net.Listener) error {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("listener %T does not expose a file descriptor", ln)
+	}
+	lnFile, err := fl.File()
+	if err != nil {
+		return fmt.Errorf("dup listener: %w", err)
+	}
+	defer lnFile.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create ready pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	// ExtraFiles start at fd 3 in the child.
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(handoffEnv(), envListenFD+"=3", envReadyFD+"=4")
+
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return fmt.Errorf("start %s: %w", exe, err)
+	}
+	readyW.Close()
+
+	_ = readyR.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := readyR.Read(buf); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("new process (pid %d) exited before becoming ready", cmd.Process.Pid)
+		}
+		return fmt.Errorf("wait for new process (pid %d): %w", cmd.Process.Pid, err)
+	}
+
+	return cmd.Process.Release()
+}
+
+func handoffEnv() []string {
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envListenFD+"=") || strings.HasPrefix(kv, envReadyFD+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+)
+
+// version and buildDate are set at build time with
+// -ldflags "-X main.version=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	buildDate = ""
+)
+
+// buildDateString prefers the BUILD_DATE environment variable set by the
+// Docker image over the value linked into the binary.
+func buildDateString() string {
+	if v := os.Getenv("BUILD_DATE"); v != "" {
+		return v
+	}
+	return buildDate
+}
+
+func (s *pacService) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyz reports ready once a PAC snapshot has been generated and no
+// enabled source is older than its max-age. A failed reload does not make
+// it unready while the previous PAC is still served; /info and the
+// metrics report it. It never triggers PAC generation itself.
+func (s *pacService) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(); err != nil {
+		http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *pacService) ready() error {
+	s.mu.RLock()
+	cached, lastErr := s.cached, s.lastErr
+	s.mu.RUnlock()
+
+	if cached == nil {
+		if lastErr != nil {
+			return fmt.Errorf("no PAC generated yet: %w", lastErr)
+		}
+		return errors.New("no PAC generated yet")
+	}
+	if s.maxAge > 0 {
+		for _, src := range s.enabledSources() {
+			if mod, ok := src.Updated(); ok {
+				if age := time.Since(mod); age > s.maxAge {
+					return fmt.Errorf("%s source %s is %s old, max-age is %s", src.Name, src.Location(), age.Round(time.Second), s.maxAge)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type serviceInfo struct {
+	Version    string                `json:"version"`
+	BuildDate  string                `json:"build_date,omitempty"`
+	Proxy      string                `json:"proxy"`
+	Sources    map[string]sourceInfo `json:"sources"`
+	LastReload *time.Time            `json:"last_reload,omitempty"`
+	LastError  string                `json:"last_error,omitempty"`
+	ETag       string                `json:"etag,omitempty"`
+}
+
+// sourceInfo describes one list. Precedence is its place in evaluation
+// order, 1 for noproxy; the first list matching a host decides it.
+// Disabled sources have none.
+type sourceInfo struct {
+	Path       string     `json:"path,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	Embedded   bool       `json:"embedded,omitempty"`
+	Exists     bool       `json:"exists"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Domains    int        `json:"domains"`
+	Precedence int        `json:"precedence,omitempty"`
+	Format     string     `json:"format,omitempty"`
+	Proxy      string     `json:"proxy,omitempty"`
+	Refresh    string     `json:"refresh,omitempty"`
+	Disabled   bool       `json:"disabled,omitempty"`
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func (s *pacService) info(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	cached, lastErr := s.cached, s.lastErr
+	s.mu.RUnlock()
+
+	info := serviceInfo{
+		Version:   version,
+		BuildDate: buildDateString(),
+		Proxy:     s.proxy,
+		Sources: map[string]sourceInfo{
+			"noproxy": s.sourceInfo(s.noproxy, false),
+			"domains": s.sourceInfo(s.domains, false),
+		},
+	}
+	setPrecedence(info.Sources, "noproxy", 1)
+	setPrecedence(info.Sources, "domains", 2)
+	precedence := 3
+	for _, src := range s.sources {
+		si := s.proxiedSourceInfo(src)
+		if src.Enabled {
+			si.Precedence = precedence
+			precedence++
+		}
+		info.Sources[src.Name] = si
+	}
+	if cached != nil {
+		generated := cached.generated
+		info.LastReload = &generated
+		info.ETag = cached.etag
+		for name, n := range cached.sourceDomains {
+			setDomainCount(info.Sources, name, n)
+		}
+		setDomainCount(info.Sources, "domains", len(cached.custom))
+		setDomainCount(info.Sources, "noproxy", len(cached.noproxy))
+	}
+	if lastErr != nil {
+		info.LastError = lastErr.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(info)
+}
+
+func (s *pacService) sourceInfo(path string, allowEmbeddedFallback bool) sourceInfo {
+	info := sourceInfo{Path: path}
+	if mod, ok := sourceModTime(path); ok {
+		info.Exists = true
+		info.Modified = &mod
+	} else if allowEmbeddedFallback && path == defaultGFWListPath {
+		info.Exists = true
+		info.Embedded = true
+	}
+	return info
+}
+
+// proxiedSourceInfo describes a source with its binding and the state of
+// its last load or download.
+func (s *pacService) proxiedSourceInfo(src *sources.Source) sourceInfo {
+	var info sourceInfo
+	switch {
+	case src.URL != "":
+		info = sourceInfo{URL: src.URL, Exists: src.Downloaded(), Refresh: src.Refresh.String()}
+	case src.Embedded:
+		info = sourceInfo{Path: defaultGFWListPath, Exists: true, Embedded: true}
+	default:
+		info = s.sourceInfo(src.Path, src.Fallback)
+	}
+	info.Format = string(src.Format)
+	if info.Format == "" {
+		info.Format = string(pacgen.FormatAuto)
+	}
+	info.Proxy = src.Proxy
+	if info.Proxy == "" {
+		info.Proxy = s.proxy
+	}
+	info.Disabled = !src.Enabled
+	if mod, ok := src.Updated(); ok {
+		info.LastUpdate = &mod
+	}
+	if err := src.Err(); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func setPrecedence(sources map[string]sourceInfo, name string, n int) {
+	src := sources[name]
+	src.Precedence = n
+	sources[name] = src
+}
+
+func setDomainCount(sources map[string]sourceInfo, name string, n int) {
+	src := sources[name]
+	src.Domains = n
+	sources[name] = src
+}
+
+func sourceModTime(path string) (time.Time, bool) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return st.ModTime(), true
+}
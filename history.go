@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxReloadEvents is the number of PAC generations kept in the reload
+// history.
+const maxReloadEvents = 50
+
+// reloadEvent records the outcome of one PAC generation.
+type reloadEvent struct {
+	Time       time.Time `json:"time"`
+	DurationMS float64   `json:"duration_ms,omitempty"`
+	ETag       string    `json:"etag,omitempty"`
+	Bytes      int       `json:"bytes,omitempty"`
+	Noproxy    int       `json:"noproxy"`
+	Domains    int       `json:"domains"`
+	GFWList    int       `json:"gfwlist"`
+	Pruned     int       `json:"pruned"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (s *pacService) recordReloadEvent(snap *cachedPAC, err error) {
+	ev := reloadEvent{Time: time.Now()}
+	if err != nil {
+		ev.Error = err.Error()
+	} else {
+		ev.Time = snap.generated
+		ev.DurationMS = float64(snap.duration.Microseconds()) / 1000
+		ev.ETag = snap.etag
+		ev.Bytes = len(snap.body)
+		ev.Noproxy = len(snap.noproxy)
+		ev.Domains = len(snap.custom)
+		ev.GFWList = len(snap.gfwlist)
+		ev.Pruned = snap.pruned.Covered + snap.pruned.Shadowed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloads = append(s.reloads, ev)
+	if len(s.reloads) > maxReloadEvents {
+		s.reloads = append([]reloadEvent(nil), s.reloads[len(s.reloads)-maxReloadEvents:]...)
+	}
+}
+
+// reloadsHandler returns the reload history, most recent first.
+func (s *pacService) reloadsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	events := make([]reloadEvent, 0, len(s.reloads))
+	for i := len(s.reloads) - 1; i >= 0; i-- {
+		events = append(events, s.reloads[i])
+	}
+	s.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"reloads": events})
+}
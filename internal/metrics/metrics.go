@@ -0,0 +1,311 @@
+// Package metrics implements the small subset of Prometheus client
+// functionality the server needs: labelled counters and gauges, histograms
+// and rendering in the text exposition format (version 0.0.4).
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Content-Type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram buckets suited to durations in seconds.
+var DefBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metrics in registration order and renders them.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Write renders every registered metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.Write(w)
+	})
+}
+
+// vec stores one float value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{name: name, help: help, typ: typ, labels: labels, values: make(map[string]*series)}
+}
+
+func (v *vec) series(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(labelValues []string, delta float64) {
+	v.mu.Lock()
+	v.series(labelValues).value += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(labelValues []string, value float64) {
+	v.mu.Lock()
+	v.series(labelValues).value = value
+	v.mu.Unlock()
+}
+
+func (v *vec) reset() {
+	v.mu.Lock()
+	v.values = make(map[string]*series)
+	v.mu.Unlock()
+}
+
+func (v *vec) write(w io.Writer) error {
+	v.mu.Lock()
+	all := make([]series, 0, len(v.values))
+	for _, s := range v.values {
+		all = append(all, *s)
+	}
+	v.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return lessLabels(all[i].labelValues, all[j].labelValues)
+	})
+
+	if err := writeHeader(w, v.name, v.help, v.typ); err != nil {
+		return err
+	}
+	for _, s := range all {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatValue(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	v *vec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{v: newVec(name, help, "counter", labels)}
+	r.register(c.v)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.v.add(labelValues, 1)
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(labelValues, delta)
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	v *vec
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{v: newVec(name, help, "gauge", labels)}
+	r.register(g.v)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.v.set(labelValues, value)
+}
+
+// Reset drops every series, so label combinations that no longer exist
+// stop being exported.
+func (g *GaugeVec) Reset() {
+	g.v.reset()
+}
+
+// Sample is one labelled value reported by a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type gaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples are computed by collect each
+// time the registry is written.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&gaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	v := newVec(g.name, g.help, "gauge", g.labels)
+	for _, s := range g.collect() {
+		v.set(s.LabelValues, s.Value)
+	}
+	return v.write(w)
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &Histogram{name: name, help: help, buckets: b, counts: make([]uint64, len(b))}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	if err := writeHeader(w, h.name, h.help, "histogram"); err != nil {
+		return err
+	}
+	for i, upper := range h.buckets {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatValue(upper), counts[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(sum)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+	return err
+}
+
+func writeHeader(w io.Writer, name, help, typ string) error {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return err
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func lessLabels(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
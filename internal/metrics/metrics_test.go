@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests served.", "path", "status")
+	domains := r.NewGaugeVec("test_domains", "Domains per source.", "source")
+	duration := r.NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1})
+
+	requests.Inc("/", "200")
+	requests.Inc("/", "200")
+	requests.Inc("/info", "500")
+	domains.Set(42, "gfwlist")
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(3)
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	want := `# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{path="/",status="200"} 2
+test_requests_total{path="/info",status="500"} 1
+# HELP test_domains Domains per source.
+# TYPE test_domains gauge
+test_domains{source="gfwlist"} 42
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 3.55
+test_duration_seconds_count 3
+`
+	if b.String() != want {
+		t.Fatalf("exposition mismatch\nwant:\n%s\n got:\n%s", want, b.String())
+	}
+}
+
+func TestLabelValueEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Help with \\ and\nnewline.", "ua")
+	c.Inc("say \"hi\"\\\n")
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	checks := []string{
+		`# HELP test_total Help with \\ and\nnewline.`,
+		`test_total{ua="say \"hi\"\\\n"} 1`,
+	}
+	for _, c := range checks {
+		if !strings.Contains(b.String(), c) {
+			t.Fatalf("output missing %q:\n%s", c, b.String())
+		}
+	}
+}
+
+func TestGaugeReset(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGaugeVec("test_gauge", "Gauge.", "source")
+	g.Set(1, "old")
+	g.Reset()
+	g.Set(2, "new")
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if strings.Contains(b.String(), "old") {
+		t.Fatalf("expected reset series to be dropped:\n%s", b.String())
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	n := 0
+	r.NewGaugeFunc("test_clients", "Clients.", []string{"version"}, func() []Sample {
+		n++
+		return []Sample{
+			{LabelValues: []string{"current"}, Value: float64(n)},
+			{LabelValues: []string{"stale"}, Value: 0},
+		}
+	})
+
+	var b strings.Builder
+	for i := 0; i < 2; i++ {
+		b.Reset()
+		if err := r.Write(&b); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	want := `# HELP test_clients Clients.
+# TYPE test_clients gauge
+test_clients{version="current"} 2
+test_clients{version="stale"} 0
+`
+	if b.String() != want {
+		t.Fatalf("exposition mismatch\nwant:\n%s\n got:\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,190 @@
+package pac
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsString quotes s as a single-quoted JavaScript string literal.
+func jsString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f || r == 0x2028 || r == 0x2029:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// indent prefixes each non-blank line of s with n spaces and drops
+// trailing blank lines.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(strings.TrimRight(s, " \t\r\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line != "" {
+			line = pad + line
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jsArray writes domains as an array literal with one entry per line.
+func jsArray(domains []string) string {
+	var b strings.Builder
+	b.Grow(3 + 18*len(domains))
+	b.WriteString("[\n")
+	for _, d := range domains {
+		b.WriteString("            ")
+		b.WriteString(strconv.Quote(d))
+		b.WriteString(",\n")
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// jsObject writes domains as an object literal mapping each to 1, with one
+// entry per line.
+func jsObject(domains []string) string {
+	var b strings.Builder
+	b.Grow(3 + 20*len(domains))
+	b.WriteString("{\n")
+	for i, d := range domains {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		b.WriteString("    ")
+		b.WriteString(strconv.Quote(d))
+		b.WriteString(": 1")
+	}
+	if len(domains) > 0 {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// jsTrie writes domains as nested objects keyed by label from the TLD
+// down. The domains must be pruned: none may lie under another.
+func jsTrie(domains []string) string {
+	var b strings.Builder
+	b.Grow(12 * len(domains))
+	writeTrie(&b, buildTrie(domains), true)
+	return b.String()
+}
+
+// trieNode is one label of a reversed-label trie. A node without children
+// ends a domain: since lists are pruned before encoding, no entry lies
+// under another, so a terminal node never needs children.
+type trieNode struct {
+	children map[string]*trieNode
+}
+
+func buildTrie(domains []string) *trieNode {
+	root := &trieNode{}
+	for _, d := range domains {
+		n := root
+		labels := strings.Split(d, ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			child, ok := n.children[labels[i]]
+			if !ok {
+				child = &trieNode{}
+				n.children[labels[i]] = child
+			}
+			n = child
+		}
+	}
+	return root
+}
+
+// writeTrie writes n as a JavaScript object literal: {"com":{"example":1}}
+// for example.com. The keys of the root go on their own lines, and an empty
+// root is an empty object rather than a terminal.
+func writeTrie(b *strings.Builder, n *trieNode, root bool) {
+	if len(n.children) == 0 && root {
+		b.WriteString("{}")
+		return
+	}
+	if len(n.children) == 0 {
+		b.WriteByte('1')
+		return
+	}
+	keys := make([]string, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if root {
+			b.WriteByte('\n')
+		}
+		writeTrieKey(b, k)
+		b.WriteByte(':')
+		writeTrie(b, n.children[k], false)
+	}
+	if root {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('}')
+}
+
+// writeTrieKey writes k bare when every JavaScript engine accepts it as a
+// property name, and quoted otherwise.
+func writeTrieKey(b *strings.Builder, k string) {
+	if isBareKey(k) {
+		b.WriteString(k)
+		return
+	}
+	b.WriteString(strconv.Quote(k))
+}
+
+func isBareKey(k string) bool {
+	if k == "" || k[0] < 'a' || k[0] > 'z' || reservedWords[k] {
+		return false
+	}
+	for i := 1; i < len(k); i++ {
+		c := k[i]
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// reservedWords cannot be bare property names in ES3, which older PAC
+// engines implement.
+var reservedWords = map[string]bool{
+	"abstract": true, "boolean": true, "break": true, "byte": true, "case": true,
+	"catch": true, "char": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "double": true,
+	"else": true, "enum": true, "export": true, "extends": true, "false": true,
+	"final": true, "finally": true, "float": true, "for": true, "function": true,
+	"goto": true, "if": true, "implements": true, "import": true, "in": true,
+	"instanceof": true, "int": true, "interface": true, "long": true, "native": true,
+	"new": true, "null": true, "package": true, "private": true, "protected": true,
+	"public": true, "return": true, "short": true, "static": true, "super": true,
+	"switch": true, "synchronized": true, "this": true, "throw": true, "throws": true,
+	"transient": true, "true": true, "try": true, "typeof": true, "var": true,
+	"void": true, "volatile": true, "while": true, "with": true,
+}
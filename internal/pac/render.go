@@ -1,90 +1,146 @@
+// Package pac renders PAC files from text/template templates.
+//
+// A template is executed with a Data value and can use these functions
+// besides the text/template built-ins:
+//
+//	js     quote a string as a JavaScript string literal: 'DIRECT'
+//	array  domains as an array literal, one entry per line
+//	object domains as an object literal mapping each domain to 1
+//	trie   domains as nested objects keyed by label from the TLD down:
+//	       {com:{example:1}}
+//	indent prefix each non-blank line of a string with n spaces:
+//	       {{indent 4 .Custom.Before}}
+//
+// The built-in templates, one per layout, are in the templates directory.
 package pac
 
 import (
-	"bytes"
+	"embed"
 	"fmt"
-	"sort"
+	"os"
+	"path/filepath"
 	"strings"
+	"text/template"
 )
 
-type Lists struct {
-	ProxyDomains  []string
-	DirectDomains []string
+// Data is what a PAC template is executed with.
+type Data struct {
+	// Groups are the proxies the lists send hosts to. Each should be
+	// declared as a variable named Var holding Proxy.
+	Groups []Group
+	// Lists are the non-empty domain lists in the order FindProxyForURL
+	// must check them. A host matches a domain when it equals it or ends
+	// with "." and the domain.
+	Lists []List
+	// Default is the result for hosts no list matches, "DIRECT".
+	Default string
+	// Custom is user JavaScript to run inside FindProxyForURL.
+	Custom Custom
+	Meta   Meta
 }
 
-func RenderPAC(lists Lists) ([]byte, error) {
-	proxy := uniqSorted(lists.ProxyDomains)
-	direct := uniqSorted(lists.DirectDomains)
+// Custom is user JavaScript for FindProxyForURL, where url, host and the
+// lowercased host h are in scope. At most one of the fields is set.
+type Custom struct {
+	Before string // runs before any list is checked
+	After  string // runs when no list matched, before returning Default
+}
+
+// Group is a named proxy.
+type Group struct {
+	Name  string // "proxy"
+	Var   string // JavaScript variable for Proxy
+	Proxy string // PAC result, e.g. "PROXY 127.0.0.1:3128"
+}
 
-	var b bytes.Buffer
-	_, _ = b.WriteString("// Generated from gfwlist.txt\n")
-	_, _ = b.WriteString("// Proxy placeholder: __PROXY__\n\n")
-	_, _ = b.WriteString("var proxy = \"__PROXY__\";\n")
-	_, _ = b.WriteString("var direct = \"DIRECT\";\n\n")
+// List is a set of domains sharing one result.
+type List struct {
+	Name    string // "noproxy", "custom" or "gfwlist"
+	Var     string // JavaScript variable for the domains
+	Group   string // Name of the Group hosts go to, empty for DIRECT
+	Result  string // PAC result: "DIRECT" or the group's Proxy
+	Return  string // JavaScript expression for Result: 'DIRECT' or the group's Var
+	Domains []string
+}
 
-	_, _ = b.WriteString("var proxyDomains = {\n")
-	writeDomainMap(&b, proxy)
-	_, _ = b.WriteString("};\n\n")
+// Meta describes how the lists were built.
+type Meta struct {
+	Layout   string // built-in layout name, also set for custom templates
+	Domains  int    // domains in all lists
+	Covered  int    // entries dropped as covered by a parent in the same list
+	Shadowed int    // entries dropped as shadowed by a noproxy domain
+}
 
-	_, _ = b.WriteString("var directDomains = {\n")
-	writeDomainMap(&b, direct)
-	_, _ = b.WriteString("};\n\n")
+// Template is a parsed PAC template.
+type Template struct {
+	tmpl *template.Template
+}
 
-	_, _ = b.WriteString("function matchDomain(map, host) {\n")
-	_, _ = b.WriteString("    if (!host) return false;\n")
-	_, _ = b.WriteString("    host = host.toLowerCase();\n")
-	_, _ = b.WriteString("    if (map[host] === 1) return true;\n")
-	_, _ = b.WriteString("    var pos = host.indexOf('.');\n")
-	_, _ = b.WriteString("    while (pos !== -1) {\n")
-	_, _ = b.WriteString("        host = host.substring(pos + 1);\n")
-	_, _ = b.WriteString("        if (map[host] === 1) return true;\n")
-	_, _ = b.WriteString("        pos = host.indexOf('.');\n")
-	_, _ = b.WriteString("    }\n")
-	_, _ = b.WriteString("    return false;\n")
-	_, _ = b.WriteString("}\n\n")
+var funcs = template.FuncMap{
+	"js":     jsString,
+	"array":  jsArray,
+	"object": jsObject,
+	"trie":   jsTrie,
+	"indent": indent,
+}
 
-	_, _ = b.WriteString("function FindProxyForURL(url, host) {\n")
-	_, _ = b.WriteString("    /*__CUSTOM_PAC__*/\n")
-	_, _ = b.WriteString("    if (matchDomain(directDomains, host)) return direct;\n")
-	_, _ = b.WriteString("    if (matchDomain(proxyDomains, host)) return proxy;\n")
-	_, _ = b.WriteString("    return direct;\n")
-	_, _ = b.WriteString("}\n")
+//go:embed templates/*.pac.tmpl
+var builtinFS embed.FS
 
-	out := b.Bytes()
-	if !bytes.Contains(out, []byte("/*__CUSTOM_PAC__*/")) {
-		return nil, fmt.Errorf("missing custom placeholder")
+var builtins = map[string]*Template{
+	"list": mustParseBuiltin("list"),
+	"trie": mustParseBuiltin("trie"),
+}
+
+func mustParseBuiltin(layout string) *Template {
+	text, err := builtinFS.ReadFile("templates/" + layout + ".pac.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	t, err := ParseTemplate(layout, string(text))
+	if err != nil {
+		panic(err)
 	}
-	return out, nil
+	return t
+}
+
+// Builtin returns the built-in template for a layout, or nil.
+func Builtin(layout string) *Template {
+	return builtins[layout]
 }
 
-func uniqSorted(in []string) []string {
-	if len(in) == 0 {
-		return nil
+// ParseTemplate parses a PAC template.
+func ParseTemplate(name, text string) (*Template, error) {
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
 	}
-	cp := append([]string(nil), in...)
-	for i := range cp {
-		cp[i] = strings.ToLower(strings.TrimSpace(cp[i]))
+	return &Template{tmpl: t}, nil
+}
+
+// ParseTemplateFile reads and parses a PAC template file.
+func ParseTemplateFile(path string) (*Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(cp)
-	out := make([]string, 0, len(cp))
-	var last string
-	for _, s := range cp {
-		if s == "" || s == last {
-			continue
-		}
-		out = append(out, s)
-		last = s
+	t, err := ParseTemplate(filepath.Base(path), string(text))
+	if err != nil {
+		return nil, fmt.Errorf("parse PAC template: %w", err)
 	}
-	return out
+	return t, nil
 }
 
-func writeDomainMap(b *bytes.Buffer, domains []string) {
-	for i, d := range domains {
-		// Keep stable output and avoid trailing commas (older JS engines).
-		if i == len(domains)-1 {
-			_, _ = fmt.Fprintf(b, "    \"%s\": 1\n", d)
-		} else {
-			_, _ = fmt.Fprintf(b, "    \"%s\": 1,\n", d)
-		}
+// Render executes the template with data.
+func (t *Template) Render(data Data) (string, error) {
+	var b strings.Builder
+	n := 1024
+	for _, l := range data.Lists {
+		n += 20 * len(l.Domains)
+	}
+	b.Grow(n)
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", err
 	}
+	return b.String(), nil
 }
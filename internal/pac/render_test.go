@@ -0,0 +1,132 @@
+package pac
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testData() Data {
+	return Data{
+		Groups:  []Group{{Name: "proxy", Var: "proxy", Proxy: "PROXY 127.0.0.1:3128"}},
+		Default: "DIRECT",
+		Lists: []List{
+			{Name: "noproxy", Var: "noProxyHosts", Result: "DIRECT", Return: "'DIRECT'", Domains: []string{"corp.example.com"}},
+			{Name: "gfwlist", Var: "hosts", Group: "proxy", Result: "PROXY 127.0.0.1:3128", Return: "proxy", Domains: []string{"example.com", "in"}},
+		},
+		Meta: Meta{Layout: "list", Domains: 3, Covered: 1},
+	}
+}
+
+func TestRenderCustomTemplate(t *testing.T) {
+	tmpl, err := ParseTemplate("custom", `// {{.Meta.Domains}} domains, {{.Meta.Covered}} pruned
+{{range .Lists}}var {{.Var}} = {{object .Domains}}; // {{.Name}} -> {{js .Result}}
+var {{.Var}}T = {{trie .Domains}};
+{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tmpl.Render(testData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `// 3 domains, 1 pruned
+var noProxyHosts = {
+    "corp.example.com": 1
+}; // noproxy -> 'DIRECT'
+var noProxyHostsT = {
+com:{example:{corp:1}}
+};
+var hosts = {
+    "example.com": 1,
+    "in": 1
+}; // gfwlist -> 'PROXY 127.0.0.1:3128'
+var hostsT = {
+com:{example:1},
+"in":1
+};
+`
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	for _, layout := range []string{"list", "trie"} {
+		tmpl := Builtin(layout)
+		if tmpl == nil {
+			t.Fatalf("no built-in template for %s", layout)
+		}
+		got, err := tmpl.Render(testData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"var proxy = 'PROXY 127.0.0.1:3128';", "function FindProxyForURL(url, host) {", "return 'DIRECT';\n}\n"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: missing %q in\n%s", layout, want, got)
+			}
+		}
+	}
+	if Builtin("tree") != nil {
+		t.Error("unexpected built-in template for unknown layout")
+	}
+}
+
+func TestBuiltinCustom(t *testing.T) {
+	for _, layout := range []string{"list", "trie"} {
+		data := testData()
+		data.Custom.Before = "if (h === 'a') {\n\treturn 'DIRECT';\n}\n\n"
+		got, err := Builtin(layout).Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "    var h = host.toLowerCase();\n    if (h === 'a') {\n    \treturn 'DIRECT';\n    }\n"
+		if !strings.Contains(got, want) {
+			t.Errorf("%s: custom JavaScript not at the start of FindProxyForURL:\n%s", layout, got)
+		}
+
+		data.Custom = Custom{After: "return 'PROXY b:1';"}
+		if got, err = Builtin(layout).Render(data); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(got, "    return 'PROXY b:1';\n    return 'DIRECT';\n}\n") {
+			t.Errorf("%s: custom JavaScript not before the default result:\n%s", layout, got)
+		}
+	}
+}
+
+func TestJSString(t *testing.T) {
+	tests := map[string]string{
+		"PROXY a:1; DIRECT": `'PROXY a:1; DIRECT'`,
+		`it's \ here`:       `'it\'s \\ here'`,
+		"line\nbreak\u2028": `'line\u000abreak\u2028'`,
+	}
+	for in, want := range tests {
+		if got := jsString(in); got != want {
+			t.Errorf("jsString(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	if _, err := ParseTemplate("bad", "{{regex .Lists}}"); err == nil {
+		t.Error("expected an error for an unknown function")
+	}
+
+	tmpl, err := ParseTemplate("missing", "{{.Proxy}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(testData()); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	path := filepath.Join(t.TempDir(), "broken.tmpl")
+	if err := os.WriteFile(path, []byte("{{range .Lists}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTemplateFile(path); err == nil || !strings.Contains(err.Error(), "broken.tmpl") {
+		t.Errorf("expected a parse error naming the file, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package pacgen
+
+import "strings"
+
+// Matcher makes the same decisions as the FindProxyForURL that GeneratePAC
+// emits for the same inputs, without running JavaScript.
+type Matcher struct {
+	lists []matcherList
+}
+
+type matcherList struct {
+	name   string
+	set    map[string]struct{}
+	result string
+}
+
+// Match is the list entry that decided a host.
+type Match struct {
+	List   string // "noproxy", "custom" or the source name, e.g. "gfwlist"
+	Domain string
+	Result string
+}
+
+// NewMatcher builds a Matcher from the arguments GeneratePAC takes.
+func NewMatcher(noProxyDomains, customDomains, gfwlistDomains []string, proxy string) *Matcher {
+	return NewSourceMatcher(noProxyDomains, customDomains, []Source{{Name: "gfwlist", Domains: gfwlistDomains}}, proxy)
+}
+
+// NewSourceMatcher builds a Matcher from the arguments GenerateSources
+// takes.
+func NewSourceMatcher(noProxyDomains, customDomains []string, sources []Source, proxy string) *Matcher {
+	if proxy == "" {
+		proxy = DefaultProxy
+	}
+	m := &Matcher{lists: []matcherList{
+		{"noproxy", domainSet(noProxyDomains), "DIRECT"},
+		{"custom", domainSet(customDomains), proxy},
+	}}
+	for _, src := range sources {
+		result := src.Proxy
+		if result == "" {
+			result = proxy
+		}
+		m.lists = append(m.lists, matcherList{src.Name, domainSet(src.Domains), result})
+	}
+	return m
+}
+
+func domainSet(domains []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		set[d] = struct{}{}
+	}
+	return set
+}
+
+// FindProxyForURL returns the proxy string for host. url is ignored, as it
+// is by the generated PAC.
+func (m *Matcher) FindProxyForURL(url, host string) string {
+	if match, ok := m.Match(host); ok {
+		return match.Result
+	}
+	return "DIRECT"
+}
+
+// Match reports which entry decides host. Lists are checked in PAC order;
+// within a list the most specific matching entry is reported. It returns
+// false when no list matches and the PAC falls through to DIRECT.
+func (m *Matcher) Match(host string) (Match, bool) {
+	h := strings.ToLower(host)
+	for _, l := range m.lists {
+		if d, ok := lookupSuffix(l.set, h); ok {
+			return Match{List: l.name, Domain: d, Result: l.result}, true
+		}
+	}
+	return Match{}, false
+}
+
+// lookupSuffix finds the longest d in set with h === d or
+// h.endsWith('.' + d).
+func lookupSuffix(set map[string]struct{}, h string) (string, bool) {
+	if len(set) == 0 {
+		return "", false
+	}
+	if _, ok := set[h]; ok {
+		return h, true
+	}
+	for i := 0; i < len(h); i++ {
+		if h[i] == '.' {
+			if _, ok := set[h[i+1:]]; ok {
+				return h[i+1:], true
+			}
+		}
+	}
+	return "", false
+}
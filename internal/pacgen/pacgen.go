@@ -3,11 +3,15 @@ package pacgen
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
 	"sort"
 	"strings"
+
+	"github.com/gsmlg-ci/pac-server/internal/pac"
+	"github.com/gsmlg-ci/pac-server/internal/pacjs"
 )
 
 const DefaultProxy = "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080; DIRECT;"
@@ -15,51 +19,167 @@ const DefaultProxy = "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080; DIRECT;"
 var domainPattern = regexp.MustCompile(`(?i)[a-z0-9][a-z0-9.-]*\.[a-z0-9-]{2,}`)
 
 func DecodeMaybeBase64(input []byte) ([]byte, error) {
+	decoded, _, err := DecodeMaybeBase64Diagnostics(input)
+	return decoded, err
+}
+
+// DecodeMaybeBase64Diagnostics is DecodeMaybeBase64 that also reports,
+// as a ReasonNotBase64 diagnostic, when input was not valid base64 and was
+// read as plain text.
+func DecodeMaybeBase64Diagnostics(input []byte) ([]byte, []Diagnostic, error) {
 	trimmed := strings.TrimSpace(string(input))
 	decoded, err := base64.StdEncoding.DecodeString(trimmed)
 	if err != nil {
 		if strings.Contains(trimmed, "\n") || strings.Contains(trimmed, "||") {
-			return []byte(trimmed), nil
+			return []byte(trimmed), []Diagnostic{{Raw: err.Error(), Reason: ReasonNotBase64}}, nil
 		}
-		return nil, err
+		return nil, nil, err
 	}
-	return decoded, nil
+	return decoded, nil, nil
 }
 
 func ParseDomains(raw string) []string {
 	set := make(map[string]struct{})
+	for _, e := range ParseDomainEntries(raw) {
+		set[e.Domain] = struct{}{}
+	}
+	return SortedDomains(set)
+}
+
+// Entry is a domain parsed from one line of a list, with its 1-based line
+// number and the line's original text.
+type Entry struct {
+	Domain string
+	Line   int
+	Raw    string
+}
+
+// ParseDomainEntries parses raw like ParseDomains but keeps every occurrence
+// in input order, together with where it came from. A line containing
+// several domains yields one entry per domain.
+func ParseDomainEntries(raw string) []Entry {
+	entries, _ := ParseDomainDiagnostics(raw)
+	return entries
+}
+
+// Reason says why the parser ignored a line.
+type Reason string
+
+const (
+	ReasonInvalidLabel Reason = "invalid label"
+	ReasonIPLiteral    Reason = "IP literal"
+	ReasonRegex        Reason = "regex"
+	ReasonWildcard     Reason = "wildcard"
+	ReasonUnsupported  Reason = "unsupported syntax"
+	// ReasonNotBase64 is reported with Line 0 when a source was not valid
+	// base64 and was read as plain text.
+	ReasonNotBase64 Reason = "not base64"
+)
+
+// Diagnostic describes a line that contributed no domain.
+type Diagnostic struct {
+	Line   int
+	Raw    string
+	Reason Reason
+}
+
+// ParseDomainDiagnostics parses raw like ParseDomainEntries and also
+// reports every line, other than blank lines and comments, that yields no
+// domain.
+func ParseDomainDiagnostics(raw string) ([]Entry, []Diagnostic) {
+	var entries []Entry
+	var diags []Diagnostic
 	s := bufio.NewScanner(strings.NewReader(raw))
 
+	lineNo := 0
 	for s.Scan() {
+		lineNo++
 		line := strings.TrimSpace(s.Text())
 		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
 			continue
 		}
 		if strings.HasPrefix(line, "@@") {
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: line, Reason: ReasonUnsupported})
 			continue
 		}
 		if strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: line, Reason: ReasonRegex})
 			continue
 		}
 
-		// Support TLD/suffix entries like ".ai" — matches all domains under that TLD.
-		if strings.HasPrefix(line, ".") {
-			tld := strings.ToLower(strings.TrimLeft(line, "."))
-			if tld != "" && !strings.Contains(tld, ".") && isValidLabel(tld) {
-				set[tld] = struct{}{}
-				continue
-			}
+		if tld, ok := tldEntry(line); ok {
+			entries = append(entries, Entry{Domain: tld, Line: lineNo, Raw: line})
+			continue
 		}
 
+		seen := make(map[string]bool)
 		for _, d := range domainPattern.FindAllString(line, -1) {
 			normalized, ok := normalizeDomain(d)
-			if ok {
-				set[normalized] = struct{}{}
+			if ok && !seen[normalized] {
+				seen[normalized] = true
+				entries = append(entries, Entry{Domain: normalized, Line: lineNo, Raw: line})
 			}
 		}
+		if len(seen) == 0 {
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: line, Reason: ignoredReason(line)})
+		}
 	}
 
-	return SortedDomains(set)
+	return entries, diags
+}
+
+// tldEntry reads a TLD/suffix entry like ".ai", which matches all domains
+// under that TLD.
+func tldEntry(line string) (string, bool) {
+	if !strings.HasPrefix(line, ".") {
+		return "", false
+	}
+	tld := strings.ToLower(strings.TrimLeft(line, "."))
+	if tld == "" || strings.Contains(tld, ".") || !isValidLabel(tld) {
+		return "", false
+	}
+	return tld, true
+}
+
+// ignoredReason classifies a rule line that yielded no domain by looking
+// at the host it names.
+func ignoredReason(line string) Reason {
+	if strings.ContainsAny(line, " \t") {
+		return ReasonUnsupported
+	}
+	host := ruleHost(line)
+	switch {
+	case host == "":
+		return ReasonUnsupported
+	case net.ParseIP(host) != nil:
+		return ReasonIPLiteral
+	case strings.Contains(host, "*"):
+		return ReasonWildcard
+	}
+	return ReasonInvalidLabel
+}
+
+// ruleHost extracts the host part of an adblock-style rule such as
+// "||example.com^" or "|https://example.com:8080/path".
+func ruleHost(line string) string {
+	h := strings.ToLower(strings.TrimLeft(line, "|"))
+	if i := strings.Index(h, "://"); i >= 0 {
+		h = h[i+3:]
+	}
+	if strings.HasPrefix(h, "[") {
+		if end := strings.Index(h, "]"); end > 0 {
+			return h[1:end]
+		}
+	}
+	if i := strings.IndexAny(h, "/^"); i >= 0 {
+		h = h[:i]
+	}
+	if net.ParseIP(h) == nil {
+		if i := strings.IndexByte(h, ':'); i >= 0 {
+			h = h[:i]
+		}
+	}
+	return strings.Trim(h, ".")
 }
 
 func SortedDomains(set map[string]struct{}) []string {
@@ -71,6 +191,8 @@ func SortedDomains(set map[string]struct{}) []string {
 	return domains
 }
 
+// MergeDomainLists normalizes and merges lists into one sorted set. Entries
+// covered by a parent domain in the set are left out.
 func MergeDomainLists(lists ...[]string) []string {
 	set := make(map[string]struct{})
 	for _, domains := range lists {
@@ -80,81 +202,285 @@ func MergeDomainLists(lists ...[]string) []string {
 			}
 		}
 	}
+	for d := range set {
+		if hasParent(set, d) {
+			delete(set, d)
+		}
+	}
 	return SortedDomains(set)
 }
 
+// PruneStats counts the entries PruneDomainLists removed.
+type PruneStats struct {
+	// Covered is entries repeated or covered by a parent domain in the
+	// same list.
+	Covered int
+	// Shadowed is custom and gfwlist entries equal to or under a noproxy
+	// entry, which always go DIRECT.
+	Shadowed int
+}
+
+// PruneDomainLists removes entries that cannot change a decision of the
+// PAC generated from the lists, since matching is by suffix and lists are
+// checked in order. The remaining entries keep their order.
+func PruneDomainLists(noProxyDomains, customDomains, gfwlistDomains []string) (noProxy, custom, gfwlist []string, stats PruneStats) {
+	noProxy, lists, stats := pruneLists(noProxyDomains, customDomains, gfwlistDomains)
+	return noProxy, lists[0], lists[1], stats
+}
+
+// pruneLists prunes each proxied list on its own and against noProxy.
+func pruneLists(noProxyDomains []string, lists ...[]string) (noProxy []string, pruned [][]string, stats PruneStats) {
+	noProxy = pruneList(noProxyDomains, nil, &stats)
+	shadow := domainSet(noProxy)
+	pruned = make([][]string, len(lists))
+	for i, l := range lists {
+		pruned[i] = pruneList(l, shadow, &stats)
+	}
+	return noProxy, pruned, stats
+}
+
+func pruneList(domains []string, shadow map[string]struct{}, stats *PruneStats) []string {
+	set := domainSet(domains)
+	seen := make(map[string]bool, len(domains))
+	out := make([]string, 0, len(domains))
+	for _, d := range domains {
+		if seen[d] || hasParent(set, d) {
+			stats.Covered++
+			continue
+		}
+		if _, ok := lookupSuffix(shadow, d); ok {
+			stats.Shadowed++
+			continue
+		}
+		seen[d] = true
+		out = append(out, d)
+	}
+	return out
+}
+
+// hasParent reports whether set contains a proper parent domain of d.
+func hasParent(set map[string]struct{}, d string) bool {
+	for i := 0; i < len(d); i++ {
+		if d[i] == '.' {
+			if _, ok := set[d[i+1:]]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Layout selects how the generated PAC stores its domain lists.
+type Layout string
+
+const (
+	// LayoutList stores each list as an array scanned with endsWith.
+	LayoutList Layout = "list"
+	// LayoutTrie stores each list as nested objects keyed by domain labels
+	// from the TLD down. It is much smaller for large lists and looks a host
+	// up in a handful of property accesses.
+	LayoutTrie Layout = "trie"
+)
+
+// ParseLayout returns the Layout named s.
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutList, LayoutTrie:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown PAC layout %q (want list or trie)", s)
+}
+
+// HookPosition is where custom JavaScript runs in FindProxyForURL.
+type HookPosition string
+
+const (
+	// HookBefore runs custom JavaScript before any domain list is checked.
+	HookBefore HookPosition = "before"
+	// HookAfter runs custom JavaScript when no domain list matched, before
+	// the default result is returned.
+	HookAfter HookPosition = "after"
+)
+
+// ParseHookPosition returns the HookPosition named s.
+func ParseHookPosition(s string) (HookPosition, error) {
+	switch p := HookPosition(s); p {
+	case HookBefore, HookAfter:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown custom JavaScript position %q (want before or after)", s)
+}
+
+// customJSPrefix opens the function custom JavaScript is checked in. It
+// declares what the built-in templates have in scope: url, host and the
+// lowercased host h.
+const customJSPrefix = "function FindProxyForURL(url, host) { var h = host.toLowerCase();\n"
+
+// CheckCustomJS reports syntax errors in custom JavaScript as it would run
+// inside FindProxyForURL. It accepts ES5 the browser runs but pacjs does
+// not, such as new Date() or regular expressions. Line numbers refer to
+// src.
+func CheckCustomJS(src string) error {
+	err := pacjs.Check(customJSPrefix + src + "\n}")
+	var se *pacjs.SyntaxError
+	if errors.As(err, &se) {
+		se.Line--
+	}
+	return err
+}
+
+// Options controls Generate.
+type Options struct {
+	// Proxy is returned for proxied hosts. Empty means DefaultProxy.
+	Proxy string
+	// Layout is the encoding of the domain lists. Empty means LayoutList.
+	Layout Layout
+	// Template renders the PAC instead of the built-in template for
+	// Layout.
+	Template *pac.Template
+	// Minify strips white space and shortens internal names, see
+	// pacjs.Minify.
+	Minify bool
+	// MaxSize fails generation with ErrTooLarge when the PAC is larger
+	// than this many bytes. 0 means no limit.
+	MaxSize int
+	// CustomJS is JavaScript run inside FindProxyForURL at
+	// CustomJSPosition. A return statement in it decides the result.
+	CustomJS string
+	// CustomJSPosition is where CustomJS runs. Empty means HookBefore.
+	CustomJSPosition HookPosition
+}
+
+// ErrTooLarge is returned by Generate when the PAC exceeds Options.MaxSize.
+var ErrTooLarge = errors.New("PAC exceeds size budget")
+
+// Source is a proxied domain list checked after the custom domains.
+type Source struct {
+	Name    string // list name in the PAC, e.g. "gfwlist"
+	Proxy   string // result for its hosts; empty means Options.Proxy
+	Domains []string
+}
+
 // GeneratePAC generates a PAC JS with two domain sets:
 //   - customDomains: checked first (higher priority)
 //   - gfwlistDomains: checked second (fallback)
 //
 // If customDomains is empty, the generated code only checks gfwlistDomains.
+// Redundant entries are dropped first, see PruneDomainLists.
 func GeneratePAC(noProxyDomains, customDomains, gfwlistDomains []string, proxy string) string {
+	pac, _, _ := Generate(noProxyDomains, customDomains, gfwlistDomains, Options{Proxy: proxy})
+	return pac
+}
+
+// Generate is GeneratePAC with options. It also reports how many entries
+// were pruned.
+func Generate(noProxyDomains, customDomains, gfwlistDomains []string, opts Options) (string, PruneStats, error) {
+	return GenerateSources(noProxyDomains, customDomains, []Source{{Name: "gfwlist", Domains: gfwlistDomains}}, opts)
+}
+
+// GenerateSources is Generate with any number of proxied sources, checked
+// in order after the custom domains. Each source may send its hosts to its
+// own proxy. Entries are pruned within each source and against the noproxy
+// domains, but not across sources, whose proxies may differ.
+func GenerateSources(noProxyDomains, customDomains []string, sources []Source, opts Options) (string, PruneStats, error) {
+	lists := [][]string{customDomains}
+	for _, src := range sources {
+		lists = append(lists, src.Domains)
+	}
+	noProxyDomains, lists, stats := pruneLists(noProxyDomains, lists...)
+	proxy := opts.Proxy
 	if proxy == "" {
 		proxy = DefaultProxy
 	}
 
-	var b strings.Builder
-	// Pre-allocate: proxy string + fixed JS boilerplate ~150 bytes,
-	// plus ~18 bytes per domain per array.
-	total := 150 + len(noProxyDomains)*18 + len(customDomains)*18 + len(gfwlistDomains)*18
-	b.Grow(total)
-
-	b.WriteString("var proxy = '")
-	b.WriteString(proxy)
-	b.WriteString("';\n")
-
-	if len(noProxyDomains) > 0 {
-		b.WriteString("var noProxyHosts = [\n")
-		for _, d := range noProxyDomains {
-			fmt.Fprintf(&b, "            %q,\n", d)
+	layout := opts.Layout
+	if layout == "" {
+		layout = LayoutList
+	}
+	tmpl := opts.Template
+	if tmpl == nil {
+		if tmpl = pac.Builtin(string(layout)); tmpl == nil {
+			return "", stats, fmt.Errorf("unknown PAC layout %q", layout)
 		}
-		b.WriteString("];\n")
 	}
 
-	if len(customDomains) > 0 {
-		b.WriteString("var customHosts = [\n")
-		for _, d := range customDomains {
-			fmt.Fprintf(&b, "            %q,\n", d)
+	var custom pac.Custom
+	if strings.TrimSpace(opts.CustomJS) != "" {
+		if err := CheckCustomJS(opts.CustomJS); err != nil {
+			return "", stats, fmt.Errorf("custom JavaScript: %w", err)
+		}
+		switch opts.CustomJSPosition {
+		case "", HookBefore:
+			custom.Before = opts.CustomJS
+		case HookAfter:
+			custom.After = opts.CustomJS
+		default:
+			return "", stats, fmt.Errorf("unknown custom JavaScript position %q", opts.CustomJSPosition)
 		}
-		b.WriteString("];\n")
 	}
 
-	b.WriteString("var hosts = [\n")
-	for _, d := range gfwlistDomains {
-		fmt.Fprintf(&b, "            %q,\n", d)
+	data := pac.Data{
+		Groups:  []pac.Group{{Name: "proxy", Var: "proxy", Proxy: proxy}},
+		Custom:  custom,
+		Default: "DIRECT",
+		Meta: pac.Meta{
+			Layout:   string(layout),
+			Covered:  stats.Covered,
+			Shadowed: stats.Shadowed,
+		},
 	}
-	b.WriteString("];\n\n")
-	b.WriteString("function FindProxyForURL(url, host) {\n")
-	b.WriteString("    var h = host.toLowerCase();\n")
-
-	if len(noProxyDomains) > 0 {
-		b.WriteString("    for (var i = 0; i < noProxyHosts.length; i++) {\n")
-		b.WriteString("        var d = noProxyHosts[i];\n")
-		b.WriteString("        if (h === d || h.endsWith('.' + d)) {\n")
-		b.WriteString("            return 'DIRECT';\n")
-		b.WriteString("        }\n")
-		b.WriteString("    }\n")
+	// group returns the group for a proxy, adding one for each proxy
+	// besides the default in order of first use.
+	group := func(p string) pac.Group {
+		if p == "" {
+			p = proxy
+		}
+		for _, g := range data.Groups {
+			if g.Proxy == p {
+				return g
+			}
+		}
+		name := fmt.Sprintf("proxy%d", len(data.Groups)+1)
+		g := pac.Group{Name: name, Var: name, Proxy: p}
+		data.Groups = append(data.Groups, g)
+		return g
 	}
-
-	if len(customDomains) > 0 {
-		b.WriteString("    for (var i = 0; i < customHosts.length; i++) {\n")
-		b.WriteString("        var d = customHosts[i];\n")
-		b.WriteString("        if (h === d || h.endsWith('.' + d)) {\n")
-		b.WriteString("            return proxy;\n")
-		b.WriteString("        }\n")
-		b.WriteString("    }\n")
+	add := func(l pac.List) {
+		data.Meta.Domains += len(l.Domains)
+		if len(l.Domains) > 0 {
+			data.Lists = append(data.Lists, l)
+		}
 	}
 
-	b.WriteString("    for (var i = 0; i < hosts.length; i++) {\n")
-	b.WriteString("        var d = hosts[i];\n")
-	b.WriteString("        if (h === d || h.endsWith('.' + d)) {\n")
-	b.WriteString("            return proxy;\n")
-	b.WriteString("        }\n")
-	b.WriteString("    }\n")
-	b.WriteString("    return 'DIRECT';\n")
-	b.WriteString("}\n")
+	add(pac.List{Name: "noproxy", Var: "noProxyHosts", Result: "DIRECT", Return: "'DIRECT'", Domains: noProxyDomains})
+	add(pac.List{Name: "custom", Var: "customHosts", Group: "proxy", Result: proxy, Return: "proxy", Domains: lists[0]})
+	for i, src := range sources {
+		if len(lists[i+1]) == 0 {
+			continue
+		}
+		v := "hosts"
+		if i > 0 {
+			v = fmt.Sprintf("hosts%d", i+1)
+		}
+		g := group(src.Proxy)
+		add(pac.List{Name: src.Name, Var: v, Group: g.Name, Result: g.Proxy, Return: g.Var, Domains: lists[i+1]})
+	}
 
-	return b.String()
+	body, err := tmpl.Render(data)
+	if err != nil {
+		return "", stats, fmt.Errorf("render PAC: %w", err)
+	}
+	if opts.Minify {
+		minified, err := pacjs.Minify(body)
+		if err != nil {
+			return "", stats, fmt.Errorf("minify PAC: %w", err)
+		}
+		body = minified
+	}
+	if opts.MaxSize > 0 && len(body) > opts.MaxSize {
+		return "", stats, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, len(body), opts.MaxSize)
+	}
+	return body, stats, nil
 }
 
 func isValidLabel(s string) bool {
@@ -2,8 +2,15 @@ package pacgen
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/gsmlg-ci/pac-server/internal/pac"
+	"github.com/gsmlg-ci/pac-server/internal/pacjs"
 )
 
 func TestDecodeMaybeBase64(t *testing.T) {
@@ -39,6 +46,60 @@ func TestParseDomains(t *testing.T) {
 	}
 }
 
+func TestParseDomainEntries(t *testing.T) {
+	raw := strings.Join([]string{
+		"! comment",
+		"||youtube.com",
+		"",
+		"github.com and gist.github.com and github.com",
+		".ai",
+	}, "\n")
+
+	var got []string
+	for _, e := range ParseDomainEntries(raw) {
+		got = append(got, fmt.Sprintf("%d:%s", e.Line, e.Domain))
+	}
+	want := "2:youtube.com,4:github.com,4:gist.github.com,5:ai"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("entries mismatch\nwant: %s\n got: %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestParseDomainDiagnostics(t *testing.T) {
+	raw := strings.Join([]string{
+		"! comment",
+		"||youtube.com",
+		"@@||google.com",
+		"/^https?:\\/\\/[^\\/]+example\\.com/",
+		"|http://85.17.73.31/",
+		"||*.cdn",
+		"my_host",
+		"not a rule",
+		"",
+	}, "\n")
+
+	entries, diags := ParseDomainDiagnostics(raw)
+	if len(entries) != 1 || entries[0].Domain != "youtube.com" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%d:%s", d.Line, d.Reason))
+	}
+	want := "3:unsupported syntax,4:regex,5:IP literal,6:wildcard,7:invalid label,8:unsupported syntax"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("diagnostics mismatch\nwant: %s\n got: %s", want, strings.Join(got, ","))
+	}
+
+	_, decodeDiags, err := DecodeMaybeBase64Diagnostics([]byte("||example.com\n||example.org\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decodeDiags) != 1 || decodeDiags[0].Reason != ReasonNotBase64 {
+		t.Fatalf("expected a plain text fallback diagnostic, got %+v", decodeDiags)
+	}
+}
+
 func TestMergeDomainLists(t *testing.T) {
 	merged := MergeDomainLists(
 		[]string{"Example.com", "a.example.com"},
@@ -46,12 +107,34 @@ func TestMergeDomainLists(t *testing.T) {
 	)
 
 	got := strings.Join(merged, ",")
-	want := "a.example.com,example.com,github.com"
+	want := "example.com,github.com"
 	if got != want {
 		t.Fatalf("domains mismatch\nwant: %s\n got: %s", want, got)
 	}
 }
 
+func TestPruneDomainLists(t *testing.T) {
+	noproxy, custom, gfwlist, stats := PruneDomainLists(
+		[]string{"corp.example.com", "wiki.corp.example.com"},
+		[]string{"ai", "chat.ai", "github.com", "github.com"},
+		[]string{"example.com", "www.example.com", "corp.example.com", "vpn.corp.example.com", "google.com"},
+	)
+
+	got := strings.Join([]string{strings.Join(noproxy, ","), strings.Join(custom, ","), strings.Join(gfwlist, ",")}, " | ")
+	want := "corp.example.com | ai,github.com | example.com,google.com"
+	if got != want {
+		t.Fatalf("pruned lists mismatch\nwant: %s\n got: %s", want, got)
+	}
+	if stats != (PruneStats{Covered: 6, Shadowed: 0}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	_, custom, _, stats = PruneDomainLists([]string{"corp.example.com"}, []string{"wiki.corp.example.com", "github.com"}, nil)
+	if strings.Join(custom, ",") != "github.com" || stats.Shadowed != 1 {
+		t.Fatalf("expected the noproxy-shadowed entry to be pruned: %v %+v", custom, stats)
+	}
+}
+
 func TestGeneratePAC(t *testing.T) {
 	pac := GeneratePAC(nil, nil, []string{"example.com"}, "PROXY 127.0.0.1:3128")
 
@@ -96,6 +179,119 @@ func TestGeneratePACWithCustom(t *testing.T) {
 	}
 }
 
+func TestGeneratePACTrie(t *testing.T) {
+	noproxy := []string{"corp.example.com"}
+	gfwlist := []string{"example.com", "www.example.com", "in", "1password.com", "x-y.net"}
+
+	pac, _, _ := Generate(noproxy, nil, gfwlist, Options{Proxy: "PROXY 127.0.0.1:3128", Layout: LayoutTrie})
+
+	checks := []string{
+		"var proxy = 'PROXY 127.0.0.1:3128';",
+		"var noProxyHosts = {\ncom:{example:{corp:1}}\n};",
+		"var hosts = {\ncom:{\"1password\":1,example:1},\n\"in\":1,\nnet:{\"x-y\":1}\n};",
+		"if (inTrie(noProxyHosts, h)) {",
+	}
+	for _, c := range checks {
+		if !strings.Contains(pac, c) {
+			t.Fatalf("generated PAC missing expected content: %q\n%s", c, pac)
+		}
+	}
+	if strings.Contains(pac, "customHosts") {
+		t.Fatal("generated PAC should not declare customHosts without custom domains")
+	}
+
+	empty, _, _ := Generate(nil, nil, nil, Options{Layout: LayoutTrie})
+	if strings.Contains(empty, "var hosts") {
+		t.Fatalf("empty lists should not be declared:\n%s", empty)
+	}
+}
+
+func TestGeneratePACMinifyAndBudget(t *testing.T) {
+	gfwlist := []string{"example.com", "google.com"}
+	plain, _, err := Generate(nil, nil, gfwlist, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	minified, _, err := Generate(nil, nil, gfwlist, Options{Minify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minified) >= len(plain)*2/3 {
+		t.Errorf("minified PAC is %d bytes, plain %d", len(minified), len(plain))
+	}
+	if !strings.Contains(minified, "function FindProxyForURL(") || strings.Contains(minified, "    ") {
+		t.Errorf("unexpected minified PAC:\n%s", minified)
+	}
+
+	if _, _, err := Generate(nil, nil, gfwlist, Options{MaxSize: len(plain)}); err != nil {
+		t.Errorf("PAC of exactly MaxSize bytes: %v", err)
+	}
+	_, _, err = Generate(nil, nil, gfwlist, Options{MaxSize: len(plain) - 1})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("want ErrTooLarge, got %v", err)
+	}
+}
+
+func TestGeneratePACCustomJS(t *testing.T) {
+	js := "if (h === 'example.com' || isPlainHostName(host)) {\n    return 'PROXY hook:1';\n}\n"
+	tests := []struct {
+		pos        HookPosition
+		host, want string
+	}{
+		{HookBefore, "example.com", "PROXY hook:1"},
+		{HookBefore, "intranet", "PROXY hook:1"},
+		{HookAfter, "example.com", DefaultProxy},
+		{HookAfter, "intranet", "PROXY hook:1"},
+		{HookAfter, "other.org", "DIRECT"},
+	}
+	for _, layout := range []Layout{LayoutList, LayoutTrie} {
+		for _, minify := range []bool{false, true} {
+			for _, tc := range tests {
+				body, _, err := Generate(nil, nil, []string{"example.com"}, Options{
+					Layout: layout, Minify: minify, CustomJS: js, CustomJSPosition: tc.pos,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				script, err := pacjs.Load(body)
+				if err != nil {
+					t.Fatalf("%s: %v\n%s", layout, err, body)
+				}
+				got, err := script.FindProxyForURL("http://"+tc.host+"/", tc.host)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tc.want {
+					t.Errorf("%s minify=%v %s %s: want %q, got %q", layout, minify, tc.pos, tc.host, tc.want, got)
+				}
+			}
+		}
+	}
+
+	// Browser-only features pass the check.
+	if _, _, err := Generate(nil, nil, nil, Options{CustomJS: "if (new Date().getHours() < 9) return 'DIRECT';"}); err != nil {
+		t.Errorf("new Date(): %v", err)
+	}
+	_, _, err := Generate(nil, nil, nil, Options{CustomJS: "\nif (h === {) return 1;"})
+	if err == nil || !strings.Contains(err.Error(), "line 2:") {
+		t.Errorf("want syntax error on line 2, got %v", err)
+	}
+	if _, err := ParseHookPosition("middle"); err == nil {
+		t.Error("ParseHookPosition accepted an unknown position")
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, name := range []string{"list", "trie"} {
+		if l, err := ParseLayout(name); err != nil || string(l) != name {
+			t.Errorf("ParseLayout(%q) = %q, %v", name, l, err)
+		}
+	}
+	if _, err := ParseLayout("tree"); err == nil {
+		t.Error("ParseLayout(\"tree\") should fail")
+	}
+}
+
 func TestParseDomainsTLD(t *testing.T) {
 	raw := strings.Join([]string{
 		".ai",
@@ -159,3 +355,344 @@ func TestGeneratePACWithNoProxy(t *testing.T) {
 		t.Fatal("noproxy DIRECT return should appear before proxy return")
 	}
 }
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher([]string{"internal.example.com"}, []string{"ai"}, []string{"example.com"}, "PROXY p:1")
+
+	tests := []struct {
+		host   string
+		list   string
+		domain string
+		result string
+	}{
+		{"Internal.Example.com", "noproxy", "internal.example.com", "DIRECT"},
+		{"a.internal.example.com", "noproxy", "internal.example.com", "DIRECT"},
+		{"chat.ai", "custom", "ai", "PROXY p:1"},
+		{"www.example.com", "gfwlist", "example.com", "PROXY p:1"},
+		{"notexample.com", "", "", "DIRECT"},
+	}
+	for _, tc := range tests {
+		match, ok := m.Match(tc.host)
+		if ok != (tc.list != "") || match.List != tc.list || match.Domain != tc.domain {
+			t.Errorf("%s: want %s %s, got %+v (%v)", tc.host, tc.list, tc.domain, match, ok)
+		}
+		if got := m.FindProxyForURL("http://"+tc.host+"/", tc.host); got != tc.result {
+			t.Errorf("%s: want %q, got %q", tc.host, tc.result, got)
+		}
+	}
+}
+
+func TestGenerateSources(t *testing.T) {
+	sources := []Source{
+		{Name: "gfwlist", Domains: []string{"google.com"}},
+		{Name: "streaming", Proxy: "SOCKS5 127.0.0.1:1080", Domains: []string{"netflix.com", "google.com"}},
+		{Name: "empty", Proxy: "PROXY 10.0.0.1:80"},
+	}
+	src, _, err := GenerateSources(nil, nil, sources, Options{Proxy: "PROXY 127.0.0.1:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"var proxy2 = 'SOCKS5 127.0.0.1:1080';", "var hosts2 = ", "return proxy2;"} {
+		if !strings.Contains(src, want) {
+			t.Fatalf("PAC lacks %q:\n%s", want, src)
+		}
+	}
+	if strings.Contains(src, "10.0.0.1") {
+		t.Fatalf("PAC declares the proxy of an empty source:\n%s", src)
+	}
+
+	script, err := pacjs.Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"www.google.com": "PROXY 127.0.0.1:3128",
+		"netflix.com":    "SOCKS5 127.0.0.1:1080",
+		"example.com":    "DIRECT",
+	} {
+		if got, _ := script.FindProxyForURL("https://"+host+"/", host); got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+
+	// Meta.Domains counts every list once, noproxy included.
+	count, err := pac.ParseTemplate("count", "{{.Meta.Domains}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := GenerateSources([]string{"intranet.example"}, []string{"example.com"}, sources, Options{Template: count})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "5" {
+		t.Fatalf("Meta.Domains = %s, want 5", got)
+	}
+}
+
+// TestMatcherAgreesWithGeneratedPAC runs the JavaScript emitted by
+// Generate, with each layout and template, for random lists and checks it
+// decides every host the same way as Matcher.
+func TestMatcherAgreesWithGeneratedPAC(t *testing.T) {
+	rng := rand.New(rand.NewPCG(34, 1))
+	labels := []string{"a", "b", "ab", "example", "com", "net", "co", "x-y", "1"}
+
+	randomDomain := func() string {
+		parts := make([]string, 1+rng.IntN(3))
+		for i := range parts {
+			parts[i] = labels[rng.IntN(len(labels))]
+		}
+		return strings.Join(parts, ".")
+	}
+	randomList := func() []string {
+		list := make([]string, rng.IntN(6))
+		for i := range list {
+			list[i] = randomDomain()
+		}
+		return list
+	}
+
+	// The template gfwlist.pac is built with.
+	example, err := pac.ParseTemplateFile("../../gfwlist.pac.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := []Options{
+		{Layout: LayoutList},
+		{Layout: LayoutTrie},
+		{Template: example},
+		{Layout: LayoutList, Minify: true},
+		{Layout: LayoutTrie, Minify: true},
+		{Template: example, Minify: true},
+	}
+
+	for round := 0; round < 300; round++ {
+		noproxy, custom, gfwlist, extra := randomList(), randomList(), randomList(), randomList()
+		opts := variants[round%len(variants)]
+		opts.Proxy = "PROXY 127.0.0.1:3128"
+		var src string
+		var m *Matcher
+		if round%2 == 0 {
+			src, _, err = Generate(noproxy, custom, gfwlist, opts)
+			m = NewMatcher(noproxy, custom, gfwlist, "PROXY 127.0.0.1:3128")
+		} else {
+			sources := []Source{
+				{Name: "gfwlist", Domains: gfwlist},
+				{Name: "extra", Proxy: "SOCKS5 127.0.0.1:1080", Domains: extra},
+			}
+			src, _, err = GenerateSources(noproxy, custom, sources, opts)
+			m = NewSourceMatcher(noproxy, custom, sources, "PROXY 127.0.0.1:3128")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := pacjs.Load(src)
+		if err != nil {
+			t.Fatalf("load generated PAC %+v: %v\n%s", opts, err, src)
+		}
+
+		hosts := []string{"", "localhost", "10.0.0.1"}
+		for _, list := range [][]string{noproxy, custom, gfwlist, extra} {
+			for _, d := range list {
+				hosts = append(hosts, d, "www."+d, "x"+d, strings.ToUpper(d), d[1:])
+			}
+		}
+		for i := 0; i < 20; i++ {
+			hosts = append(hosts, randomDomain())
+		}
+
+		for _, host := range hosts {
+			want, err := script.FindProxyForURL("https://"+host+"/", host)
+			if err != nil {
+				t.Fatalf("FindProxyForURL(%q): %v", host, err)
+			}
+			if got := m.FindProxyForURL("https://"+host+"/", host); got != want {
+				t.Fatalf("host %q: PAC %+v returns %q, Matcher %q\nnoproxy=%q custom=%q gfwlist=%q extra=%q",
+					host, opts, want, got, noproxy, custom, gfwlist, extra)
+			}
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		format  SourceFormat
+		content string
+		domains string
+		diags   string
+	}{
+		{FormatPlain, "# comment\nExample.com\n.example.org # trailing\n*.example.net\nnot a domain\n.ai\n", "example.com,example.org,example.net,ai", "5:unsupported syntax"},
+		{FormatHosts, "127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com\n::1 ip6-localhost\nexample.org\n", "ads.example.com,tracker.example.com", "4:unsupported syntax"},
+		{FormatClash, "payload:\n  - DOMAIN-SUFFIX,google.com\n  - DOMAIN,www.example.com,PROXY\n  - DOMAIN-KEYWORD,google\n  - IP-CIDR,1.1.1.1/32\n  - '+.youtube.com'\n", "google.com,www.example.com,youtube.com", "4:wildcard,5:IP literal"},
+		{FormatSurge, "// comment\nDOMAIN-SUFFIX,github.com\nHOST-SUFFIX,twitter.com,proxy\n.telegram.org\nDOMAIN-REGEX,^a\nUSER-AGENT,foo*\n", "github.com,twitter.com,telegram.org", "5:regex,6:unsupported syntax"},
+		{FormatDnsmasq, "server=/baidu.com/114.114.114.114\nipset=/qq.com/taobao.com/china\n# comment\nno-resolv\naddress=/#/127.0.0.1\nserver=/cn.example/1.1.1.1 # trailing\n", "baidu.com,qq.com,taobao.com,cn.example", "4:unsupported syntax,5:invalid label"},
+		{FormatV2Fly, "google.com\nfull:www.google.com @cn\nkeyword:google\nregexp:^a\n", "google.com,www.google.com", "3:wildcard,4:regex"},
+	}
+	for _, tt := range tests {
+		entries, diags, err := ParseSource(tt.format, []byte(tt.content), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		var domains, got []string
+		for _, e := range entries {
+			domains = append(domains, e.Domain)
+		}
+		for _, d := range diags {
+			got = append(got, fmt.Sprintf("%d:%s", d.Line, d.Reason))
+		}
+		if strings.Join(domains, ",") != tt.domains {
+			t.Errorf("%s domains = %v, want %s", tt.format, domains, tt.domains)
+		}
+		if strings.Join(got, ",") != tt.diags {
+			t.Errorf("%s diagnostics = %v, want %s", tt.format, got, tt.diags)
+		}
+	}
+
+	if _, _, err := ParseSource(FormatGFWList, []byte("||example.com\n"), nil); err == nil {
+		t.Fatal("gfwlist format accepted plain text")
+	}
+	if _, err := ParseSourceFormat("yaml"); err == nil {
+		t.Fatal("ParseSourceFormat accepted an unknown format")
+	}
+}
+
+func TestParseSourceV2FlyInclude(t *testing.T) {
+	lists := map[string]string{
+		"google":  "google.com\ngoogle.cn @cn\ngoogle-analytics.com @ads\ninclude:youtube\n",
+		"youtube": "youtube.com\nyoutube.cn @cn\n",
+		"loop":    "include:loop\n",
+	}
+	include := func(name string) ([]byte, error) {
+		content, ok := lists[name]
+		if !ok {
+			return nil, fmt.Errorf("no list %s", name)
+		}
+		return []byte(content), nil
+	}
+
+	tests := []struct{ content, want string }{
+		{"include:google", "google.com,google.cn,google-analytics.com,youtube.com,youtube.cn"},
+		{"include:google @cn", "google.cn,youtube.cn"},
+		{"include:google @-cn @-ads\nexample.com", "google.com,youtube.com,example.com"},
+	}
+	for _, tt := range tests {
+		entries, _, err := ParseSource(FormatV2Fly, []byte(tt.content), include)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.content, err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Domain)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%q = %v, want %s", tt.content, got, tt.want)
+		}
+	}
+
+	if _, _, err := ParseSource(FormatV2Fly, []byte("include:loop"), include); err == nil {
+		t.Fatal("include cycle not reported")
+	}
+	if _, _, err := ParseSource(FormatV2Fly, []byte("include:missing"), include); err == nil {
+		t.Fatal("missing include not reported")
+	}
+	_, diags, err := ParseSource(FormatV2Fly, []byte("include:google"), nil)
+	if err != nil || len(diags) != 1 || diags[0].Reason != ReasonUnsupported {
+		t.Fatalf("include without a loader: diags %+v, err %v", diags, err)
+	}
+}
+
+// benchDomains returns n distinct domains shaped roughly like a combined
+// gfwlist: mostly second-level names under a few common TLDs.
+func benchDomains(n int) []string {
+	rng := rand.New(rand.NewPCG(38, 1))
+	tlds := []string{"com", "net", "org", "io", "jp", "co.uk", "com.hk", "tw"}
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	seen := make(map[string]bool, n)
+	domains := make([]string, 0, n)
+	for len(domains) < n {
+		label := make([]byte, 4+rng.IntN(10))
+		for i := range label {
+			label[i] = letters[rng.IntN(26+10*min(i, 1))]
+		}
+		d := string(label) + "." + tlds[rng.IntN(len(tlds))]
+		if rng.IntN(5) == 0 {
+			d = "cdn" + strconv.Itoa(rng.IntN(10)) + "." + d
+		}
+		if !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// benchLayout is one PAC form the benchmarks compare.
+type benchLayout struct {
+	name string
+	opts Options
+}
+
+// benchLayouts returns the built-in list and trie layouts and the plain
+// map of gfwlist.pac.tmpl, which looks every parent domain of a host up in
+// one object.
+func benchLayouts(b *testing.B) []benchLayout {
+	example, err := pac.ParseTemplateFile("../../gfwlist.pac.tmpl")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return []benchLayout{
+		{"list", Options{Layout: LayoutList}},
+		{"trie", Options{Layout: LayoutTrie}},
+		{"map", Options{Template: example}},
+	}
+}
+
+func BenchmarkGeneratePAC(b *testing.B) {
+	domains := benchDomains(50000)
+	for _, l := range benchLayouts(b) {
+		for _, minify := range []bool{false, true} {
+			name, opts := l.name, l.opts
+			if opts.Minify = minify; minify {
+				name += "-minify"
+			}
+			b.Run(name, func(b *testing.B) {
+				var size int
+				for b.Loop() {
+					pac, _, err := Generate(nil, nil, domains, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(pac)
+				}
+				b.ReportMetric(float64(size), "pac-bytes")
+			})
+		}
+	}
+}
+
+// BenchmarkFindProxyForURL measures lookups in the generated PAC with the
+// test interpreter. Absolute times are far slower than a browser engine,
+// but the layouts compare the same way.
+func BenchmarkFindProxyForURL(b *testing.B) {
+	domains := benchDomains(50000)
+	hosts := []string{"www." + domains[len(domains)/2], domains[len(domains)-1], "unlisted.example.org"}
+	for _, l := range benchLayouts(b) {
+		b.Run(l.name, func(b *testing.B) {
+			pac, _, err := Generate(nil, nil, domains, l.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			script, err := pacjs.Load(pac)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i := 0
+			for b.Loop() {
+				host := hosts[i%len(hosts)]
+				if _, err := script.FindProxyForURL("https://"+host+"/", host); err != nil {
+					b.Fatal(err)
+				}
+				i++
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package pacgen
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SourceFormat is the syntax of a domain source. Every format yields
+// domains, and a domain matches itself and its subdomains, so rules that
+// match one exact host or URL are widened to the host and its subdomains.
+type SourceFormat string
+
+const (
+	// FormatAuto is a gfwlist that may or may not be base64 encoded,
+	// decided by DecodeMaybeBase64.
+	FormatAuto SourceFormat = "auto"
+	// FormatGFWList is a base64 encoded gfwlist of adblock-style rules.
+	// URL rules such as |http://example.com/path are widened to their
+	// host, whatever the scheme and path.
+	FormatGFWList SourceFormat = "gfwlist"
+	// FormatPlain is one domain per line with # comments. A leading "."
+	// or "*." is allowed.
+	FormatPlain SourceFormat = "plain"
+	// FormatHosts is a hosts file. Every name after the address is read as
+	// a domain, so it matches its subdomains too.
+	FormatHosts SourceFormat = "hosts"
+	// FormatClash is a Clash rule provider or rules list, classical
+	// (DOMAIN-SUFFIX,example.com) or domain behavior (+.example.com).
+	// Exact DOMAIN rules are widened to suffixes.
+	FormatClash SourceFormat = "clash"
+	// FormatSurge is a Surge or Quantumult X rule list, or a Surge domain
+	// set. Exact DOMAIN and HOST rules are widened to suffixes, as are
+	// domain set entries without a leading ".".
+	FormatSurge SourceFormat = "surge"
+	// FormatDnsmasq is dnsmasq configuration such as dnsmasq-china-list:
+	// the domains of server=, ipset= and nftset= lines.
+	FormatDnsmasq SourceFormat = "dnsmasq"
+	// FormatV2Fly is a v2fly domain-list-community data file, with
+	// include: lines and @attribute filters. Exact full: entries are
+	// widened to suffixes.
+	FormatV2Fly SourceFormat = "v2fly"
+)
+
+var sourceFormats = []SourceFormat{FormatAuto, FormatGFWList, FormatPlain, FormatHosts, FormatClash, FormatSurge, FormatDnsmasq, FormatV2Fly}
+
+// ParseSourceFormat returns the SourceFormat named s.
+func ParseSourceFormat(s string) (SourceFormat, error) {
+	for _, f := range sourceFormats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	names := make([]string, len(sourceFormats))
+	for i, f := range sourceFormats {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("unknown source format %q (want %s)", s, strings.Join(names, ", "))
+}
+
+// IncludeFunc returns the content of the v2fly list a source includes by
+// name.
+type IncludeFunc func(name string) ([]byte, error)
+
+// IncludeDir returns an IncludeFunc reading the named lists from files in
+// dir.
+func IncludeDir(dir string) IncludeFunc {
+	return func(name string) ([]byte, error) {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid list name %q", name)
+		}
+		return os.ReadFile(filepath.Join(dir, name))
+	}
+}
+
+// ParseSource parses content in format. It returns every domain in input
+// order with where it came from, and the lines that yielded none. include
+// resolves v2fly include: lines; with a nil include they are reported as
+// unsupported.
+func ParseSource(format SourceFormat, content []byte, include IncludeFunc) ([]Entry, []Diagnostic, error) {
+	switch format {
+	case FormatAuto, "":
+		raw, decodeDiags, err := DecodeMaybeBase64Diagnostics(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries, diags := ParseDomainDiagnostics(string(raw))
+		return entries, append(decodeDiags, diags...), nil
+	case FormatGFWList:
+		raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(content)), ""))
+		if err != nil {
+			return nil, nil, fmt.Errorf("gfwlist is not base64: %w", err)
+		}
+		entries, diags := ParseDomainDiagnostics(string(raw))
+		return entries, diags, nil
+	case FormatPlain:
+		entries, diags := parseLines(content, plainLine)
+		return entries, diags, nil
+	case FormatHosts:
+		entries, diags := parseLines(content, hostsLine)
+		return entries, diags, nil
+	case FormatClash, FormatSurge:
+		entries, diags := parseLines(content, ruleLine)
+		return entries, diags, nil
+	case FormatDnsmasq:
+		entries, diags := parseLines(content, dnsmasqLine)
+		return entries, diags, nil
+	case FormatV2Fly:
+		entries, diags, err := parseV2Fly(content, include, nil, nil, 0)
+		return entries, diags, err
+	}
+	return nil, nil, fmt.Errorf("unknown source format %q", format)
+}
+
+// EntryDomains returns the sorted unique domains of entries.
+func EntryDomains(entries []Entry) []string {
+	set := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		set[e.Domain] = struct{}{}
+	}
+	return SortedDomains(set)
+}
+
+// lineParser returns the domains of one trimmed, non-comment line, or the
+// reason it has none.
+type lineParser func(line string) ([]string, Reason)
+
+// parseLines runs parse on every line of content that is not blank or a
+// comment. Comments start with "#" at the start of a line or after white
+// space, or with "//" or ";" at the start of a line.
+func parseLines(content []byte, parse lineParser) ([]Entry, []Diagnostic) {
+	var entries []Entry
+	var diags []Diagnostic
+	s := bufio.NewScanner(strings.NewReader(string(content)))
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		raw := strings.TrimSpace(s.Text())
+		line := stripComment(raw)
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		domains, reason := parse(line)
+		if len(domains) == 0 {
+			if reason != "" {
+				diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: reason})
+			}
+			continue
+		}
+		for _, d := range domains {
+			entries = append(entries, Entry{Domain: d, Line: lineNo, Raw: raw})
+		}
+	}
+	return entries, diags
+}
+
+// stripComment cuts a "#" comment off line. The "#" must start the line or
+// follow white space, so dnsmasq's address=/#/ keeps its "#".
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// domainReason normalizes s as a domain, or says why it is not one.
+func domainReason(s string) (string, Reason) {
+	if d, ok := normalizeDomain(s); ok {
+		return d, ""
+	}
+	switch t := strings.Trim(s, "."); {
+	case net.ParseIP(t) != nil:
+		return "", ReasonIPLiteral
+	case strings.Contains(t, "*"):
+		return "", ReasonWildcard
+	}
+	return "", ReasonInvalidLabel
+}
+
+func single(s string) ([]string, Reason) {
+	d, reason := domainReason(s)
+	if reason != "" {
+		return nil, reason
+	}
+	return []string{d}, ""
+}
+
+func plainLine(line string) ([]string, Reason) {
+	if strings.ContainsAny(line, " \t") {
+		return nil, ReasonUnsupported
+	}
+	// A TLD entry like ".ai" is accepted as in domains.txt.
+	if tld, ok := tldEntry(line); ok {
+		return []string{tld}, ""
+	}
+	return single(line)
+}
+
+// hostsNames are names hosts files map that are not domains to route.
+var hostsNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true,
+}
+
+func hostsLine(line string) ([]string, Reason) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, ReasonUnsupported
+	}
+	var domains []string
+	var reason Reason
+	for _, name := range fields[1:] {
+		if hostsNames[strings.ToLower(name)] {
+			continue
+		}
+		d, r := domainReason(name)
+		if r != "" {
+			reason = r
+			continue
+		}
+		domains = append(domains, d)
+	}
+	if len(domains) == 0 && reason == "" {
+		return nil, "" // only local names
+	}
+	return domains, reason
+}
+
+// ruleLine reads a Clash, Surge or Quantumult X rule, or an entry of a
+// domain set. Only rules matching a domain or its suffix yield domains;
+// exact DOMAIN and HOST rules yield their domain, which matches its
+// subdomains too.
+func ruleLine(line string) ([]string, Reason) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+	line = strings.Trim(line, `'"`)
+	if line == "payload:" || line == "rules:" || line == "payload: []" {
+		return nil, ""
+	}
+	if !strings.Contains(line, ",") {
+		// Domain behavior or domain set entry: example.com, .example.com
+		// or +.example.com all match the domain and its subdomains.
+		return single(strings.TrimPrefix(line, "+"))
+	}
+	fields := strings.Split(line, ",")
+	switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+	case "DOMAIN-SUFFIX", "HOST-SUFFIX", "DOMAIN", "HOST":
+		return single(strings.TrimSpace(fields[1]))
+	case "DOMAIN-KEYWORD", "HOST-KEYWORD", "DOMAIN-WILDCARD", "HOST-WILDCARD":
+		return nil, ReasonWildcard
+	case "DOMAIN-REGEX":
+		return nil, ReasonRegex
+	case "IP-CIDR", "IP-CIDR6", "IP6-CIDR", "IP-ASN", "GEOIP", "SRC-IP-CIDR":
+		return nil, ReasonIPLiteral
+	}
+	return nil, ReasonUnsupported
+}
+
+// dnsmasqLine reads the domains of a server=/a/b/addr, ipset=, nftset= or
+// address= line.
+func dnsmasqLine(line string) ([]string, Reason) {
+	key, value, ok := strings.Cut(line, "=")
+	switch strings.TrimSpace(key) {
+	case "server", "local", "ipset", "nftset", "address":
+	default:
+		return nil, ReasonUnsupported
+	}
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if !ok || len(parts) < 3 || parts[0] != "" {
+		return nil, ReasonUnsupported
+	}
+	var domains []string
+	var reason Reason
+	for _, name := range parts[1 : len(parts)-1] {
+		d, r := domainReason(name)
+		if r != "" {
+			reason = r
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains, reason
+}
+
+// maxIncludeDepth bounds v2fly include chains, which may form cycles.
+const maxIncludeDepth = 16
+
+// parseV2Fly parses a v2fly data file at an include depth. An entry is
+// kept when it has every attribute in want and none in unwanted, which
+// come from the include: lines that led to the file. full: entries match
+// subdomains too, like every other entry.
+func parseV2Fly(content []byte, include IncludeFunc, want, unwanted []string, depth int) ([]Entry, []Diagnostic, error) {
+	var entries []Entry
+	var diags []Diagnostic
+	s := bufio.NewScanner(strings.NewReader(string(content)))
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		raw := strings.TrimSpace(s.Text())
+		line := raw
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		rule, attrs := fields[0], fields[1:]
+		kind, value, ok := strings.Cut(rule, ":")
+		if !ok {
+			kind, value = "domain", rule
+		}
+
+		if kind == "include" {
+			if include == nil {
+				diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: ReasonUnsupported})
+				continue
+			}
+			if depth >= maxIncludeDepth {
+				return nil, nil, fmt.Errorf("include %s: too deeply nested", value)
+			}
+			var incWant, incUnwanted []string
+			for _, a := range attrs {
+				if name, ok := strings.CutPrefix(a, "@-"); ok {
+					incUnwanted = append(incUnwanted, name)
+				} else {
+					incWant = append(incWant, strings.TrimPrefix(a, "@"))
+				}
+			}
+			content, err := include(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("include %s: %w", value, err)
+			}
+			incEntries, incDiags, err := parseV2Fly(content, include, append(incWant, want...), append(incUnwanted, unwanted...), depth+1)
+			if err != nil {
+				return nil, nil, fmt.Errorf("include %s: %w", value, err)
+			}
+			entries = append(entries, incEntries...)
+			diags = append(diags, incDiags...)
+			continue
+		}
+
+		if !hasAttrs(attrs, want, unwanted) {
+			continue
+		}
+		switch kind {
+		case "domain", "full":
+			d, reason := domainReason(value)
+			if reason != "" {
+				diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: reason})
+				continue
+			}
+			entries = append(entries, Entry{Domain: d, Line: lineNo, Raw: raw})
+		case "regexp":
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: ReasonRegex})
+		case "keyword":
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: ReasonWildcard})
+		default:
+			diags = append(diags, Diagnostic{Line: lineNo, Raw: raw, Reason: ReasonUnsupported})
+		}
+	}
+	return entries, diags, nil
+}
+
+// hasAttrs reports whether the @attributes of an entry include every
+// wanted one and no unwanted one.
+func hasAttrs(attrs, want, unwanted []string) bool {
+	has := make(map[string]bool, len(attrs))
+	for _, a := range attrs {
+		has[strings.TrimPrefix(a, "@")] = true
+	}
+	for _, a := range want {
+		if !has[a] {
+			return false
+		}
+	}
+	for _, a := range unwanted {
+		if has[a] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,400 @@
+package pacjs
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+func native(name string, fn func(this value, args []value) (value, error)) *function {
+	return &function{name: name, native: fn}
+}
+
+func thisString(this value) (string, error) {
+	switch this.(type) {
+	case undefinedType, null:
+		return "", errors.New("TypeError: called on null or undefined")
+	}
+	return toString(this), nil
+}
+
+// stringMethod adapts a method body that only needs the receiver as a
+// string.
+func stringMethod(name string, fn func(s string, args []value) value) *function {
+	return native(name, func(this value, args []value) (value, error) {
+		s, err := thisString(this)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s, args), nil
+	})
+}
+
+// clampIndex converts a relative position to an index in [0, n]; negative
+// positions count from the end when fromEnd is set.
+func clampIndex(v value, n int, fromEnd bool) int {
+	i := toInteger(v)
+	if i < 0 && fromEnd {
+		i += float64(n)
+	}
+	return int(math.Max(0, math.Min(float64(n), i)))
+}
+
+// String methods index by byte, which matches JavaScript for the ASCII
+// host names and URLs PAC files work with.
+var stringMethods = map[string]*function{
+	"toLowerCase": stringMethod("toLowerCase", func(s string, args []value) value {
+		return strings.ToLower(s)
+	}),
+	"toUpperCase": stringMethod("toUpperCase", func(s string, args []value) value {
+		return strings.ToUpper(s)
+	}),
+	"trim": stringMethod("trim", func(s string, args []value) value {
+		return strings.TrimSpace(s)
+	}),
+	"indexOf": stringMethod("indexOf", func(s string, args []value) value {
+		from := clampIndex(arg(args, 1), len(s), false)
+		i := strings.Index(s[from:], toString(arg(args, 0)))
+		if i < 0 {
+			return float64(-1)
+		}
+		return float64(from + i)
+	}),
+	"lastIndexOf": stringMethod("lastIndexOf", func(s string, args []value) value {
+		sub := toString(arg(args, 0))
+		end := len(s)
+		if n := toNumber(arg(args, 1)); !math.IsNaN(n) {
+			end = clampIndex(n, len(s), false) + len(sub)
+			end = min(end, len(s))
+		}
+		return float64(strings.LastIndex(s[:end], sub))
+	}),
+	"startsWith": stringMethod("startsWith", func(s string, args []value) value {
+		from := clampIndex(arg(args, 1), len(s), false)
+		return strings.HasPrefix(s[from:], toString(arg(args, 0)))
+	}),
+	"endsWith": stringMethod("endsWith", func(s string, args []value) value {
+		end := len(s)
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			end = clampIndex(arg(args, 1), len(s), false)
+		}
+		return strings.HasSuffix(s[:end], toString(arg(args, 0)))
+	}),
+	"charAt": stringMethod("charAt", func(s string, args []value) value {
+		i := toInteger(arg(args, 0))
+		if i < 0 || i >= float64(len(s)) {
+			return ""
+		}
+		return s[int(i) : int(i)+1]
+	}),
+	"charCodeAt": stringMethod("charCodeAt", func(s string, args []value) value {
+		i := toInteger(arg(args, 0))
+		if i < 0 || i >= float64(len(s)) {
+			return math.NaN()
+		}
+		return float64(s[int(i)])
+	}),
+	"substring": stringMethod("substring", func(s string, args []value) value {
+		start := clampIndex(arg(args, 0), len(s), false)
+		end := len(s)
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			end = clampIndex(arg(args, 1), len(s), false)
+		}
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end]
+	}),
+	"substr": stringMethod("substr", func(s string, args []value) value {
+		start := clampIndex(arg(args, 0), len(s), true)
+		end := len(s)
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			end = start + clampIndex(arg(args, 1), len(s)-start, false)
+		}
+		return s[start:end]
+	}),
+	"slice": stringMethod("slice", func(s string, args []value) value {
+		start := clampIndex(arg(args, 0), len(s), true)
+		end := len(s)
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			end = clampIndex(arg(args, 1), len(s), true)
+		}
+		if start > end {
+			return ""
+		}
+		return s[start:end]
+	}),
+	"split": stringMethod("split", func(s string, args []value) value {
+		var parts []string
+		if _, ok := arg(args, 0).(undefinedType); ok {
+			parts = []string{s}
+		} else {
+			parts = strings.Split(s, toString(arg(args, 0)))
+			if s == "" && toString(arg(args, 0)) == "" {
+				parts = nil
+			}
+		}
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			parts = parts[:min(len(parts), int(toUint32(arg(args, 1))))]
+		}
+		a := &array{elems: make([]value, len(parts))}
+		for i, p := range parts {
+			a.elems[i] = p
+		}
+		return a
+	}),
+	"replace": stringMethod("replace", func(s string, args []value) value {
+		return strings.Replace(s, toString(arg(args, 0)), toString(arg(args, 1)), 1)
+	}),
+	"concat": stringMethod("concat", func(s string, args []value) value {
+		var b strings.Builder
+		b.WriteString(s)
+		for _, a := range args {
+			b.WriteString(toString(a))
+		}
+		return b.String()
+	}),
+	"toString": stringMethod("toString", func(s string, args []value) value {
+		return s
+	}),
+}
+
+func thisArray(this value) (*array, error) {
+	a, ok := this.(*array)
+	if !ok {
+		return nil, errors.New("TypeError: not an array")
+	}
+	return a, nil
+}
+
+var arrayMethods = map[string]*function{
+	"indexOf": native("indexOf", func(this value, args []value) (value, error) {
+		a, err := thisArray(this)
+		if err != nil {
+			return nil, err
+		}
+		for i := clampIndex(arg(args, 1), len(a.elems), true); i < len(a.elems); i++ {
+			if strictEquals(a.elems[i], arg(args, 0)) {
+				return float64(i), nil
+			}
+		}
+		return float64(-1), nil
+	}),
+	"join": native("join", func(this value, args []value) (value, error) {
+		a, err := thisArray(this)
+		if err != nil {
+			return nil, err
+		}
+		sep := ","
+		if _, ok := arg(args, 0).(undefinedType); !ok {
+			sep = toString(arg(args, 0))
+		}
+		parts := make([]string, len(a.elems))
+		for i, e := range a.elems {
+			if !isNullish(e) {
+				parts[i] = toString(e)
+			}
+		}
+		return strings.Join(parts, sep), nil
+	}),
+	"push": native("push", func(this value, args []value) (value, error) {
+		a, err := thisArray(this)
+		if err != nil {
+			return nil, err
+		}
+		a.elems = append(a.elems, args...)
+		return float64(len(a.elems)), nil
+	}),
+	"pop": native("pop", func(this value, args []value) (value, error) {
+		a, err := thisArray(this)
+		if err != nil {
+			return nil, err
+		}
+		if len(a.elems) == 0 {
+			return undefined, nil
+		}
+		last := a.elems[len(a.elems)-1]
+		a.elems = a.elems[:len(a.elems)-1]
+		return last, nil
+	}),
+	"slice": native("slice", func(this value, args []value) (value, error) {
+		a, err := thisArray(this)
+		if err != nil {
+			return nil, err
+		}
+		start := clampIndex(arg(args, 0), len(a.elems), true)
+		end := len(a.elems)
+		if _, ok := arg(args, 1).(undefinedType); !ok {
+			end = clampIndex(arg(args, 1), len(a.elems), true)
+		}
+		if start > end {
+			start = end
+		}
+		return &array{elems: append([]value(nil), a.elems[start:end]...)}, nil
+	}),
+}
+
+var hasOwnProperty = native("hasOwnProperty", func(this value, args []value) (value, error) {
+	o, ok := this.(*object)
+	if !ok {
+		return false, nil
+	}
+	_, has := o.props[toString(arg(args, 0))]
+	return has, nil
+})
+
+func (s *Script) installGlobals() {
+	g := s.global.vars
+	g["undefined"] = undefined
+	g["NaN"] = math.NaN()
+	g["Infinity"] = math.Inf(1)
+
+	g["String"] = native("String", func(_ value, args []value) (value, error) {
+		if len(args) == 0 {
+			return "", nil
+		}
+		return toString(args[0]), nil
+	})
+	g["isNaN"] = native("isNaN", func(_ value, args []value) (value, error) {
+		return math.IsNaN(toNumber(arg(args, 0))), nil
+	})
+	g["parseInt"] = native("parseInt", func(_ value, args []value) (value, error) {
+		return parseInt(toString(arg(args, 0)), int(toInt32(arg(args, 1)))), nil
+	})
+
+	// PAC helper functions, following the Mozilla reference
+	// implementation. The date and time range helpers are not provided.
+	g["isPlainHostName"] = native("isPlainHostName", func(_ value, args []value) (value, error) {
+		return !strings.ContainsAny(toString(arg(args, 0)), ".:"), nil
+	})
+	g["dnsDomainIs"] = native("dnsDomainIs", func(_ value, args []value) (value, error) {
+		return strings.HasSuffix(toString(arg(args, 0)), toString(arg(args, 1))), nil
+	})
+	g["localHostOrDomainIs"] = native("localHostOrDomainIs", func(_ value, args []value) (value, error) {
+		host, hostdom := toString(arg(args, 0)), toString(arg(args, 1))
+		return host == hostdom || strings.HasPrefix(hostdom, host+"."), nil
+	})
+	g["dnsDomainLevels"] = native("dnsDomainLevels", func(_ value, args []value) (value, error) {
+		return float64(strings.Count(toString(arg(args, 0)), ".")), nil
+	})
+	g["shExpMatch"] = native("shExpMatch", func(_ value, args []value) (value, error) {
+		return shExpMatch(toString(arg(args, 0)), toString(arg(args, 1))), nil
+	})
+	g["dnsResolve"] = native("dnsResolve", func(_ value, args []value) (value, error) {
+		if ip, ok := s.resolve(toString(arg(args, 0))); ok {
+			return ip, nil
+		}
+		return null{}, nil
+	})
+	g["isResolvable"] = native("isResolvable", func(_ value, args []value) (value, error) {
+		_, ok := s.resolve(toString(arg(args, 0)))
+		return ok, nil
+	})
+	g["myIpAddress"] = native("myIpAddress", func(_ value, args []value) (value, error) {
+		if s.DNSResolve != nil {
+			if ip, ok := s.DNSResolve("localhost"); ok {
+				return ip, nil
+			}
+		}
+		return "127.0.0.1", nil
+	})
+	g["isInNet"] = native("isInNet", func(_ value, args []value) (value, error) {
+		ip, ok := s.resolve(toString(arg(args, 0)))
+		if !ok {
+			return false, nil
+		}
+		addr, pattern, mask := ipv4(ip), ipv4(toString(arg(args, 1))), ipv4(toString(arg(args, 2)))
+		if addr == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		return addr.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+	})
+	g["convert_addr"] = native("convert_addr", func(_ value, args []value) (value, error) {
+		ip := ipv4(toString(arg(args, 0)))
+		if ip == nil {
+			return float64(0), nil
+		}
+		return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+	})
+	g["alert"] = native("alert", func(_ value, args []value) (value, error) {
+		return undefined, nil
+	})
+}
+
+// resolve returns host itself when it is an IP address and otherwise asks
+// DNSResolve.
+func (s *Script) resolve(host string) (string, bool) {
+	if net.ParseIP(host) != nil {
+		return host, true
+	}
+	if s.DNSResolve == nil {
+		return "", false
+	}
+	return s.DNSResolve(host)
+}
+
+func ipv4(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	return ip.To4()
+}
+
+// shExpMatch matches str against a shell expression where * matches any
+// run of characters and ? any single character.
+func shExpMatch(str, pattern string) bool {
+	if pattern == "" {
+		return str == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(str); i++ {
+			if shExpMatch(str[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return str != "" && shExpMatch(str[1:], pattern[1:])
+	}
+	return str != "" && str[0] == pattern[0] && shExpMatch(str[1:], pattern[1:])
+}
+
+func parseInt(s string, radix int) float64 {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if (radix == 0 || radix == 16) && len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s, radix = s[2:], 16
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	if radix < 2 || radix > 36 {
+		return math.NaN()
+	}
+	end := 0
+	for end < len(s) {
+		if _, err := strconv.ParseInt(s[end:end+1], radix, 8); err != nil {
+			break
+		}
+		end++
+	}
+	if end == 0 {
+		return math.NaN()
+	}
+	n, err := strconv.ParseInt(s[:end], radix, 64)
+	if err != nil {
+		f, _ := strconv.ParseFloat(s[:end], 64)
+		return sign * f
+	}
+	return sign * float64(n)
+}
@@ -0,0 +1,830 @@
+// Package pacjs is a small interpreter for the subset of ES5 used by PAC
+// files: var and function declarations, the usual statements and operators,
+// string, array and object values, and the PAC helper functions. It exists
+// so that tests can execute generated PAC files without a JavaScript engine.
+//
+// Not supported: new, this, exceptions other than throw, regular
+// expressions, getters and setters, prototypes and the date and time range
+// helpers. Strings are indexed by byte.
+package pacjs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// maxSteps bounds the statements and expressions evaluated by one
+	// call, so that a runaway loop fails instead of hanging.
+	maxSteps = 50_000_000
+	// maxDepth bounds recursion.
+	maxDepth = 256
+)
+
+var errStepLimit = errors.New("step limit exceeded")
+
+type scope struct {
+	vars   map[string]value
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: make(map[string]value), parent: parent}
+}
+
+func (sc *scope) lookup(name string) (value, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// assign sets name in the innermost scope declaring it, or as a global
+// like non-strict ES5.
+func (sc *scope) assign(name string, v value) {
+	for s := sc; ; s = s.parent {
+		if _, ok := s.vars[name]; ok || s.parent == nil {
+			s.vars[name] = v
+			return
+		}
+	}
+}
+
+type completion int
+
+const (
+	normal completion = iota
+	returned
+	broke
+	continued
+)
+
+// Script is a loaded program whose top level has run.
+type Script struct {
+	// DNSResolve resolves a host name for dnsResolve, isResolvable,
+	// isInNet and myIpAddress. When nil no host name resolves and
+	// myIpAddress returns 127.0.0.1.
+	DNSResolve func(host string) (string, bool)
+
+	global *scope
+	steps  int
+	depth  int
+	// labels are the labels of the statement exec runs next, and target
+	// is the label of a break or continue on its way out, "" for one
+	// that targets the innermost loop or switch.
+	labels []string
+	target string
+}
+
+// Load parses src and runs its top level.
+func Load(src string) (*Script, error) {
+	prog, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{global: newScope(nil)}
+	s.installGlobals()
+	s.hoist(s.global, prog.top)
+	if _, _, err := s.execBlock(s.global, prog.top.body); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FindProxyForURL calls the script's FindProxyForURL function.
+func (s *Script) FindProxyForURL(url, host string) (string, error) {
+	v, err := s.Call("FindProxyForURL", url, host)
+	if err != nil {
+		return "", err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("FindProxyForURL returned %v, not a string", v)
+	}
+	return str, nil
+}
+
+// Call calls the global function name with string arguments and returns
+// its result converted to a Go value: nil for undefined and null, or a
+// bool, float64 or string. Objects are returned as their string form.
+func (s *Script) Call(name string, args ...string) (any, error) {
+	v, ok := s.global.vars[name]
+	fn, isFn := v.(*function)
+	if !ok || !isFn {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	vals := make([]value, len(args))
+	for i, a := range args {
+		vals[i] = a
+	}
+	s.steps = 0
+	res, err := s.call(fn, undefined, vals)
+	if err != nil {
+		return nil, err
+	}
+	switch res := res.(type) {
+	case undefinedType, null:
+		return nil, nil
+	case bool, float64, string:
+		return res, nil
+	}
+	return toString(res), nil
+}
+
+func (s *Script) hoist(sc *scope, fn *funcLit) {
+	for _, name := range fn.vars {
+		if _, ok := sc.vars[name]; !ok {
+			sc.vars[name] = undefined
+		}
+	}
+	for _, f := range fn.funcs {
+		sc.vars[f.name] = &function{name: f.name, lit: f, scope: sc}
+	}
+}
+
+func (s *Script) step() error {
+	s.steps++
+	if s.steps > maxSteps {
+		return errStepLimit
+	}
+	return nil
+}
+
+func (s *Script) call(fn *function, this value, args []value) (value, error) {
+	if fn.native != nil {
+		return fn.native(this, args)
+	}
+	if s.depth >= maxDepth {
+		return nil, errors.New("maximum call depth exceeded")
+	}
+	s.depth++
+	defer func() { s.depth-- }()
+
+	sc := newScope(fn.scope)
+	for i, p := range fn.lit.params {
+		sc.vars[p] = arg(args, i)
+	}
+	s.hoist(sc, fn.lit)
+	c, v, err := s.execBlock(sc, fn.lit.body)
+	if err != nil {
+		return nil, err
+	}
+	if c == returned {
+		return v, nil
+	}
+	return undefined, nil
+}
+
+func (s *Script) execBlock(sc *scope, body []stmt) (completion, value, error) {
+	for _, st := range body {
+		c, v, err := s.exec(sc, st)
+		if err != nil || c != normal {
+			return c, v, err
+		}
+	}
+	return normal, nil, nil
+}
+
+// loop runs one iteration of a loop body labeled labels and reports
+// whether the loop should stop, passing return completions and jumps to
+// outer labels through.
+func (s *Script) loop(sc *scope, body stmt, labels []string) (stop bool, c completion, v value, err error) {
+	c, v, err = s.exec(sc, body)
+	switch {
+	case err != nil || c == returned:
+		return true, c, v, err
+	case c == broke && s.target == "":
+		return true, normal, nil, nil
+	case c == broke:
+		return true, c, nil, nil
+	case c == continued && s.target != "" && !contains(labels, s.target):
+		return true, c, nil, nil
+	}
+	s.target = ""
+	return false, normal, nil, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Script) exec(sc *scope, st stmt) (completion, value, error) {
+	if err := s.step(); err != nil {
+		return normal, nil, err
+	}
+	labels := s.labels
+	s.labels = nil
+
+	switch st := st.(type) {
+	case *exprStmt:
+		_, err := s.eval(sc, st.x)
+		return normal, nil, err
+	case *varStmt:
+		for i, init := range st.inits {
+			if init == nil {
+				continue
+			}
+			v, err := s.eval(sc, init)
+			if err != nil {
+				return normal, nil, err
+			}
+			sc.assign(st.names[i], v)
+		}
+	case *funcDeclStmt, *emptyStmt:
+	case *blockStmt:
+		return s.execBlock(sc, st.body)
+	case *ifStmt:
+		test, err := s.eval(sc, st.test)
+		if err != nil {
+			return normal, nil, err
+		}
+		if toBoolean(test) {
+			return s.exec(sc, st.then)
+		}
+		if st.els != nil {
+			return s.exec(sc, st.els)
+		}
+	case *forStmt:
+		if st.init != nil {
+			if _, _, err := s.exec(sc, st.init); err != nil {
+				return normal, nil, err
+			}
+		}
+		for {
+			if st.test != nil {
+				test, err := s.eval(sc, st.test)
+				if err != nil {
+					return normal, nil, err
+				}
+				if !toBoolean(test) {
+					break
+				}
+			}
+			if stop, c, v, err := s.loop(sc, st.body, labels); stop {
+				return c, v, err
+			}
+			if st.update != nil {
+				if _, err := s.eval(sc, st.update); err != nil {
+					return normal, nil, err
+				}
+			}
+		}
+	case *forInStmt:
+		obj, err := s.eval(sc, st.obj)
+		if err != nil {
+			return normal, nil, err
+		}
+		for _, key := range enumerate(obj) {
+			sc.assign(st.name, key)
+			if stop, c, v, err := s.loop(sc, st.body, labels); stop {
+				return c, v, err
+			}
+		}
+	case *whileStmt:
+		for {
+			test, err := s.eval(sc, st.test)
+			if err != nil {
+				return normal, nil, err
+			}
+			if !toBoolean(test) {
+				break
+			}
+			if stop, c, v, err := s.loop(sc, st.body, labels); stop {
+				return c, v, err
+			}
+		}
+	case *doWhileStmt:
+		for {
+			if stop, c, v, err := s.loop(sc, st.body, labels); stop {
+				return c, v, err
+			}
+			test, err := s.eval(sc, st.test)
+			if err != nil {
+				return normal, nil, err
+			}
+			if !toBoolean(test) {
+				break
+			}
+		}
+	case *returnStmt:
+		if st.x == nil {
+			return returned, undefined, nil
+		}
+		v, err := s.eval(sc, st.x)
+		return returned, v, err
+	case *breakStmt:
+		s.target = st.label
+		return broke, nil, nil
+	case *continueStmt:
+		s.target = st.label
+		return continued, nil, nil
+	case *labeledStmt:
+		s.labels = append(labels, st.label)
+		c, v, err := s.exec(sc, st.body)
+		if c == broke && s.target == st.label {
+			s.target = ""
+			return normal, nil, err
+		}
+		return c, v, err
+	case *switchStmt:
+		return s.execSwitch(sc, st)
+	case *throwStmt:
+		v, err := s.eval(sc, st.x)
+		if err != nil {
+			return normal, nil, err
+		}
+		return normal, nil, fmt.Errorf("line %d: uncaught exception: %s", st.line, toString(v))
+	case *unsupportedStmt:
+		return normal, nil, fmt.Errorf("line %d: unsupported: %s", st.line, st.what)
+	default:
+		return normal, nil, fmt.Errorf("unknown statement %T", st)
+	}
+	return normal, nil, nil
+}
+
+func (s *Script) execSwitch(sc *scope, st *switchStmt) (completion, value, error) {
+	disc, err := s.eval(sc, st.disc)
+	if err != nil {
+		return normal, nil, err
+	}
+	start := -1
+	for i, c := range st.cases {
+		if c.test == nil {
+			continue
+		}
+		v, err := s.eval(sc, c.test)
+		if err != nil {
+			return normal, nil, err
+		}
+		if strictEquals(disc, v) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		for i, c := range st.cases {
+			if c.test == nil {
+				start = i
+			}
+		}
+	}
+	if start < 0 {
+		return normal, nil, nil
+	}
+	for _, c := range st.cases[start:] {
+		comp, v, err := s.execBlock(sc, c.body)
+		if err != nil {
+			return normal, nil, err
+		}
+		switch {
+		case comp == broke && s.target == "":
+			return normal, nil, nil
+		case comp != normal:
+			return comp, v, nil
+		}
+	}
+	return normal, nil, nil
+}
+
+// enumerate returns the keys a for-in loop visits.
+func enumerate(v value) []string {
+	var n int
+	switch v := v.(type) {
+	case *object:
+		return append([]string(nil), v.keys...)
+	case *array:
+		n = len(v.elems)
+	case string:
+		n = len(v)
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = numberToString(float64(i))
+	}
+	return keys
+}
+
+// ref is an assignable location: a variable or an object property.
+type ref struct {
+	sc   *scope
+	name string
+
+	obj  value
+	key  string
+	line int
+}
+
+func (s *Script) reference(sc *scope, x expr) (ref, error) {
+	switch x := x.(type) {
+	case *identExpr:
+		return ref{sc: sc, name: x.name, line: x.line}, nil
+	case *memberExpr:
+		obj, err := s.eval(sc, x.obj)
+		if err != nil {
+			return ref{}, err
+		}
+		key, err := s.eval(sc, x.prop)
+		if err != nil {
+			return ref{}, err
+		}
+		return ref{obj: obj, key: toString(key), line: x.line}, nil
+	}
+	return ref{}, fmt.Errorf("invalid assignment target %T", x)
+}
+
+func (s *Script) get(r ref) (value, error) {
+	if r.sc != nil {
+		v, ok := r.sc.lookup(r.name)
+		if !ok {
+			return nil, fmt.Errorf("line %d: ReferenceError: %s is not defined", r.line, r.name)
+		}
+		return v, nil
+	}
+	return s.getProp(r.obj, r.key, r.line)
+}
+
+func (s *Script) put(r ref, v value) error {
+	if r.sc != nil {
+		r.sc.assign(r.name, v)
+		return nil
+	}
+	return setProp(r.obj, r.key, v, r.line)
+}
+
+func (s *Script) eval(sc *scope, x expr) (value, error) {
+	if err := s.step(); err != nil {
+		return nil, err
+	}
+
+	switch x := x.(type) {
+	case *literal:
+		return x.v, nil
+	case *identExpr:
+		v, ok := sc.lookup(x.name)
+		if !ok {
+			return nil, fmt.Errorf("line %d: ReferenceError: %s is not defined", x.line, x.name)
+		}
+		return v, nil
+	case *arrayLit:
+		a := &array{elems: make([]value, len(x.elems))}
+		for i, e := range x.elems {
+			v, err := s.eval(sc, e)
+			if err != nil {
+				return nil, err
+			}
+			a.elems[i] = v
+		}
+		return a, nil
+	case *objectLit:
+		o := newObject()
+		for i, k := range x.keys {
+			v, err := s.eval(sc, x.vals[i])
+			if err != nil {
+				return nil, err
+			}
+			o.set(k, v)
+		}
+		return o, nil
+	case *funcExpr:
+		return &function{name: x.fn.name, lit: x.fn, scope: sc}, nil
+	case *memberExpr:
+		r, err := s.reference(sc, x)
+		if err != nil {
+			return nil, err
+		}
+		return s.get(r)
+	case *callExpr:
+		return s.evalCall(sc, x)
+	case *unaryExpr:
+		return s.evalUnary(sc, x)
+	case *updateExpr:
+		r, err := s.reference(sc, x.x)
+		if err != nil {
+			return nil, err
+		}
+		old, err := s.get(r)
+		if err != nil {
+			return nil, err
+		}
+		n := toNumber(old)
+		updated := n + 1
+		if x.op == "--" {
+			updated = n - 1
+		}
+		if err := s.put(r, updated); err != nil {
+			return nil, err
+		}
+		if x.prefix {
+			return updated, nil
+		}
+		return n, nil
+	case *binaryExpr:
+		l, err := s.eval(sc, x.l)
+		if err != nil {
+			return nil, err
+		}
+		r, err := s.eval(sc, x.r)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x.op, l, r, x.line)
+	case *logicalExpr:
+		l, err := s.eval(sc, x.l)
+		if err != nil {
+			return nil, err
+		}
+		if toBoolean(l) == (x.op == "||") {
+			return l, nil
+		}
+		return s.eval(sc, x.r)
+	case *condExpr:
+		test, err := s.eval(sc, x.test)
+		if err != nil {
+			return nil, err
+		}
+		if toBoolean(test) {
+			return s.eval(sc, x.then)
+		}
+		return s.eval(sc, x.els)
+	case *assignExpr:
+		r, err := s.reference(sc, x.target)
+		if err != nil {
+			return nil, err
+		}
+		v, err := s.eval(sc, x.val)
+		if err != nil {
+			return nil, err
+		}
+		if x.op != "=" {
+			old, err := s.get(r)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = binary(strings.TrimSuffix(x.op, "="), old, v, x.line); err != nil {
+				return nil, err
+			}
+		}
+		return v, s.put(r, v)
+	case *unsupportedExpr:
+		return nil, fmt.Errorf("line %d: unsupported: %s", x.line, x.what)
+	case *seqExpr:
+		var v value
+		for _, e := range x.list {
+			var err error
+			if v, err = s.eval(sc, e); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", x)
+}
+
+func (s *Script) evalCall(sc *scope, x *callExpr) (value, error) {
+	var callee, this value = nil, undefined
+	if m, ok := x.callee.(*memberExpr); ok {
+		r, err := s.reference(sc, m)
+		if err != nil {
+			return nil, err
+		}
+		if callee, err = s.get(r); err != nil {
+			return nil, err
+		}
+		this = r.obj
+	} else {
+		var err error
+		if callee, err = s.eval(sc, x.callee); err != nil {
+			return nil, err
+		}
+	}
+
+	args := make([]value, len(x.args))
+	for i, a := range x.args {
+		v, err := s.eval(sc, a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	fn, ok := callee.(*function)
+	if !ok {
+		return nil, fmt.Errorf("line %d: TypeError: %s is not a function", x.line, calleeName(x.callee))
+	}
+	v, err := s.call(fn, this, args)
+	if err != nil && fn.native != nil {
+		err = fmt.Errorf("line %d: %s: %w", x.line, calleeName(x.callee), err)
+	}
+	return v, err
+}
+
+func calleeName(x expr) string {
+	switch x := x.(type) {
+	case *identExpr:
+		return x.name
+	case *memberExpr:
+		if l, ok := x.prop.(*literal); ok {
+			if name, ok := l.v.(string); ok {
+				return calleeName(x.obj) + "." + name
+			}
+		}
+		return calleeName(x.obj) + "[...]"
+	}
+	return "expression"
+}
+
+func (s *Script) evalUnary(sc *scope, x *unaryExpr) (value, error) {
+	if id, ok := x.x.(*identExpr); ok && x.op == "typeof" {
+		if _, declared := sc.lookup(id.name); !declared {
+			return "undefined", nil
+		}
+	}
+	v, err := s.eval(sc, x.x)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "!":
+		return !toBoolean(v), nil
+	case "-":
+		return -toNumber(v), nil
+	case "+":
+		return toNumber(v), nil
+	case "~":
+		return float64(^toInt32(v)), nil
+	case "typeof":
+		return typeOf(v), nil
+	case "void":
+		return undefined, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", x.op)
+}
+
+func binary(op string, l, r value, line int) (value, error) {
+	switch op {
+	case "+":
+		lp, rp := toPrimitive(l), toPrimitive(r)
+		_, ls := lp.(string)
+		_, rs := rp.(string)
+		if ls || rs {
+			return toString(lp) + toString(rp), nil
+		}
+		return toNumber(lp) + toNumber(rp), nil
+	case "-":
+		return toNumber(l) - toNumber(r), nil
+	case "*":
+		return toNumber(l) * toNumber(r), nil
+	case "/":
+		return toNumber(l) / toNumber(r), nil
+	case "%":
+		return math.Mod(toNumber(l), toNumber(r)), nil
+	case "==":
+		return looseEquals(l, r), nil
+	case "!=":
+		return !looseEquals(l, r), nil
+	case "===":
+		return strictEquals(l, r), nil
+	case "!==":
+		return !strictEquals(l, r), nil
+	case "<", ">", "<=", ">=":
+		return compare(op, toPrimitive(l), toPrimitive(r)), nil
+	case "&":
+		return float64(toInt32(l) & toInt32(r)), nil
+	case "|":
+		return float64(toInt32(l) | toInt32(r)), nil
+	case "^":
+		return float64(toInt32(l) ^ toInt32(r)), nil
+	case "<<":
+		return float64(toInt32(l) << (toUint32(r) & 31)), nil
+	case ">>":
+		return float64(toInt32(l) >> (toUint32(r) & 31)), nil
+	case ">>>":
+		return float64(toUint32(l) >> (toUint32(r) & 31)), nil
+	case "in":
+		key := toString(l)
+		switch r := r.(type) {
+		case *object:
+			_, ok := r.props[key]
+			return ok, nil
+		case *array:
+			if i, ok := arrayIndex(key); ok {
+				return i < len(r.elems), nil
+			}
+			return key == "length", nil
+		}
+		return nil, fmt.Errorf("line %d: TypeError: cannot use 'in' on %s", line, typeOf(r))
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func compare(op string, l, r value) bool {
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs
+		case ">":
+			return ls > rs
+		case "<=":
+			return ls <= rs
+		}
+		return ls >= rs
+	}
+	ln, rn := toNumber(l), toNumber(r)
+	switch op {
+	case "<":
+		return ln < rn
+	case ">":
+		return ln > rn
+	case "<=":
+		return ln <= rn
+	}
+	return ln >= rn
+}
+
+func (s *Script) getProp(obj value, key string, line int) (value, error) {
+	switch o := obj.(type) {
+	case undefinedType, null:
+		return nil, fmt.Errorf("line %d: TypeError: cannot read property %q of %s", line, key, toString(o))
+	case string:
+		if key == "length" {
+			return float64(len(o)), nil
+		}
+		if i, ok := arrayIndex(key); ok {
+			if i < len(o) {
+				return o[i : i+1], nil
+			}
+			return undefined, nil
+		}
+		if m, ok := stringMethods[key]; ok {
+			return m, nil
+		}
+	case *array:
+		if key == "length" {
+			return float64(len(o.elems)), nil
+		}
+		if i, ok := arrayIndex(key); ok {
+			if i < len(o.elems) {
+				return o.elems[i], nil
+			}
+			return undefined, nil
+		}
+		if m, ok := arrayMethods[key]; ok {
+			return m, nil
+		}
+	case *object:
+		if v, ok := o.props[key]; ok {
+			return v, nil
+		}
+		if key == "hasOwnProperty" {
+			return hasOwnProperty, nil
+		}
+	case *function:
+		if key == "length" && o.lit != nil {
+			return float64(len(o.lit.params)), nil
+		}
+	}
+	return undefined, nil
+}
+
+func setProp(obj value, key string, v value, line int) error {
+	switch o := obj.(type) {
+	case undefinedType, null:
+		return fmt.Errorf("line %d: TypeError: cannot set property %q of %s", line, key, toString(o))
+	case *object:
+		o.set(key, v)
+	case *array:
+		if key == "length" {
+			n := toInteger(v)
+			if n < 0 || n > math.MaxInt32 {
+				return fmt.Errorf("line %d: RangeError: invalid array length", line)
+			}
+			o.resize(int(n))
+			return nil
+		}
+		if i, ok := arrayIndex(key); ok {
+			if i >= len(o.elems) {
+				o.resize(i + 1)
+			}
+			o.elems[i] = v
+		}
+	}
+	return nil
+}
+
+func (a *array) resize(n int) {
+	for len(a.elems) < n {
+		a.elems = append(a.elems, undefined)
+	}
+	a.elems = a.elems[:n]
+}
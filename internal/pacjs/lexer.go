@@ -0,0 +1,349 @@
+package pacjs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+	tokRegex
+)
+
+// token is one lexical token. text is the exact source text; str and num
+// hold the decoded value of string and number literals.
+type token struct {
+	kind tokenKind
+	text string
+	str  string
+	num  float64
+	line int
+	col  int
+	nl   bool // a line terminator precedes the token
+}
+
+// SyntaxError reports source that is not valid in the supported subset.
+type SyntaxError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// punctuators ordered so that longer operators are tried first.
+var punctuators = []string{
+	">>>=", "===", "!==", ">>>", "<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "<", ">",
+	"+", "-", "*", "/", "%", "&", "|", "^", "!", "~", "?", ":", "=",
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func tokenize(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1, col: 1}
+	toks := make([]token, 0, len(src)/4)
+	for {
+		nl, err := l.skipSpace()
+		if err != nil {
+			return nil, err
+		}
+		t, err := l.next(regexAllowed(toks))
+		if err != nil {
+			return nil, err
+		}
+		t.nl = nl
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, args ...any) error {
+	return &SyntaxError{Line: l.line, Col: l.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// advance moves past n bytes, keeping line and column up to date.
+func (l *lexer) advance(n int) {
+	for _, c := range l.src[l.pos : l.pos+n] {
+		if c == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+	}
+	l.pos += n
+}
+
+// skipSpace skips white space and comments and reports whether a line
+// terminator was among them.
+func (l *lexer) skipSpace() (bool, error) {
+	nl := false
+	for l.pos < len(l.src) {
+		rest := l.src[l.pos:]
+		switch {
+		case rest[0] == '\n':
+			nl = true
+			l.advance(1)
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r' || rest[0] == '\v' || rest[0] == '\f':
+			l.advance(1)
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			l.advance(end)
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return nl, l.errorf("unterminated comment")
+			}
+			if strings.Contains(rest[:end+4], "\n") {
+				nl = true
+			}
+			l.advance(end + 4)
+		default:
+			r, size := utf8.DecodeRuneInString(rest)
+			if r != ' ' && r != '\uFEFF' && !unicode.Is(unicode.Zs, r) {
+				return nl, nil
+			}
+			l.advance(size)
+		}
+	}
+	return nl, nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '$' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= 0x80 && unicode.IsLetter(r))
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || (r >= '0' && r <= '9') || (r >= 0x80 && unicode.IsDigit(r))
+}
+
+// regexAllowed reports whether a "/" after toks starts a regular
+// expression literal rather than a division: it does where an expression
+// is expected.
+func regexAllowed(toks []token) bool {
+	if len(toks) == 0 {
+		return true
+	}
+	switch prev := toks[len(toks)-1]; prev.kind {
+	case tokPunct:
+		return prev.text != ")" && prev.text != "]" && prev.text != "}"
+	case tokIdent:
+		switch prev.text {
+		case "return", "typeof", "instanceof", "in", "new", "delete", "void", "throw", "case", "do", "else":
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lexer) next(regexOK bool) (token, error) {
+	t := token{line: l.line, col: l.col}
+	if l.pos >= len(l.src) {
+		t.kind = tokEOF
+		return t, nil
+	}
+
+	start := l.pos
+	rest := l.src[l.pos:]
+	r, _ := utf8.DecodeRuneInString(rest)
+	switch {
+	case isIdentStart(r):
+		end := 0
+		for end < len(rest) {
+			r, size := utf8.DecodeRuneInString(rest[end:])
+			if !isIdentPart(r) {
+				break
+			}
+			end += size
+		}
+		l.advance(end)
+		t.kind = tokIdent
+	case r >= '0' && r <= '9' || (r == '.' && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9'):
+		n, err := l.number()
+		if err != nil {
+			return t, err
+		}
+		t.kind = tokNumber
+		t.num = n
+	case r == '/' && regexOK:
+		if err := l.regex(); err != nil {
+			return t, err
+		}
+		t.kind = tokRegex
+	case r == '"' || r == '\'':
+		s, err := l.string(byte(r))
+		if err != nil {
+			return t, err
+		}
+		t.kind = tokString
+		t.str = s
+	default:
+		for _, p := range punctuators {
+			if strings.HasPrefix(rest, p) {
+				l.advance(len(p))
+				t.kind = tokPunct
+				break
+			}
+		}
+		if t.kind != tokPunct {
+			return t, l.errorf("unexpected character %q", r)
+		}
+	}
+	t.text = l.src[start:l.pos]
+	return t, nil
+}
+
+// regex skips a regular expression literal and its flags.
+func (l *lexer) regex() error {
+	rest := l.src[l.pos:]
+	inClass := false
+	for i := 1; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case c == '\n':
+			return l.errorf("unterminated regular expression")
+		case c == '\\':
+			i++
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '/' && !inClass:
+			end := i + 1
+			for end < len(rest) && isIdentPart(rune(rest[end])) {
+				end++
+			}
+			l.advance(end)
+			return nil
+		}
+	}
+	return l.errorf("unterminated regular expression")
+}
+
+func (l *lexer) number() (float64, error) {
+	rest := l.src[l.pos:]
+	if len(rest) > 1 && rest[0] == '0' && (rest[1] == 'x' || rest[1] == 'X') {
+		end := 2
+		for end < len(rest) && strings.IndexByte("0123456789abcdefABCDEF", rest[end]) >= 0 {
+			end++
+		}
+		n, err := strconv.ParseUint(rest[2:end], 16, 64)
+		if err != nil {
+			return 0, l.errorf("invalid number %q", rest[:end])
+		}
+		l.advance(end)
+		return float64(n), nil
+	}
+
+	end := 0
+	digits := func() {
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+	}
+	digits()
+	if end < len(rest) && rest[end] == '.' {
+		end++
+		digits()
+	}
+	if end < len(rest) && (rest[end] == 'e' || rest[end] == 'E') {
+		end++
+		if end < len(rest) && (rest[end] == '+' || rest[end] == '-') {
+			end++
+		}
+		digits()
+	}
+	if end < len(rest) {
+		if r, _ := utf8.DecodeRuneInString(rest[end:]); isIdentStart(r) {
+			return 0, l.errorf("identifier directly after number")
+		}
+	}
+	n, err := strconv.ParseFloat(rest[:end], 64)
+	if err != nil {
+		return 0, l.errorf("invalid number %q", rest[:end])
+	}
+	l.advance(end)
+	return n, nil
+}
+
+func (l *lexer) string(quote byte) (string, error) {
+	var b strings.Builder
+	i := l.pos + 1
+	for {
+		if i >= len(l.src) || l.src[i] == '\n' {
+			return "", l.errorf("unterminated string")
+		}
+		c := l.src[i]
+		if c == quote {
+			l.advance(i + 1 - l.pos)
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(l.src) {
+			return "", l.errorf("unterminated string")
+		}
+		e := l.src[i+1]
+		i += 2
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			// Line continuation.
+		case 'x', 'u':
+			n := 2
+			if e == 'u' {
+				n = 4
+			}
+			if i+n > len(l.src) {
+				return "", l.errorf("invalid escape sequence")
+			}
+			v, err := strconv.ParseUint(l.src[i:i+n], 16, 32)
+			if err != nil {
+				return "", l.errorf("invalid escape sequence \\%c%s", e, l.src[i:i+n])
+			}
+			b.WriteRune(rune(v))
+			i += n
+		default:
+			b.WriteByte(e)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package pacjs
+
+import (
+	"sort"
+	"strings"
+)
+
+// entryPoints are called by name by the browser and keep their names.
+var entryPoints = map[string]bool{"FindProxyForURL": true, "FindProxyForURLEx": true}
+
+// hostGlobals are globals a browser may provide beyond those this package
+// implements. A script that declares one of these names, say as a
+// parameter, may still use the global elsewhere, so such names keep their
+// spelling.
+var hostGlobals = []string{
+	"Array", "Boolean", "Date", "Error", "JSON", "Math", "Number", "Object", "RegExp",
+	"decodeURI", "decodeURIComponent", "encodeURI", "encodeURIComponent", "escape",
+	"eval", "isFinite", "parseFloat", "unescape",
+	"dateRange", "timeRange", "weekdayRange", "dnsResolveEx", "isInNetEx",
+	"isResolvableEx", "myIpAddressEx", "sortIpAddressList", "getClientVersion",
+}
+
+// futureReserved are words ES3 reserves that the parser accepts as names.
+// Short names are never chosen from them.
+var futureReserved = map[string]bool{
+	"abstract": true, "boolean": true, "byte": true, "char": true, "class": true,
+	"const": true, "double": true, "enum": true, "export": true, "extends": true,
+	"final": true, "float": true, "goto": true, "implements": true, "import": true,
+	"int": true, "interface": true, "let": true, "long": true, "native": true,
+	"package": true, "private": true, "protected": true, "public": true,
+	"short": true, "static": true, "super": true, "synchronized": true,
+	"throws": true, "transient": true, "volatile": true, "yield": true,
+}
+
+// Minify returns src without comments, unneeded white space and trailing
+// commas, and with the names it declares shortened. FindProxyForURL keeps
+// its name, as do globals the browser provides, so the result behaves
+// exactly like src. Line breaks are kept where automatic semicolon
+// insertion may depend on them. src must be accepted by Check.
+func Minify(src string) (string, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return "", err
+	}
+	prog, err := parseTokens(toks, true)
+	if err != nil {
+		return "", err
+	}
+	toks = toks[:len(toks)-1] // EOF
+
+	isName := markNames(toks)
+	renames := shortNames(toks, isName, prog.declared)
+
+	var b strings.Builder
+	b.Grow(len(src) / 2)
+	prev, prevKind := "", tokEOF
+	for i, t := range toks {
+		text := t.text
+		if text == "," && i+1 < len(toks) && (toks[i+1].text == "]" || toks[i+1].text == "}") {
+			// A trailing comma adds an element to arrays in ES3 engines.
+			continue
+		}
+		if isName[i] {
+			if short, ok := renames[text]; ok {
+				text = short
+			}
+		}
+		if prev != "" {
+			if t.nl && keepLineBreak(prev, text) {
+				b.WriteByte('\n')
+			} else if needSpace(prevKind, prev, text) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(text)
+		prev, prevKind = text, t.kind
+	}
+	if prev != "" {
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// markNames reports which identifier tokens refer to variables, as opposed
+// to keywords, property names after "." and keys of object literals.
+func markNames(toks []token) []bool {
+	type frame struct {
+		object    bool // an object literal rather than a block or brackets
+		ternary   int  // unmatched "?"
+		caseColon bool // a case or default label awaits its ":"
+	}
+	stack := []frame{{}}
+	isName := make([]bool, len(toks))
+	caseColon := -1 // index of the last ":" ending a case or statement label
+	for i, t := range toks {
+		top := &stack[len(stack)-1]
+		var prev token
+		if i > 0 {
+			prev = toks[i-1]
+		}
+
+		switch {
+		case t.kind == tokIdent:
+			isKey := top.object && (prev.text == "{" || prev.text == ",") && i+1 < len(toks) && toks[i+1].text == ":"
+			if isKey || prev.text == "." {
+				break
+			}
+			if t.text == "case" || t.text == "default" {
+				top.caseColon = true
+			} else if !top.object && !top.caseColon && top.ternary == 0 && i+1 < len(toks) && toks[i+1].text == ":" && !reserved[t.text] {
+				caseColon = i + 1 // a statement label, so "{" after it opens a block
+			}
+			isName[i] = !reserved[t.text]
+		case t.kind != tokPunct:
+		case t.text == "{":
+			stack = append(stack, frame{object: i > 0 && i-1 != caseColon && opensObject(prev)})
+		case t.text == "(" || t.text == "[":
+			stack = append(stack, frame{})
+		case t.text == "}" || t.text == ")" || t.text == "]":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case t.text == "?":
+			top.ternary++
+		case t.text == ":":
+			if top.ternary > 0 {
+				top.ternary--
+			} else if top.caseColon {
+				top.caseColon = false
+				caseColon = i
+			}
+		}
+	}
+	return isName
+}
+
+// opensObject reports whether a "{" after prev starts an object literal
+// rather than a block, that is whether prev leaves an expression to parse.
+func opensObject(prev token) bool {
+	switch prev.kind {
+	case tokPunct:
+		return prev.text != ")" && prev.text != "]" && prev.text != "}" && prev.text != ";"
+	case tokIdent:
+		switch prev.text {
+		case "return", "typeof", "void", "in", "case", "throw":
+			return true
+		}
+	}
+	return false
+}
+
+// shortNames maps each declared name, most used first, to the shortest
+// name not otherwise in use. Entry points and host globals are kept.
+func shortNames(toks []token, isName []bool, declared map[string]bool) map[string]string {
+	taken := make(map[string]bool)
+	for _, t := range toks {
+		if t.kind == tokIdent {
+			taken[t.text] = true
+		}
+	}
+	keep := make(map[string]bool)
+	for name := range entryPoints {
+		keep[name] = true
+	}
+	for _, name := range hostGlobals {
+		keep[name] = true
+	}
+	globals := &Script{global: newScope(nil)}
+	globals.installGlobals()
+	for name := range globals.global.vars {
+		keep[name] = true
+	}
+
+	count := make(map[string]int)
+	var names []string
+	for i, t := range toks {
+		if !isName[i] || !declared[t.text] || keep[t.text] {
+			continue
+		}
+		if count[t.text] == 0 {
+			names = append(names, t.text)
+		}
+		count[t.text]++
+	}
+	sort.SliceStable(names, func(i, j int) bool { return count[names[i]] > count[names[j]] })
+
+	renames := make(map[string]string, len(names))
+	next := 0
+	for _, name := range names {
+		short := nthName(next)
+		for taken[short] || reserved[short] || futureReserved[short] || keep[short] {
+			next++
+			short = nthName(next)
+		}
+		next++
+		if len(short) < len(name) {
+			renames[name] = short
+		}
+	}
+	return renames
+}
+
+const (
+	nameStart = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_$"
+	namePart  = nameStart + "0123456789"
+)
+
+// nthName returns the n-th identifier in order of length: a, b, ..., $,
+// aa, ba, ...
+func nthName(n int) string {
+	name := []byte{nameStart[n%len(nameStart)]}
+	for n /= len(nameStart); n > 0; n = (n - 1) / len(namePart) {
+		name = append(name, namePart[(n-1)%len(namePart)])
+	}
+	return string(name)
+}
+
+// keepLineBreak reports whether a line break between prev and next must be
+// kept: it may end a statement through automatic semicolon insertion, or
+// separate return, break, continue, ++ or -- from what follows.
+func keepLineBreak(prev, next string) bool {
+	switch prev {
+	case ";", "{", ",", "(", "[", "?", ":", ".":
+		return false
+	}
+	switch next {
+	case ";", "}", ")", "]", ",", ".", ":", "?":
+		return false
+	}
+	return true
+}
+
+// needSpace reports whether prev and next would run together into
+// different tokens without a space.
+func needSpace(prevKind tokenKind, prev, next string) bool {
+	a, b := prev[len(prev)-1], next[0]
+	switch {
+	case isNameByte(a) && isNameByte(b):
+		return true
+	case (a == '+' || a == '-' || a == '/') && a == b:
+		return true
+	case prevKind == tokNumber && b == '.':
+		return true
+	}
+	return false
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
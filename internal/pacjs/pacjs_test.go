@@ -0,0 +1,295 @@
+package pacjs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"arithmetic", "function f() { return 1 + 2 * 3 - 8 / 4 % 3; }", 5.0},
+		{"string concat", "function f() { return 'a' + 1 + 2; }", "a12"},
+		{"number formatting", "function f() { return '' + 1.5 + ',' + 10 / 4 + ',' + (0 / 0); }", "1.5,2.5,NaN"},
+		{"strict and loose equality", "function f() { return [1 === 1, '1' == 1, '1' === 1, null == undefined].join(); }", "true,true,false,true"},
+		{"logical operators return operands", "function f() { return (0 || 'x') + (1 && 'y'); }", "xy"},
+		{"conditional", "function f() { return 2 > 1 ? 'yes' : 'no'; }", "yes"},
+		{"bitwise", "function f() { return (5 & 3) + (5 | 3) + (1 << 4) + (-16 >> 2) + (-1 >>> 28); }", 35.0},
+		{"var hoisting", "function f() { x = 3; var x; return x; }", 3.0},
+		{"function hoisting", "function f() { return g(); function g() { return 'g'; } }", "g"},
+		{"closures", "function f() { var n = 0; var inc = function () { n++; }; inc(); inc(); return n; }", 2.0},
+		{"recursion", "function f() { return fib(10); } function fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); }", 55.0},
+		{"for loop with break and continue", `function f() {
+			var s = 0;
+			for (var i = 0; i < 10; i++) {
+				if (i % 2) continue;
+				if (i > 6) break;
+				s += i;
+			}
+			return s;
+		}`, 12.0},
+		{"labeled break and continue", `function f() {
+			var s = '';
+			outer: for (var i = 0; i < 3; i++) {
+				var j = 0;
+				inner: while (true) {
+					j++;
+					if (j > i) continue outer;
+					if (i == 2) break outer;
+					switch (j) {
+					case 1: s += i; continue inner;
+					}
+				}
+			}
+			done: {
+				if (s) break done;
+				s = 'unreached';
+			}
+			return s;
+		}`, "1"},
+		{"while and do-while", "function f() { var i = 0; while (i < 5) i++; do { i--; } while (i > 2); return i; }", 2.0},
+		{"for-in over object", "function f() { var o = {b: 1, a: 2}, s = ''; for (var k in o) s += k + o[k]; return s; }", "b1a2"},
+		{"in and hasOwnProperty", "function f() { var o = {'x.y': true}; return ('x.y' in o) && o.hasOwnProperty('x.y') && !('z' in o); }", true},
+		{"switch fallthrough", `function f(v) {
+			var s = '';
+			switch (v) {
+			case 'a': s += 'a';
+			case 'b': s += 'b'; break;
+			default: s += 'd';
+			}
+			return s;
+		}`, "d"},
+		{"arrays", "function f() { var a = [3, 1]; a.push(2); a[5] = 9; return a.length + ':' + a.indexOf(2) + ':' + a.slice(0, 3).join('-'); }", "6:2:3-1-2"},
+		{"string methods", `function f() {
+			var h = 'WWW.Example.COM'.toLowerCase();
+			return [h.endsWith('.example.com'), h.startsWith('www'), h.indexOf('.'), h.lastIndexOf('.'),
+				h.substring(4, 11), h.substr(-3), h.slice(0, -4), h.split('.').length, h.charAt(0), h.length].join();
+		}`, "true,true,3,11,example,com,www.example,3,w,15"},
+		{"typeof", "function f() { return [typeof 1, typeof 'a', typeof f, typeof {}, typeof nothing].join(); }", "number,string,function,object,undefined"},
+		{"automatic semicolon insertion", "function f() {\n var a = 1\n var b = 2\n return a + b\n}", 3.0},
+		{"comments", "/* header */ function f() { // trailing\n return 'ok'; }", "ok"},
+		{"undefined result", "function f() {}", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Load(tc.src)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			got, err := s.Call("f", "z")
+			if err != nil {
+				t.Fatalf("Call: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %#v, got %#v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPACHelpers(t *testing.T) {
+	s, err := Load(`function FindProxyForURL(url, host) {
+		if (isPlainHostName(host) || dnsDomainIs(host, '.corp.example'))
+			return 'DIRECT';
+		if (shExpMatch(url, 'http://*.example.com/*'))
+			return 'PROXY a:1';
+		if (isInNet(host, '10.0.0.0', '255.0.0.0'))
+			return 'PROXY b:2';
+		if (localHostOrDomainIs(host, 'www.example.org'))
+			return 'PROXY c:3';
+		return 'DIRECT; level ' + dnsDomainLevels(host);
+	}`)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	s.DNSResolve = func(host string) (string, bool) {
+		if host == "intranet.example.net" {
+			return "10.1.2.3", true
+		}
+		return "", false
+	}
+
+	tests := []struct{ url, host, want string }{
+		{"http://intranet/", "intranet", "DIRECT"},
+		{"http://wiki.corp.example/", "wiki.corp.example", "DIRECT"},
+		{"http://www.example.com/x", "www.example.com", "PROXY a:1"},
+		{"https://www.example.com/x", "www.example.com", "DIRECT; level 2"},
+		{"http://10.9.8.7/", "10.9.8.7", "PROXY b:2"},
+		{"http://intranet.example.net/", "intranet.example.net", "PROXY b:2"},
+		{"http://www/", "www", "DIRECT"},
+		{"http://a.b.c.d/", "a.b.c.d", "DIRECT; level 3"},
+	}
+	for _, tc := range tests {
+		got, err := s.FindProxyForURL(tc.url, tc.host)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.url, tc.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"var x = ;", "line 1:9: unexpected \";\""},
+		{"function f() {\n  return new Date();\n}", "line 2:10: unsupported syntax: new"},
+		{"var r = /ab+c/;", "unsupported syntax: regular expression literal"},
+		{"return 1;", "return outside function"},
+		{"break;", "break outside loop or switch"},
+		{"var s = 'open", "unterminated string"},
+		{"function () {}", "function declaration needs a name"},
+		{"1 = 2;", "invalid assignment target"},
+		{"for (;;) { break missing; }", "undefined label \"missing\""},
+		{"a: { for (;;) { continue a; } }", "continue to label \"a\", which is not a loop"},
+		{"a: a: ;", "label \"a\" already declared"},
+	}
+	for _, tc := range tests {
+		_, err := Parse(tc.src)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Fatalf("%q: want SyntaxError, got %v", tc.src, err)
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: want error containing %q, got %q", tc.src, tc.want, err)
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"function f() { return missing; }", "line 1: ReferenceError: missing is not defined"},
+		{"function f() { var o; return o.x; }", `cannot read property "x" of undefined`},
+		{"function f() { var o = {}; return o.x(); }", "o.x is not a function"},
+		{"function f() { throw 'bad'; }", "uncaught exception: bad"},
+		{"function f() { for (;;) {} }", "step limit exceeded"},
+		{"function f() { return f(); }", "maximum call depth exceeded"},
+	}
+	for _, tc := range tests {
+		s, err := Load(tc.src)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", tc.src, err)
+		}
+		_, err = s.Call("f")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: want error containing %q, got %v", tc.src, tc.want, err)
+		}
+	}
+}
+
+func TestMinify(t *testing.T) {
+	src := `// Routing table.
+var proxyServer = 'PROXY a:1';
+var table = {direct: 'DIRECT', proxy: proxyServer, 'x-y': 2,};
+
+function pick(kind, fallback) {
+	var result = fallback
+	switch (kind) {
+	case 'd': { result = table.direct; break; }
+	case 'p': result = kind ? {proxy: table.proxy}.proxy : null; break;
+	default: result = typeof alert
+	}
+	return result
+}
+
+function FindProxyForURL(url, host) {
+	var isPlain = function (isPlainHostName) { return isPlainHostName; };
+	if (isPlainHostName(host) && isPlain(true)) return pick('d');
+	var n = 1 + +host.length, list = [1, 2,];
+	return pick(host.charAt(0), 'DIRECT') + ':' + (n - -list.length) + ':' + first(list);
+}
+
+function first(list) {
+	var found = -1;
+	search: {
+		for (var i = 0; i < list.length; i++) {
+			if (list[i] > 1) { found = list[i]; break search; }
+		}
+		found = 0;
+	}
+	return found;
+}`
+	out, err := Minify(src)
+	if err != nil {
+		t.Fatalf("Minify: %v", err)
+	}
+	for _, unwanted := range []string{"Routing", "proxyServer", "fallback", "  ", ",]", ",}"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("minified script contains %q:\n%s", unwanted, out)
+		}
+	}
+	for _, kept := range []string{"function FindProxyForURL(", ".direct", "{direct:", "isPlainHostName(", "typeof alert", "+ +", "- -"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("minified script lacks %q:\n%s", kept, out)
+		}
+	}
+
+	orig, err := Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, err := Load(out)
+	if err != nil {
+		t.Fatalf("Load minified: %v\n%s", err, out)
+	}
+	for _, host := range []string{"intranet", "d.example.com", "p.example.com", "www.example.com"} {
+		want, err := orig.FindProxyForURL("http://"+host+"/", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := min.FindProxyForURL("http://"+host+"/", host)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", host, err, out)
+		}
+		if got != want {
+			t.Errorf("%s: minified returns %q, original %q\n%s", host, got, want, out)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	valid := []string{
+		"function f() {\n  var d = new Date();\n  return d.getHours() < 8 ? 'DIRECT' : null;\n}",
+		"function f(host) { if (/^10\\./.test(host)) return 'DIRECT'; return 6 / 2 / 3; }",
+		"function f(o) { try { delete o.x; } catch (e) { return this; } finally { debugger; } }",
+		"function f(o) { with (o) { return o instanceof Object && new new F()[0].g(1, 2); } }",
+		"function f(a) { outer: for (var i in a) { for (var j in a[i]) { if (j) continue outer; } } }",
+	}
+	for _, src := range valid {
+		if err := Check(src); err != nil {
+			t.Errorf("Check(%q): %v", src, err)
+		}
+		if _, err := Minify(src); err != nil {
+			t.Errorf("Minify(%q): %v", src, err)
+		}
+	}
+
+	invalid := []struct{ src, want string }{
+		{"function f() { return new; }", "unexpected \";\""},
+		{"var r = /ab+c;", "unterminated regular expression"},
+		{"try { }", "expected catch or finally"},
+		{"catch (e) {}", "unexpected \"catch\""},
+		{"function f() { if (x) { }", "expected \"}\" but found end of input"},
+	}
+	for _, tc := range invalid {
+		err := Check(tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Check(%q): want error containing %q, got %v", tc.src, tc.want, err)
+		}
+	}
+}
+
+func TestMinifyKeepsRegexApart(t *testing.T) {
+	out, err := Minify("var a = 4 / /x/.source.length, b = /[/]+/g;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "/ /x/") || !strings.Contains(out, "/[/]+/g") {
+		t.Errorf("regular expressions not kept intact:\n%s", out)
+	}
+}
@@ -0,0 +1,1171 @@
+package pacjs
+
+import (
+	"fmt"
+)
+
+type stmt interface{ stmtNode() }
+
+type expr interface{ exprNode() }
+
+// funcLit is a function body together with the declarations hoisted to its
+// scope. The top level of a program is parsed as a nameless funcLit.
+type funcLit struct {
+	name   string
+	params []string
+	body   []stmt
+	vars   []string
+	funcs  []*funcLit
+}
+
+type (
+	varStmt struct {
+		names []string
+		inits []expr // nil for declarations without initialiser
+	}
+	funcDeclStmt struct{ fn *funcLit }
+	exprStmt     struct{ x expr }
+	blockStmt    struct{ body []stmt }
+	ifStmt       struct {
+		test expr
+		then stmt
+		els  stmt
+	}
+	forStmt struct {
+		init   stmt
+		test   expr
+		update expr
+		body   stmt
+	}
+	forInStmt struct {
+		name string
+		obj  expr
+		body stmt
+	}
+	whileStmt struct {
+		test expr
+		body stmt
+	}
+	doWhileStmt struct {
+		body stmt
+		test expr
+	}
+	returnStmt struct{ x expr }
+	// breakStmt and continueStmt have an empty label when they target
+	// the innermost loop or switch.
+	breakStmt    struct{ label string }
+	continueStmt struct{ label string }
+	labeledStmt  struct {
+		label string
+		body  stmt
+	}
+	switchStmt struct {
+		disc  expr
+		cases []switchCase
+	}
+	throwStmt struct {
+		x    expr
+		line int
+	}
+	emptyStmt struct{}
+	// unsupportedStmt is a statement the interpreter does not implement,
+	// accepted by Check.
+	unsupportedStmt struct {
+		what string
+		line int
+	}
+)
+
+// switchCase is one case clause; test is nil for default.
+type switchCase struct {
+	test expr
+	body []stmt
+}
+
+func (*varStmt) stmtNode()         {}
+func (*funcDeclStmt) stmtNode()    {}
+func (*exprStmt) stmtNode()        {}
+func (*blockStmt) stmtNode()       {}
+func (*ifStmt) stmtNode()          {}
+func (*forStmt) stmtNode()         {}
+func (*forInStmt) stmtNode()       {}
+func (*whileStmt) stmtNode()       {}
+func (*doWhileStmt) stmtNode()     {}
+func (*returnStmt) stmtNode()      {}
+func (*breakStmt) stmtNode()       {}
+func (*continueStmt) stmtNode()    {}
+func (*labeledStmt) stmtNode()     {}
+func (*switchStmt) stmtNode()      {}
+func (*throwStmt) stmtNode()       {}
+func (*emptyStmt) stmtNode()       {}
+func (*unsupportedStmt) stmtNode() {}
+
+type (
+	literal   struct{ v value }
+	identExpr struct {
+		name string
+		line int
+	}
+	arrayLit  struct{ elems []expr }
+	objectLit struct {
+		keys []string
+		vals []expr
+	}
+	funcExpr   struct{ fn *funcLit }
+	memberExpr struct {
+		obj  expr
+		prop expr
+		line int
+	}
+	callExpr struct {
+		callee expr
+		args   []expr
+		line   int
+	}
+	unaryExpr struct {
+		op string
+		x  expr
+	}
+	updateExpr struct {
+		op     string
+		prefix bool
+		x      expr
+		line   int
+	}
+	binaryExpr struct {
+		op   string
+		l, r expr
+		line int
+	}
+	logicalExpr struct {
+		op   string
+		l, r expr
+	}
+	condExpr struct {
+		test, then, els expr
+	}
+	assignExpr struct {
+		op     string
+		target expr
+		val    expr
+		line   int
+	}
+	seqExpr struct{ list []expr }
+	// unsupportedExpr is an expression the interpreter does not
+	// implement, accepted by Check.
+	unsupportedExpr struct {
+		what string
+		line int
+	}
+)
+
+func (*literal) exprNode()         {}
+func (*identExpr) exprNode()       {}
+func (*arrayLit) exprNode()        {}
+func (*objectLit) exprNode()       {}
+func (*funcExpr) exprNode()        {}
+func (*memberExpr) exprNode()      {}
+func (*callExpr) exprNode()        {}
+func (*unaryExpr) exprNode()       {}
+func (*updateExpr) exprNode()      {}
+func (*binaryExpr) exprNode()      {}
+func (*logicalExpr) exprNode()     {}
+func (*condExpr) exprNode()        {}
+func (*assignExpr) exprNode()      {}
+func (*seqExpr) exprNode()         {}
+func (*unsupportedExpr) exprNode() {}
+
+// Program is a parsed script.
+type Program struct {
+	top      *funcLit
+	declared map[string]bool // names declared by var, function or parameter in any scope
+}
+
+// Parse parses src. It fails on syntax errors and on ES5 features outside
+// the supported subset (new, this, try, regular expression literals, ...).
+func Parse(src string) (*Program, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(toks, false)
+}
+
+// Check reports syntax errors in src. Unlike Parse it accepts the ES5
+// features the interpreter does not implement, so it suits scripts meant
+// for browsers.
+func Check(src string) error {
+	toks, err := tokenize(src)
+	if err != nil {
+		return err
+	}
+	_, err = parseTokens(toks, true)
+	return err
+}
+
+// parseTokens parses a whole script. permissive accepts the unsupported
+// features as nodes that fail when evaluated.
+func parseTokens(toks []token, permissive bool) (*Program, error) {
+	p := &parser{toks: toks, fn: &funcLit{}, declared: make(map[string]bool), permissive: permissive}
+	for p.peek().kind != tokEOF {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		p.fn.body = append(p.fn.body, s)
+	}
+	return &Program{top: p.fn, declared: p.declared}, nil
+}
+
+var reserved = map[string]bool{
+	"break": true, "case": true, "catch": true, "continue": true, "debugger": true,
+	"default": true, "delete": true, "do": true, "else": true, "false": true,
+	"finally": true, "for": true, "function": true, "if": true, "in": true,
+	"instanceof": true, "new": true, "null": true, "return": true, "switch": true,
+	"this": true, "throw": true, "true": true, "try": true, "typeof": true,
+	"var": true, "void": true, "while": true, "with": true,
+}
+
+// unsupported are reserved words valid in ES5 that the interpreter does not
+// implement.
+var unsupported = map[string]bool{
+	"catch": true, "debugger": true, "delete": true, "finally": true,
+	"instanceof": true, "new": true, "this": true, "try": true, "with": true,
+}
+
+var binaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6, "===": 6, "!==": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7, "in": 7, "instanceof": 7,
+	"<<": 8, ">>": 8, ">>>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+var assignOps = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, ">>>=": true, "&=": true, "|=": true, "^=": true,
+}
+
+type parser struct {
+	toks []token
+	pos  int
+
+	fn        *funcLit // function collecting hoisted declarations
+	fnDepth   int      // enclosing function literals, for return
+	loops     int      // enclosing loops, for continue
+	breakable int      // enclosing loops and switches, for break
+	labels    []label  // enclosing labeled statements, innermost last
+
+	declared   map[string]bool
+	permissive bool
+}
+
+// label is a statement label in scope; loop reports whether it labels a
+// loop, which continue may target.
+type label struct {
+	name string
+	loop bool
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuator or word s.
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokIdent) && t.text == s
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &SyntaxError{Line: t.line, Col: t.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// unsupported fails on a feature the interpreter does not implement unless
+// the parser is permissive.
+func (p *parser) unsupported(t token, what string) error {
+	if p.permissive {
+		return nil
+	}
+	return p.errorf(t, "unsupported syntax: %s", what)
+}
+
+func describe(t token) string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (p *parser) expect(s string) error {
+	if !p.is(s) {
+		t := p.peek()
+		return p.errorf(t, "expected %q but found %s", s, describe(t))
+	}
+	p.next()
+	return nil
+}
+
+// semicolon consumes a statement terminator, applying automatic semicolon
+// insertion before }, at the end of input and after a line break.
+func (p *parser) semicolon() error {
+	if p.is(";") {
+		p.next()
+		return nil
+	}
+	t := p.peek()
+	if t.kind == tokEOF || p.is("}") || t.nl {
+		return nil
+	}
+	return p.errorf(t, "expected \";\" but found %s", describe(t))
+}
+
+func (p *parser) identifier() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent || reserved[t.text] {
+		return "", p.errorf(t, "expected identifier but found %s", describe(t))
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *parser) declare(name string) {
+	p.declared[name] = true
+	for _, v := range p.fn.vars {
+		if v == name {
+			return
+		}
+	}
+	p.fn.vars = append(p.fn.vars, name)
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	if t.kind == tokIdent && unsupported[t.text] {
+		if err := p.unsupported(t, t.text); err != nil {
+			return nil, err
+		}
+		switch t.text {
+		case "try":
+			return p.tryStatement()
+		case "with":
+			p.next()
+			if _, err := p.parenExpression(); err != nil {
+				return nil, err
+			}
+			if _, err := p.statement(); err != nil {
+				return nil, err
+			}
+			return &unsupportedStmt{what: "with", line: t.line}, nil
+		case "debugger":
+			p.next()
+			return &unsupportedStmt{what: "debugger", line: t.line}, p.semicolon()
+		case "catch", "finally":
+			return nil, p.errorf(t, "unexpected %s", describe(t))
+		}
+	}
+	switch {
+	case p.is("{"):
+		p.next()
+		body, err := p.block()
+		return &blockStmt{body: body}, err
+	case p.is(";"):
+		p.next()
+		return &emptyStmt{}, nil
+	case p.is("var"):
+		p.next()
+		s, err := p.varDecls()
+		if err != nil {
+			return nil, err
+		}
+		return s, p.semicolon()
+	case p.is("function"):
+		fn, err := p.function(true)
+		if err != nil {
+			return nil, err
+		}
+		p.fn.funcs = append(p.fn.funcs, fn)
+		return &funcDeclStmt{fn: fn}, nil
+	case p.is("if"):
+		return p.ifStatement()
+	case p.is("for"):
+		return p.forStatement()
+	case p.is("while"):
+		p.next()
+		test, err := p.parenExpression()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.loopBody()
+		return &whileStmt{test: test, body: body}, err
+	case p.is("do"):
+		p.next()
+		body, err := p.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("while"); err != nil {
+			return nil, err
+		}
+		test, err := p.parenExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.is(";") {
+			p.next()
+		}
+		return &doWhileStmt{body: body, test: test}, nil
+	case p.is("return"):
+		p.next()
+		if p.fnDepth == 0 {
+			return nil, p.errorf(t, "return outside function")
+		}
+		if p.is(";") || p.is("}") || p.peek().kind == tokEOF || p.peek().nl {
+			return &returnStmt{}, p.semicolon()
+		}
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &returnStmt{x: x}, p.semicolon()
+	case p.is("break"):
+		p.next()
+		name, err := p.jumpLabel(false)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" && p.breakable == 0 {
+			return nil, p.errorf(t, "break outside loop or switch")
+		}
+		return &breakStmt{label: name}, p.semicolon()
+	case p.is("continue"):
+		p.next()
+		name, err := p.jumpLabel(true)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" && p.loops == 0 {
+			return nil, p.errorf(t, "continue outside loop")
+		}
+		return &continueStmt{label: name}, p.semicolon()
+	case p.is("switch"):
+		return p.switchStatement()
+	case p.is("throw"):
+		p.next()
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &throwStmt{x: x, line: t.line}, p.semicolon()
+	}
+	if t.kind == tokIdent && !reserved[t.text] && p.toks[p.pos+1].text == ":" {
+		return p.labeledStatement()
+	}
+
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &exprStmt{x: x}, p.semicolon()
+}
+
+// labeledStatement parses "name: statement".
+func (p *parser) labeledStatement() (stmt, error) {
+	t := p.peek()
+	name, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range p.labels {
+		if l.name == name {
+			return nil, p.errorf(t, "label %q already declared", name)
+		}
+	}
+	p.next() // ":"
+	// The label names a loop when the labels in front of it do.
+	i := p.pos
+	for p.toks[i].kind == tokIdent && !reserved[p.toks[i].text] && p.toks[i+1].text == ":" {
+		i += 2
+	}
+	next := p.toks[i]
+	loop := next.kind == tokIdent && (next.text == "for" || next.text == "while" || next.text == "do")
+	p.labels = append(p.labels, label{name: name, loop: loop})
+	body, err := p.statement()
+	p.labels = p.labels[:len(p.labels)-1]
+	if err != nil {
+		return nil, err
+	}
+	return &labeledStmt{label: name, body: body}, nil
+}
+
+// jumpLabel parses the optional label of a break or continue, which must
+// be on the same line. continue may only target a loop.
+func (p *parser) jumpLabel(continues bool) (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent || reserved[t.text] || t.nl {
+		return "", nil
+	}
+	p.next()
+	for i := len(p.labels) - 1; i >= 0; i-- {
+		if l := p.labels[i]; l.name == t.text {
+			if continues && !l.loop {
+				return "", p.errorf(t, "continue to label %q, which is not a loop", t.text)
+			}
+			return t.text, nil
+		}
+	}
+	return "", p.errorf(t, "undefined label %q", t.text)
+}
+
+// tryStatement parses try/catch/finally for Check.
+func (p *parser) tryStatement() (stmt, error) {
+	t := p.next()
+	parseBlock := func() error {
+		if err := p.expect("{"); err != nil {
+			return err
+		}
+		_, err := p.block()
+		return err
+	}
+	if err := parseBlock(); err != nil {
+		return nil, err
+	}
+	handled := false
+	if p.is("catch") {
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if _, err := p.identifier(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if err := parseBlock(); err != nil {
+			return nil, err
+		}
+		handled = true
+	}
+	if p.is("finally") {
+		p.next()
+		if err := parseBlock(); err != nil {
+			return nil, err
+		}
+		handled = true
+	}
+	if !handled {
+		return nil, p.errorf(p.peek(), "expected catch or finally but found %s", describe(p.peek()))
+	}
+	return &unsupportedStmt{what: "try", line: t.line}, nil
+}
+
+// block parses statements up to the closing brace.
+func (p *parser) block() ([]stmt, error) {
+	body := []stmt{}
+	for !p.is("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf(p.peek(), "expected \"}\" but found end of input")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	p.next()
+	return body, nil
+}
+
+func (p *parser) varDecls() (*varStmt, error) {
+	s := &varStmt{}
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		p.declare(name)
+		var init expr
+		if p.is("=") {
+			p.next()
+			if init, err = p.assignment(); err != nil {
+				return nil, err
+			}
+		}
+		s.names = append(s.names, name)
+		s.inits = append(s.inits, init)
+		if !p.is(",") {
+			return s, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parenExpression() (expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return x, p.expect(")")
+}
+
+func (p *parser) loopBody() (stmt, error) {
+	p.loops++
+	p.breakable++
+	defer func() {
+		p.loops--
+		p.breakable--
+	}()
+	return p.statement()
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	p.next()
+	test, err := p.parenExpression()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	s := &ifStmt{test: test, then: then}
+	if p.is("else") {
+		p.next()
+		if s.els, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) forStatement() (stmt, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	// for (var k in obj) and for (k in obj)
+	name, offset := "", 0
+	if p.is("var") {
+		offset = 1
+	}
+	if t := p.toks[p.pos+offset]; t.kind == tokIdent && !reserved[t.text] && p.pos+offset+1 < len(p.toks) {
+		if n := p.toks[p.pos+offset+1]; n.kind == tokIdent && n.text == "in" {
+			name = t.text
+		}
+	}
+	if name != "" {
+		if offset == 1 {
+			p.declare(name)
+		}
+		p.pos += offset + 2
+		obj, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.loopBody()
+		return &forInStmt{name: name, obj: obj, body: body}, err
+	}
+
+	s := &forStmt{}
+	var err error
+	switch {
+	case p.is(";"):
+	case p.is("var"):
+		p.next()
+		if s.init, err = p.varDecls(); err != nil {
+			return nil, err
+		}
+	default:
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		s.init = &exprStmt{x: x}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if s.test, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if s.update, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	s.body, err = p.loopBody()
+	return s, err
+}
+
+func (p *parser) switchStatement() (stmt, error) {
+	p.next()
+	disc, err := p.parenExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	p.breakable++
+	defer func() { p.breakable-- }()
+
+	s := &switchStmt{disc: disc}
+	hasDefault := false
+	for !p.is("}") {
+		var c switchCase
+		switch t := p.peek(); {
+		case p.is("case"):
+			p.next()
+			if c.test, err = p.expression(); err != nil {
+				return nil, err
+			}
+		case p.is("default"):
+			if hasDefault {
+				return nil, p.errorf(t, "more than one default clause")
+			}
+			hasDefault = true
+			p.next()
+		default:
+			return nil, p.errorf(t, "expected case or default but found %s", describe(t))
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for !p.is("case") && !p.is("default") && !p.is("}") {
+			if p.peek().kind == tokEOF {
+				return nil, p.errorf(p.peek(), "expected \"}\" but found end of input")
+			}
+			st, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			c.body = append(c.body, st)
+		}
+		s.cases = append(s.cases, c)
+	}
+	p.next()
+	return s, nil
+}
+
+// function parses a function declaration or expression starting at the
+// function keyword.
+func (p *parser) function(needName bool) (*funcLit, error) {
+	p.next()
+	fn := &funcLit{params: []string{}}
+	if p.peek().kind == tokIdent && !p.is("(") {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		fn.name = name
+		p.declared[name] = true
+	} else if needName {
+		return nil, p.errorf(p.peek(), "function declaration needs a name")
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+		p.declared[name] = true
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	outer, loops, breakable, labels := p.fn, p.loops, p.breakable, p.labels
+	p.fn, p.loops, p.breakable, p.labels = fn, 0, 0, nil
+	p.fnDepth++
+	body, err := p.block()
+	p.fnDepth--
+	p.fn, p.loops, p.breakable, p.labels = outer, loops, breakable, labels
+	fn.body = body
+	return fn, err
+}
+
+func (p *parser) expression() (expr, error) {
+	x, err := p.assignment()
+	if err != nil || !p.is(",") {
+		return x, err
+	}
+	seq := &seqExpr{list: []expr{x}}
+	for p.is(",") {
+		p.next()
+		x, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		seq.list = append(seq.list, x)
+	}
+	return seq, nil
+}
+
+func (p *parser) assignment() (expr, error) {
+	left, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tokPunct || !assignOps[t.text] {
+		return left, nil
+	}
+	if !isTarget(left) {
+		return nil, p.errorf(t, "invalid assignment target")
+	}
+	p.next()
+	val, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return &assignExpr{op: t.text, target: left, val: val, line: t.line}, nil
+}
+
+func isTarget(x expr) bool {
+	switch x.(type) {
+	case *identExpr, *memberExpr:
+		return true
+	}
+	return false
+}
+
+func (p *parser) conditional() (expr, error) {
+	test, err := p.binary(0)
+	if err != nil || !p.is("?") {
+		return test, err
+	}
+	p.next()
+	then, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return &condExpr{test: test, then: then, els: els}, nil
+}
+
+func (p *parser) binary(minPrec int) (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokPunct && t.kind != tokIdent {
+			return left, nil
+		}
+		if t.kind == tokIdent && t.text == "instanceof" {
+			if err := p.unsupported(t, "instanceof"); err != nil {
+				return nil, err
+			}
+		}
+		prec := binaryPrec[t.text]
+		if prec == 0 || prec <= minPrec || (t.kind == tokIdent && t.text != "in" && t.text != "instanceof") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(prec)
+		if err != nil {
+			return nil, err
+		}
+		switch t.text {
+		case "instanceof":
+			left = &unsupportedExpr{what: "instanceof", line: t.line}
+		case "&&", "||":
+			left = &logicalExpr{op: t.text, l: left, r: right}
+		default:
+			left = &binaryExpr{op: t.text, l: left, r: right, line: t.line}
+		}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	t := p.peek()
+	switch {
+	case p.is("!") || p.is("-") || p.is("+") || p.is("~") || p.is("typeof") || p.is("void"):
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: t.text, x: x}, nil
+	case p.is("++") || p.is("--"):
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if !isTarget(x) {
+			return nil, p.errorf(t, "invalid %s operand", t.text)
+		}
+		return &updateExpr{op: t.text, prefix: true, x: x, line: t.line}, nil
+	case p.is("delete"):
+		if err := p.unsupported(t, "delete"); err != nil {
+			return nil, err
+		}
+		p.next()
+		if _, err := p.unary(); err != nil {
+			return nil, err
+		}
+		return &unsupportedExpr{what: "delete", line: t.line}, nil
+	}
+
+	x, err := p.callMember()
+	if err != nil {
+		return nil, err
+	}
+	if n := p.peek(); (p.is("++") || p.is("--")) && !n.nl {
+		if !isTarget(x) {
+			return nil, p.errorf(n, "invalid %s operand", n.text)
+		}
+		p.next()
+		return &updateExpr{op: n.text, x: x, line: n.line}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) callMember() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.is("."):
+			p.next()
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, p.errorf(name, "expected property name but found %s", describe(name))
+			}
+			x = &memberExpr{obj: x, prop: &literal{v: name.text}, line: t.line}
+		case p.is("["):
+			p.next()
+			prop, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &memberExpr{obj: x, prop: prop, line: t.line}
+		case p.is("("):
+			p.next()
+			var args []expr
+			for !p.is(")") {
+				a, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, a)
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			x = &callExpr{callee: x, args: args, line: t.line}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		return &literal{v: t.num}, nil
+	case tokString:
+		p.next()
+		return &literal{v: t.str}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return &literal{v: t.text == "true"}, nil
+		case "null":
+			p.next()
+			return &literal{v: null{}}, nil
+		case "function":
+			fn, err := p.function(false)
+			if err != nil {
+				return nil, err
+			}
+			return &funcExpr{fn: fn}, nil
+		}
+		if unsupported[t.text] {
+			if err := p.unsupported(t, t.text); err != nil {
+				return nil, err
+			}
+			switch t.text {
+			case "this":
+				p.next()
+				return &unsupportedExpr{what: "this", line: t.line}, nil
+			case "new":
+				return p.newExpression()
+			}
+		}
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		return &identExpr{name: name, line: t.line}, nil
+	case tokRegex:
+		if err := p.unsupported(t, "regular expression literal"); err != nil {
+			return nil, err
+		}
+		p.next()
+		return &unsupportedExpr{what: "regular expression literal", line: t.line}, nil
+	case tokEOF:
+		return nil, p.errorf(t, "unexpected end of input")
+	}
+
+	switch {
+	case p.is("("):
+		p.next()
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.is("["):
+		p.next()
+		a := &arrayLit{}
+		for !p.is("]") {
+			if p.is(",") {
+				return nil, p.errorf(p.peek(), "unsupported syntax: array holes")
+			}
+			x, err := p.assignment()
+			if err != nil {
+				return nil, err
+			}
+			a.elems = append(a.elems, x)
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		return a, p.expect("]")
+	case p.is("{"):
+		p.next()
+		o := &objectLit{}
+		for !p.is("}") {
+			k := p.next()
+			var key string
+			switch k.kind {
+			case tokIdent:
+				key = k.text
+			case tokString:
+				key = k.str
+			case tokNumber:
+				key = numberToString(k.num)
+			default:
+				return nil, p.errorf(k, "expected property name but found %s", describe(k))
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.assignment()
+			if err != nil {
+				return nil, err
+			}
+			o.keys = append(o.keys, key)
+			o.vals = append(o.vals, v)
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		return o, p.expect("}")
+	}
+	return nil, p.errorf(t, "unexpected %s", describe(t))
+}
+
+// newExpression parses "new" with its constructor and arguments for Check.
+func (p *parser) newExpression() (expr, error) {
+	t := p.next()
+	if p.is("new") {
+		if _, err := p.newExpression(); err != nil {
+			return nil, err
+		}
+	} else if _, err := p.primary(); err != nil {
+		return nil, err
+	}
+	for p.is(".") || p.is("[") {
+		if p.next().text == "." {
+			if name := p.next(); name.kind != tokIdent {
+				return nil, p.errorf(name, "expected property name but found %s", describe(name))
+			}
+			continue
+		}
+		if _, err := p.expression(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		p.next()
+		for !p.is(")") {
+			if _, err := p.assignment(); err != nil {
+				return nil, err
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	return &unsupportedExpr{what: "new", line: t.line}, nil
+}
@@ -0,0 +1,259 @@
+package pacjs
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// value is a JavaScript value: undefinedType, null, bool, float64, string,
+// *object, *array or *function.
+type value = any
+
+type undefinedType struct{}
+
+type null struct{}
+
+var undefined value = undefinedType{}
+
+// object is a plain object. keys keeps insertion order for for-in.
+type object struct {
+	keys  []string
+	props map[string]value
+}
+
+func newObject() *object {
+	return &object{props: make(map[string]value)}
+}
+
+func (o *object) set(key string, v value) {
+	if _, ok := o.props[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.props[key] = v
+}
+
+type array struct {
+	elems []value
+}
+
+// function is a closure over a parsed function or a native Go function.
+type function struct {
+	name   string
+	lit    *funcLit
+	scope  *scope
+	native func(this value, args []value) (value, error)
+}
+
+func arg(args []value, i int) value {
+	if i < len(args) {
+		return args[i]
+	}
+	return undefined
+}
+
+func typeOf(v value) string {
+	switch v.(type) {
+	case undefinedType:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *function:
+		return "function"
+	}
+	return "object"
+}
+
+func toBoolean(v value) bool {
+	switch v := v.(type) {
+	case undefinedType, null:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func toNumber(v value) float64 {
+	switch v := v.(type) {
+	case undefinedType:
+		return math.NaN()
+	case null:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		return stringToNumber(v)
+	}
+	return toNumber(toPrimitive(v))
+}
+
+func stringToNumber(s string) float64 {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return 0
+	case "Infinity", "+Infinity":
+		return math.Inf(1)
+	case "-Infinity":
+		return math.Inf(-1)
+	}
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-') {
+			return math.NaN()
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return n
+}
+
+// toInteger is ToInteger: NaN becomes 0, everything else is truncated.
+func toInteger(v value) float64 {
+	n := toNumber(v)
+	if math.IsNaN(n) {
+		return 0
+	}
+	return math.Trunc(n)
+}
+
+func toInt32(v value) int32 {
+	n := toNumber(v)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Trunc(math.Mod(n, 1<<32)))))
+}
+
+func toUint32(v value) uint32 {
+	return uint32(toInt32(v))
+}
+
+func numberToString(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	case n == 0:
+		return "0"
+	case n == math.Trunc(n) && math.Abs(n) < 1e21:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case undefinedType:
+		return "undefined"
+	case null:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return numberToString(v)
+	case string:
+		return v
+	}
+	return toString(toPrimitive(v))
+}
+
+// toPrimitive converts objects the way their default toString would.
+func toPrimitive(v value) value {
+	switch v := v.(type) {
+	case *array:
+		parts := make([]string, len(v.elems))
+		for i, e := range v.elems {
+			switch e.(type) {
+			case undefinedType, null:
+			default:
+				parts[i] = toString(e)
+			}
+		}
+		return strings.Join(parts, ",")
+	case *object:
+		return "[object Object]"
+	case *function:
+		return "function " + v.name + "() { [code] }"
+	}
+	return v
+}
+
+func strictEquals(a, b value) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case *object, *array, *function:
+		return a == b
+	}
+	return a == b
+}
+
+func looseEquals(a, b value) bool {
+	if typeOf(a) == typeOf(b) && isNull(a) == isNull(b) {
+		return strictEquals(a, b)
+	}
+	if isNullish(a) || isNullish(b) {
+		return isNullish(a) && isNullish(b)
+	}
+	switch a.(type) {
+	case *object, *array, *function:
+		return looseEquals(toPrimitive(a), b)
+	}
+	switch b.(type) {
+	case *object, *array, *function:
+		return looseEquals(a, toPrimitive(b))
+	}
+	return toNumber(a) == toNumber(b)
+}
+
+func isNull(v value) bool {
+	_, ok := v.(null)
+	return ok
+}
+
+func isNullish(v value) bool {
+	switch v.(type) {
+	case undefinedType, null:
+		return true
+	}
+	return false
+}
+
+// arrayIndex parses key as an array index.
+func arrayIndex(key string) (int, bool) {
+	n, err := strconv.Atoi(key)
+	if err != nil || n < 0 || strconv.Itoa(n) != key {
+		return 0, false
+	}
+	return n, true
+}
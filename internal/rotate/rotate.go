@@ -0,0 +1,107 @@
+// Package rotate provides a size-based rotating log file.
+package rotate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// File is an io.WriteCloser that appends to path and rotates it once it
+// grows past MaxBytes. Rotated files are renamed path.1, path.2, ... with
+// path.1 being the most recent; at most MaxBackups of them are kept.
+type File struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens (or creates) path for appending. A maxBytes of 0 disables
+// rotation.
+func Open(path string, maxBytes int64, maxBackups int) (*File, error) {
+	r := &File{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *File) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", r.path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat %s: %w", r.path, err)
+	}
+	r.f = f
+	r.size = st.Size()
+	return nil
+}
+
+func (r *File) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, fs.ErrClosed
+	}
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *File) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", r.path, err)
+	}
+	r.f = nil
+
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return r.open()
+	}
+
+	_ = os.Remove(backupName(r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(r.path, i), backupName(r.path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, backupName(r.path, 1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return r.open()
+}
+
+func (r *File) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
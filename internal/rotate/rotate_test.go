@@ -0,0 +1,68 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := Open(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range want {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read %s: %v", p, err)
+		}
+		if string(got) != content {
+			t.Fatalf("%s: want %q, got %q", p, content, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 backups, stat .3: %v", err)
+	}
+}
+
+func TestFileAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := f.Write([]byte(strings.Repeat("x", 100) + "\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "old\n") || len(got) != 105 {
+		t.Fatalf("expected append without rotation, got %q", got)
+	}
+}
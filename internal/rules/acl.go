@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+func init() {
+	register(Format{Name: "squid-direct", File: "squid-direct.acl", ContentType: "text/plain; charset=utf-8", Write: squidACL(true)})
+	register(Format{Name: "squid-proxy", File: "squid-proxy.acl", ContentType: "text/plain; charset=utf-8", Write: squidACL(false)})
+	register(Format{Name: "nginx", File: "nginx-map.conf", ContentType: "text/plain; charset=utf-8", Write: writeNginxMap})
+}
+
+// merged returns the domains with one action without those lying under
+// another, which Squid and nginx reject as duplicates.
+func (s Set) merged(direct bool) []string {
+	_, domains, _, _ := pacgen.PruneDomainLists(nil, s.Domains(direct), nil)
+	return domains
+}
+
+// squidACL writes the domains with one action as a dstdomain ACL file. The
+// leading dot matches the domain and its subdomains. Squid checks access
+// rules in order, so the direct ACL must come first.
+func squidACL(direct bool) func(io.Writer, Set, Options) error {
+	return func(w io.Writer, set Set, _ Options) error {
+		if err := set.split(); err != nil {
+			return err
+		}
+		b := bufio.NewWriter(w)
+		for _, d := range set.merged(direct) {
+			b.WriteByte('.')
+			b.WriteString(d)
+			b.WriteByte('\n')
+		}
+		return b.Flush()
+	}
+}
+
+// writeNginxMap writes the body of an nginx map from a host name to
+// "DIRECT", the policy ("PROXY") or, for a source bound to a proxy of its
+// own, the source name. nginx prefers the longest matching name, which
+// agrees with the PAC since the set has no domain under one of an earlier
+// list.
+func writeNginxMap(w io.Writer, set Set, opts Options) error {
+	var targets []string
+	byTarget := make(map[string][]string)
+	for _, direct := range []bool{true, false} {
+		for _, l := range set.Lists {
+			if l.Direct != direct {
+				continue
+			}
+			target := l.policy(opts.policy())
+			if direct {
+				target = "DIRECT"
+			}
+			if _, ok := byTarget[target]; !ok {
+				targets = append(targets, target)
+			}
+			byTarget[target] = append(byTarget[target], l.Domains...)
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("hostnames;\ndefault DIRECT;\n")
+	for _, target := range targets {
+		_, domains, _, _ := pacgen.PruneDomainLists(nil, byTarget[target], nil)
+		for _, d := range domains {
+			b.WriteString("." + d + " " + target + ";\n")
+		}
+	}
+	return b.Flush()
+}
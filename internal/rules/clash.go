@@ -0,0 +1,59 @@
+package rules
+
+import (
+	"bufio"
+	"io"
+)
+
+func init() {
+	register(Format{Name: "clash", File: "clash.yaml", ContentType: "text/yaml; charset=utf-8", Write: writeClashRules})
+	register(Format{Name: "clash-direct", File: "clash-direct.yaml", ContentType: "text/yaml; charset=utf-8", Write: clashProvider(true)})
+	register(Format{Name: "clash-proxy", File: "clash-proxy.yaml", ContentType: "text/yaml; charset=utf-8", Write: clashProvider(false)})
+}
+
+// writeClashRules writes a Clash/Mihomo rules section: one DOMAIN-SUFFIX
+// rule per domain, in list order, and a final MATCH,DIRECT. Sources bound to
+// a proxy of their own go to the proxy group named after the source.
+func writeClashRules(w io.Writer, set Set, opts Options) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("rules:\n")
+	for _, l := range set.Lists {
+		target := l.policy(opts.policy())
+		if l.Direct {
+			target = "DIRECT"
+		}
+		for _, d := range l.Domains {
+			b.WriteString("  - DOMAIN-SUFFIX,")
+			b.WriteString(d)
+			b.WriteByte(',')
+			b.WriteString(target)
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("  - MATCH,DIRECT\n")
+	return b.Flush()
+}
+
+// clashProvider writes the domains with one action as the payload of a
+// classical rule provider. Clients must use the direct provider before the
+// proxy one, which rules out sources bound to a proxy of their own.
+func clashProvider(direct bool) func(io.Writer, Set, Options) error {
+	return func(w io.Writer, set Set, _ Options) error {
+		if err := set.split(); err != nil {
+			return err
+		}
+		b := bufio.NewWriter(w)
+		domains := set.Domains(direct)
+		if len(domains) == 0 {
+			b.WriteString("payload: []\n")
+			return b.Flush()
+		}
+		b.WriteString("payload:\n")
+		for _, d := range domains {
+			b.WriteString("  - DOMAIN-SUFFIX,")
+			b.WriteString(d)
+			b.WriteByte('\n')
+		}
+		return b.Flush()
+	}
+}
@@ -0,0 +1,130 @@
+package rules
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+func init() {
+	register(Format{Name: "dnsmasq", File: "dnsmasq.conf", ContentType: "text/plain; charset=utf-8", Write: writeDnsmasq})
+	register(Format{Name: "unbound", File: "unbound.conf", ContentType: "text/plain; charset=utf-8", Write: writeUnbound})
+	register(Format{Name: "smartdns", File: "smartdns.conf", ContentType: "text/plain; charset=utf-8", Write: writeSmartDNS})
+}
+
+// DNS formats resolve proxied domains through a trusted resolver and can
+// add their addresses to a firewall set that routes through the tunnel.
+// Other hosts keep the default resolver. The resolvers pick the most
+// specific zone, so only DIRECT domains under a proxied domain need a rule
+// of their own. All proxied domains share the resolver, so sources bound to
+// a proxy of their own are rejected.
+
+// directOverrides returns the DIRECT domains lying under a proxied domain,
+// in order.
+func directOverrides(set Set) []string {
+	proxied := make(map[string]bool)
+	for _, d := range set.Domains(false) {
+		proxied[d] = true
+	}
+	var out []string
+	for _, d := range set.Domains(true) {
+		for p := d; ; {
+			i := strings.IndexByte(p, '.')
+			if i < 0 {
+				break
+			}
+			if p = p[i+1:]; proxied[p] {
+				out = append(out, d)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// writeDnsmasq writes server= lines sending proxied domains to the trusted
+// resolver, ipset= and nftset= lines when sets are given, and server=/d/#
+// lines returning DIRECT domains under them to the default resolvers.
+// dnsmasq has no way to exempt those from a set.
+func writeDnsmasq(w io.Writer, set Set, opts Options) error {
+	if err := set.defaultProxy(); err != nil {
+		return err
+	}
+	ip, port, err := opts.dns()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	for _, d := range directOverrides(set) {
+		b.WriteString("server=/" + d + "/#\n")
+	}
+	for _, d := range set.Domains(false) {
+		b.WriteString("server=/" + d + "/" + ip + "#" + port + "\n")
+		if opts.IPSet != "" {
+			b.WriteString("ipset=/" + d + "/" + opts.IPSet + "\n")
+		}
+		if opts.NFTSet != "" {
+			b.WriteString("nftset=/" + d + "/4#" + opts.NFTSet + "\n")
+		}
+	}
+	return b.Flush()
+}
+
+// writeUnbound writes a forward-zone per proxied domain. Unbound cannot
+// return a subzone to the default resolvers, so DIRECT domains under a
+// proxied one are resolved by the trusted resolver too.
+func writeUnbound(w io.Writer, set Set, opts Options) error {
+	if err := set.defaultProxy(); err != nil {
+		return err
+	}
+	ip, port, err := opts.dns()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	for _, d := range set.Domains(false) {
+		b.WriteString("forward-zone:\n")
+		b.WriteString("    name: \"" + d + ".\"\n")
+		b.WriteString("    forward-addr: " + ip + "@" + port + "\n")
+	}
+	return b.Flush()
+}
+
+// smartDNSGroup is the server group proxied domains are resolved by.
+const smartDNSGroup = "pac"
+
+// writeSmartDNS writes a server in its own group and nameserver, ipset
+// and nftset rules for proxied domains. DIRECT domains under them get "-"
+// rules, which restore the defaults.
+func writeSmartDNS(w io.Writer, set Set, opts Options) error {
+	if err := set.defaultProxy(); err != nil {
+		return err
+	}
+	ip, port, err := opts.dns()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	b.WriteString("server " + net.JoinHostPort(ip, port) + " -group " + smartDNSGroup + " -exclude-default-group\n")
+	nftset := ""
+	if opts.NFTSet != "" {
+		nftset = "#4:" + opts.NFTSet
+	}
+	rule := func(d, group, ipset, nftset string) {
+		b.WriteString("nameserver /" + d + "/" + group + "\n")
+		if opts.IPSet != "" {
+			b.WriteString("ipset /" + d + "/" + ipset + "\n")
+		}
+		if opts.NFTSet != "" {
+			b.WriteString("nftset /" + d + "/" + nftset + "\n")
+		}
+	}
+	for _, d := range directOverrides(set) {
+		rule(d, "-", "-", "-")
+	}
+	for _, d := range set.Domains(false) {
+		rule(d, smartDNSGroup, opts.IPSet, nftset)
+	}
+	return b.Flush()
+}
@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func init() {
+	register(Format{Name: "chrome", File: "chrome-policy.json", ContentType: "application/json", Write: writeChromePolicy})
+	register(Format{Name: "firefox", File: "firefox-policies.json", ContentType: "application/json", Write: writeFirefoxPolicy})
+	register(Format{Name: "mobileconfig", File: "proxy.mobileconfig", ContentType: "application/x-apple-aspen-config", Write: writeMobileConfig})
+	register(Format{Name: "windows", File: "proxy.reg", ContentType: "text/plain; charset=utf-8", Write: writeWindowsReg})
+}
+
+// Policy formats configure browsers and operating systems to use the PAC
+// at Options.PACURL, and list the DIRECT domains as proxy bypass entries
+// where the format has them. Clients consult those only when they do not
+// use the PAC, which returns DIRECT for the same domains.
+
+var errNoPACURL = errors.New("policy formats need the PAC URL")
+
+func (o Options) pacURL() (string, error) {
+	if o.PACURL == "" {
+		return "", errNoPACURL
+	}
+	return o.PACURL, nil
+}
+
+// bypass returns the DIRECT domains in the syntax of one client, joined by
+// sep. Each domain yields the entries patterns returns for it.
+func bypass(set Set, sep string, patterns func(d string) []string) string {
+	var entries []string
+	for _, d := range set.Domains(true) {
+		entries = append(entries, patterns(d)...)
+	}
+	return strings.Join(entries, sep)
+}
+
+// wildcardPatterns matches a domain and its subdomains where a bare name
+// matches only the host itself, as in Chrome and Windows.
+func wildcardPatterns(d string) []string {
+	return []string{d, "*." + d}
+}
+
+type chromePolicy struct {
+	ProxySettings chromeProxySettings
+}
+
+type chromeProxySettings struct {
+	ProxyMode       string
+	ProxyPacURL     string `json:"ProxyPacUrl"`
+	ProxyBypassList string `json:",omitempty"`
+}
+
+// writeChromePolicy writes the ProxySettings policy of Chrome and Edge.
+func writeChromePolicy(w io.Writer, set Set, opts Options) error {
+	pacURL, err := opts.pacURL()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, chromePolicy{ProxySettings: chromeProxySettings{
+		ProxyMode:       "pac_script",
+		ProxyPacURL:     pacURL,
+		ProxyBypassList: bypass(set, ",", wildcardPatterns),
+	}})
+}
+
+type firefoxPolicies struct {
+	Policies struct {
+		Proxy firefoxProxy
+	} `json:"policies"`
+}
+
+type firefoxProxy struct {
+	Mode          string
+	AutoConfigURL string
+	Passthrough   string `json:",omitempty"`
+}
+
+// writeFirefoxPolicy writes a Firefox policies.json with the Proxy
+// policy. Firefox matches a bare domain and its subdomains.
+func writeFirefoxPolicy(w io.Writer, set Set, opts Options) error {
+	pacURL, err := opts.pacURL()
+	if err != nil {
+		return err
+	}
+	var p firefoxPolicies
+	p.Policies.Proxy = firefoxProxy{
+		Mode:          "autoConfig",
+		AutoConfigURL: pacURL,
+		Passthrough:   bypass(set, ", ", func(d string) []string { return []string{d} }),
+	}
+	return writeJSON(w, p)
+}
+
+// writeMobileConfig writes an Apple configuration profile with a global
+// HTTP proxy payload using the PAC. The payload has no bypass list. The
+// UUIDs derive from the PAC URL, so the profile only changes with it.
+func writeMobileConfig(w io.Writer, _ Set, opts Options) error {
+	pacURL, err := opts.pacURL()
+	if err != nil {
+		return err
+	}
+	var u strings.Builder
+	xml.EscapeText(&u, []byte(pacURL))
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>PayloadContent</key>
+    <array>
+        <dict>
+            <key>PayloadDisplayName</key>
+            <string>Proxy auto-configuration</string>
+            <key>PayloadIdentifier</key>
+            <string>pac-server.proxy.http.global</string>
+            <key>PayloadType</key>
+            <string>com.apple.proxy.http.global</string>
+            <key>PayloadUUID</key>
+            <string>%s</string>
+            <key>PayloadVersion</key>
+            <integer>1</integer>
+            <key>ProxyType</key>
+            <string>Auto</string>
+            <key>ProxyPACURL</key>
+            <string>%s</string>
+            <key>ProxyPACFallbackAllowed</key>
+            <false/>
+        </dict>
+    </array>
+    <key>PayloadDisplayName</key>
+    <string>Proxy</string>
+    <key>PayloadIdentifier</key>
+    <string>pac-server.proxy</string>
+    <key>PayloadType</key>
+    <string>Configuration</string>
+    <key>PayloadUUID</key>
+    <string>%s</string>
+    <key>PayloadVersion</key>
+    <integer>1</integer>
+</dict>
+</plist>
+`, nameUUID("payload:"+pacURL), u.String(), nameUUID("profile:"+pacURL))
+	return b.Flush()
+}
+
+// nameUUID returns a UUID derived from name, formatted like a version 5
+// UUID.
+func nameUUID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// writeWindowsReg writes a .reg file setting the PAC for the current
+// user's WinINet settings, which Edge, Chrome and most Windows programs
+// use. ProxyOverride takes the bypass list.
+func writeWindowsReg(w io.Writer, set Set, opts Options) error {
+	pacURL, err := opts.pacURL()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	b.WriteString("Windows Registry Editor Version 5.00\r\n\r\n")
+	b.WriteString(`[HKEY_CURRENT_USER\Software\Microsoft\Windows\CurrentVersion\Internet Settings]` + "\r\n")
+	b.WriteString(`"AutoConfigURL"=` + regString(pacURL) + "\r\n")
+	if override := bypass(set, ";", wildcardPatterns); override != "" {
+		b.WriteString(`"ProxyOverride"=` + regString(override) + "\r\n")
+	}
+	return b.Flush()
+}
+
+// regString quotes s as a .reg string value.
+func regString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
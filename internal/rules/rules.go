@@ -0,0 +1,270 @@
+// Package rules exports the domain lists behind the PAC as rule sets for
+// proxy clients that do not read PAC files.
+//
+// Every format keeps the PAC's precedence: lists are checked in order, a
+// host matches a domain when it equals it or ends with "." and the domain,
+// and hosts no list matches go DIRECT.
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+// List is a set of domain suffixes sharing one action.
+type List struct {
+	Name    string // "noproxy", "custom" or a source name such as "gfwlist"
+	Direct  bool   // matching hosts go DIRECT rather than through a proxy
+	Proxy   string // the proxy of a source bound to one of its own; empty for the default proxy
+	Domains []string
+}
+
+// Set is the lists in the order a client must check them.
+type Set struct {
+	Lists []List
+}
+
+// NewSet orders the lists like the PAC: noproxy, then custom, then the
+// sources. A source bound to DIRECT becomes a DIRECT list. Each list is
+// pruned on its own and against the lists before it, whose entries win in
+// the PAC, so formats matching the most specific domain agree with it.
+// Empty lists are left out.
+func NewSet(noProxyDomains, customDomains []string, sources []pacgen.Source) Set {
+	lists := []List{
+		{Name: "noproxy", Direct: true, Domains: noProxyDomains},
+		{Name: "custom", Domains: customDomains},
+	}
+	for _, src := range sources {
+		l := List{Name: src.Name, Proxy: src.Proxy, Domains: src.Domains}
+		if src.Proxy == "DIRECT" {
+			l.Direct, l.Proxy = true, ""
+		}
+		lists = append(lists, l)
+	}
+
+	var set Set
+	var earlier []string
+	for _, l := range lists {
+		_, l.Domains, _, _ = pacgen.PruneDomainLists(earlier, l.Domains, nil)
+		if len(l.Domains) > 0 {
+			set.Lists = append(set.Lists, l)
+			earlier = append(earlier, l.Domains...)
+		}
+	}
+	return set
+}
+
+// Domains returns the domains of the lists with the given action, in
+// order.
+func (s Set) Domains(direct bool) []string {
+	var domains []string
+	for _, l := range s.Lists {
+		if l.Direct == direct {
+			domains = append(domains, l.Domains...)
+		}
+	}
+	return domains
+}
+
+// defaultProxy returns an error when a list goes through a proxy of its
+// own, which formats that only tell proxied hosts from DIRECT ones cannot
+// express.
+func (s Set) defaultProxy() error {
+	for _, l := range s.Lists {
+		if !l.Direct && l.Proxy != "" {
+			return fmt.Errorf("source %s is bound to %q, which this format cannot express", l.Name, l.Proxy)
+		}
+	}
+	return nil
+}
+
+// split returns an error when the set cannot be written as a DIRECT and a
+// proxy list checked in that order: a list goes through a proxy of its
+// own, or a proxied domain lies under a DIRECT domain of a later list.
+func (s Set) split() error {
+	if err := s.defaultProxy(); err != nil {
+		return err
+	}
+	var proxied []string
+	for _, l := range s.Lists {
+		if !l.Direct {
+			proxied = append(proxied, l.Domains...)
+			continue
+		}
+		direct := make(map[string]bool, len(l.Domains))
+		for _, d := range l.Domains {
+			direct[d] = true
+		}
+		for _, d := range proxied {
+			for p := d; strings.Contains(p, "."); {
+				if p = p[strings.IndexByte(p, '.')+1:]; direct[p] {
+					return fmt.Errorf("proxied %s lies under %s of the later DIRECT source %s, which this format cannot express", d, p, l.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// policy returns the policy hosts matching l go to, when not DIRECT: proxy,
+// or the name of the source for one bound to a proxy of its own.
+func (l List) policy(proxy string) string {
+	if l.Proxy != "" {
+		return l.Name
+	}
+	return proxy
+}
+
+// Options are settings shared by the formats.
+type Options struct {
+	// Policy names the proxy in formats that route to a named policy or
+	// outbound, such as a Clash proxy group. Empty means the format's
+	// usual name, "PROXY" for Clash and "proxy" for Quantumult X. Sources
+	// bound to a proxy of their own route to the policy named after the
+	// source.
+	Policy string
+	// DNS is the trusted resolver DNS formats send proxied domains to, as
+	// "IP" or "IP:port". Empty means DefaultDNS.
+	DNS string
+	// IPSet names an ipset that DNS formats add the addresses of proxied
+	// domains to.
+	IPSet string
+	// NFTSet is an nftables set, "family#table#set", that DNS formats add
+	// the IPv4 addresses of proxied domains to.
+	NFTSet string
+	// PACURL is the URL of the PAC that policy formats point browsers
+	// and operating systems at. The policy formats require it.
+	PACURL string
+}
+
+// DefaultDNS is the resolver for proxied domains in DNS formats, a local
+// forwarder such as dns-over-https or a tunnelled DNS.
+const DefaultDNS = "127.0.0.1:5353"
+
+// invalidPolicyChars may not appear in policy names, since they separate
+// fields in some formats.
+const invalidPolicyChars = ",:#'\"\r\n"
+
+var setNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func (o Options) validate() error {
+	if strings.ContainsAny(o.Policy, invalidPolicyChars) {
+		return fmt.Errorf("invalid policy name %q", o.Policy)
+	}
+	if o.DNS != "" {
+		if _, _, err := o.dns(); err != nil {
+			return err
+		}
+	}
+	if o.IPSet != "" && !setNameRe.MatchString(o.IPSet) {
+		return fmt.Errorf("invalid ipset name %q", o.IPSet)
+	}
+	if o.PACURL != "" {
+		if u, err := url.Parse(o.PACURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid PAC URL %q", o.PACURL)
+		}
+	}
+	if o.NFTSet != "" {
+		parts := strings.Split(o.NFTSet, "#")
+		if len(parts) != 3 || !setNameRe.MatchString(parts[0]) || !setNameRe.MatchString(parts[1]) || !setNameRe.MatchString(parts[2]) {
+			return fmt.Errorf("invalid nftables set %q (want family#table#set)", o.NFTSet)
+		}
+	}
+	return nil
+}
+
+// dns returns the IP and port of Options.DNS.
+func (o Options) dns() (ip, port string, err error) {
+	addr := o.DNS
+	if addr == "" {
+		addr = DefaultDNS
+	}
+	ip, port = addr, "53"
+	if host, p, err := net.SplitHostPort(addr); err == nil {
+		ip, port = host, p
+	}
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid DNS server %q (want IP or IP:port)", o.DNS)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid DNS server port in %q", o.DNS)
+	}
+	return ip, port, nil
+}
+
+func (o Options) policy() string {
+	if o.Policy == "" {
+		return "PROXY"
+	}
+	return o.Policy
+}
+
+// Format writes a Set in one client's syntax.
+type Format struct {
+	Name        string // used by gfwlist2pac -format
+	File        string // served at /rules/File
+	ContentType string
+	Write       func(w io.Writer, set Set, opts Options) error
+}
+
+var formats = map[string]Format{}
+
+func register(f Format) {
+	formats[f.Name] = f
+}
+
+// Lookup returns the format called name.
+func Lookup(name string) (Format, bool) {
+	f, ok := formats[name]
+	return f, ok
+}
+
+// ByFile returns the format served under file name.
+func ByFile(file string) (Format, bool) {
+	for _, f := range formats {
+		if f.File == file {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Names returns the names of all formats, sorted.
+func Names() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render writes set in the format called name.
+func Render(name string, set Set, opts Options) ([]byte, error) {
+	f, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown rule format %q", name)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	for _, l := range set.Lists {
+		if l.Proxy != "" && (l.Name == "" || strings.ContainsAny(l.Name, invalidPolicyChars)) {
+			return nil, fmt.Errorf("invalid policy name %q for source bound to %q", l.Name, l.Proxy)
+		}
+	}
+	var b bytes.Buffer
+	if err := f.Write(&b, set, opts); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,426 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+func testSet() Set {
+	return NewSet(
+		[]string{"direct.example.com"},
+		[]string{"example.com", "www.example.com"},
+		gfwlist("google.com", "a.direct.example.com"),
+	)
+}
+
+func gfwlist(domains ...string) []pacgen.Source {
+	return []pacgen.Source{{Name: "gfwlist", Domains: domains}}
+}
+
+func TestNewSet(t *testing.T) {
+	want := Set{Lists: []List{
+		{Name: "noproxy", Direct: true, Domains: []string{"direct.example.com"}},
+		{Name: "custom", Domains: []string{"example.com"}},
+		{Name: "gfwlist", Domains: []string{"google.com"}},
+	}}
+	if got := testSet(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("NewSet:\nwant %+v\n got %+v", want, got)
+	}
+	if got := NewSet(nil, nil, gfwlist("google.com")); len(got.Lists) != 1 || got.Lists[0].Name != "gfwlist" {
+		t.Errorf("empty lists not dropped: %+v", got)
+	}
+}
+
+func TestClash(t *testing.T) {
+	tests := []struct {
+		format string
+		opts   Options
+		want   string
+	}{
+		{"clash", Options{}, `rules:
+  - DOMAIN-SUFFIX,direct.example.com,DIRECT
+  - DOMAIN-SUFFIX,example.com,PROXY
+  - DOMAIN-SUFFIX,google.com,PROXY
+  - MATCH,DIRECT
+`},
+		{"clash", Options{Policy: "Proxies"}, "  - DOMAIN-SUFFIX,google.com,Proxies\n"},
+		{"clash-direct", Options{}, "payload:\n  - DOMAIN-SUFFIX,direct.example.com\n"},
+		{"clash-proxy", Options{}, "payload:\n  - DOMAIN-SUFFIX,example.com\n  - DOMAIN-SUFFIX,google.com\n"},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, testSet(), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), tc.want) {
+			t.Errorf("%s: want %q in\n%s", tc.format, tc.want, got)
+		}
+	}
+
+	got, err := Render("clash-direct", NewSet(nil, nil, gfwlist("google.com")), Options{})
+	if err != nil || string(got) != "payload: []\n" {
+		t.Errorf("empty provider: %q, %v", got, err)
+	}
+}
+
+func TestSurgeAndQuantumultX(t *testing.T) {
+	tests := []struct {
+		format string
+		opts   Options
+		want   string
+	}{
+		{"surge-direct", Options{}, "DOMAIN-SUFFIX,direct.example.com\n"},
+		{"surge-proxy", Options{Policy: "ignored"}, "DOMAIN-SUFFIX,example.com\nDOMAIN-SUFFIX,google.com\n"},
+		{"quantumultx", Options{}, "HOST-SUFFIX,direct.example.com,direct\nHOST-SUFFIX,example.com,proxy\nHOST-SUFFIX,google.com,proxy\n"},
+		{"quantumultx", Options{Policy: "Tunnel"}, "HOST-SUFFIX,direct.example.com,direct\nHOST-SUFFIX,example.com,Tunnel\nHOST-SUFFIX,google.com,Tunnel\n"},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, testSet(), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: want\n%s got\n%s", tc.format, tc.want, got)
+		}
+	}
+}
+
+func TestSingBoxAndV2Ray(t *testing.T) {
+	got, err := Render("singbox-proxy", testSet(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs singBoxRuleSet
+	if err := json.Unmarshal(got, &rs); err != nil {
+		t.Fatal(err)
+	}
+	want := singBoxRuleSet{Version: 1, Rules: []singBoxRule{{DomainSuffix: []string{"example.com", "google.com"}}}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("singbox-proxy: want %+v, got %+v", want, rs)
+	}
+	if got, _ := Render("singbox-direct", NewSet(nil, nil, gfwlist("google.com")), Options{}); !strings.Contains(string(got), `"rules": []`) {
+		t.Errorf("empty sing-box rule set must have no rules:\n%s", got)
+	}
+
+	if got, err = Render("v2ray", testSet(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var routing v2rayRouting
+	if err := json.Unmarshal(got, &routing); err != nil {
+		t.Fatal(err)
+	}
+	wantRouting := v2rayRouting{DomainStrategy: "AsIs", Rules: []v2rayRule{
+		{Type: "field", Domain: []string{"domain:direct.example.com"}, OutboundTag: "direct"},
+		{Type: "field", Domain: []string{"domain:example.com"}, OutboundTag: "proxy"},
+		{Type: "field", Domain: []string{"domain:google.com"}, OutboundTag: "proxy"},
+	}}
+	if !reflect.DeepEqual(routing, wantRouting) {
+		t.Errorf("v2ray: want %+v, got %+v", wantRouting, routing)
+	}
+}
+
+func TestSingBoxBinary(t *testing.T) {
+	set := NewSet(nil, nil, gfwlist("google.com", "a.b.c.net", "b.c.net", "x.io", "oogle.com", "g.cn"))
+	got, err := Render("singbox-proxy-srs", set, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(got, []byte("SRS\x01")) {
+		t.Fatalf("bad header % x", got[:4])
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(got[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(zr)
+	readByte := func() byte {
+		c, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	readUvarint := func() int {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(n)
+	}
+	readUint64s := func() []uint64 {
+		vs := make([]uint64, readUvarint())
+		if err := binary.Read(r, binary.BigEndian, vs); err != nil {
+			t.Fatal(err)
+		}
+		return vs
+	}
+	if n := readUvarint(); n != 1 {
+		t.Fatalf("want 1 rule, got %d", n)
+	}
+	if rule, item, version := readByte(), readByte(), readByte(); rule != srsDefaultRule || item != srsItemDomain || version != srsMatcherVersion {
+		t.Fatalf("unexpected rule header %d %d %d", rule, item, version)
+	}
+	ss := &succinctSet{leaves: readUint64s(), labelBitmap: readUint64s()}
+	ss.labels = make([]byte, readUvarint())
+	if _, err := r.Read(ss.labels); err != nil {
+		t.Fatal(err)
+	}
+	if final, invert := readByte(), readByte(); final != srsItemFinal || invert != 0 {
+		t.Fatalf("unexpected rule trailer %d %d", final, invert)
+	}
+
+	for host, want := range map[string]bool{
+		"google.com": true, "www.google.com": true, "oogle.com": true, "xgoogle.com": false,
+		"b.c.net": true, "a.b.c.net": true, "c.net": false, "x.io": true, "io": false,
+		"g.cn": true, "cn": false, "example.com": false,
+	} {
+		if got := srsMatch(ss, reverse(host)); got != want {
+			t.Errorf("%s: want match %v, got %v", host, want, got)
+		}
+	}
+}
+
+// srsMatch looks up a reversed host the way sing-box's domain matcher does.
+func srsMatch(ss *succinctSet, key string) bool {
+	bit := func(bm []uint64, i int) bool { return i>>6 < len(bm) && bm[i>>6]&(1<<uint(i&63)) != 0 }
+	zeros := func(n int) int { // zero bits of labelBitmap before n
+		c := 0
+		for i := 0; i < n; i++ {
+			if !bit(ss.labelBitmap, i) {
+				c++
+			}
+		}
+		return c
+	}
+	selectOne := func(k int) int { // position of the k-th one bit, from 0
+		for i := 0; ; i++ {
+			if bit(ss.labelBitmap, i) {
+				if k == 0 {
+					return i
+				}
+				k--
+			}
+		}
+	}
+	nodeID, idx := 0, 0
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		for ; ; idx++ {
+			if bit(ss.labelBitmap, idx) {
+				return false
+			}
+			label := ss.labels[idx-nodeID]
+			if label == srsRootLabel && c == '.' && bit(ss.leaves, zeros(idx+1)) {
+				return true
+			}
+			if label == c {
+				break
+			}
+		}
+		nodeID = zeros(idx + 1)
+		idx = selectOne(nodeID-1) + 1
+	}
+	if bit(ss.leaves, nodeID) {
+		return true
+	}
+	for ; !bit(ss.labelBitmap, idx); idx++ {
+		if ss.labels[idx-nodeID] == srsRootLabel {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDNSFormats(t *testing.T) {
+	set := NewSet([]string{"maps.google.com", "intranet.example"}, nil, gfwlist("google.com", "x.io"))
+	tests := []struct {
+		format string
+		opts   Options
+		want   string
+	}{
+		{"dnsmasq", Options{}, `server=/maps.google.com/#
+server=/google.com/127.0.0.1#5353
+server=/x.io/127.0.0.1#5353
+`},
+		{"dnsmasq", Options{DNS: "10.0.0.1", IPSet: "gfw", NFTSet: "inet#fw4#gfw"}, `server=/maps.google.com/#
+server=/google.com/10.0.0.1#53
+ipset=/google.com/gfw
+nftset=/google.com/4#inet#fw4#gfw
+server=/x.io/10.0.0.1#53
+ipset=/x.io/gfw
+nftset=/x.io/4#inet#fw4#gfw
+`},
+		{"unbound", Options{DNS: "[::1]:5300"}, `forward-zone:
+    name: "google.com."
+    forward-addr: ::1@5300
+forward-zone:
+    name: "x.io."
+    forward-addr: ::1@5300
+`},
+		{"smartdns", Options{IPSet: "gfw"}, `server 127.0.0.1:5353 -group pac -exclude-default-group
+nameserver /maps.google.com/-
+ipset /maps.google.com/-
+nameserver /google.com/pac
+ipset /google.com/gfw
+nameserver /x.io/pac
+ipset /x.io/gfw
+`},
+		{"smartdns", Options{NFTSet: "inet#fw4#gfw"}, "nftset /google.com/#4:inet#fw4#gfw\n"},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, set, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), tc.want) {
+			t.Errorf("%s %+v: want\n%s got\n%s", tc.format, tc.opts, tc.want, got)
+		}
+	}
+
+	for _, opts := range []Options{{DNS: "dns.google"}, {DNS: "1.1.1.1:0"}, {IPSet: "a b"}, {NFTSet: "gfw"}} {
+		if _, err := Render("dnsmasq", set, opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
+
+func TestSquidAndNginx(t *testing.T) {
+	// www.example.com is in both proxied lists, under example.com.
+	set := NewSet([]string{"maps.google.com"}, []string{"example.com"}, gfwlist("google.com", "www.example.com"))
+	tests := []struct {
+		format string
+		opts   Options
+		want   string
+	}{
+		{"squid-direct", Options{}, ".maps.google.com\n"},
+		{"squid-proxy", Options{}, ".example.com\n.google.com\n"},
+		{"nginx", Options{Policy: "tunnel"}, `hostnames;
+default DIRECT;
+.maps.google.com DIRECT;
+.example.com tunnel;
+.google.com tunnel;
+`},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, set, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: want\n%s got\n%s", tc.format, tc.want, got)
+		}
+	}
+}
+
+func TestSourceBindings(t *testing.T) {
+	// cn goes DIRECT, but google.cn is proxied by the earlier gfwlist;
+	// corp has a proxy of its own.
+	set := NewSet(nil, nil, []pacgen.Source{
+		{Name: "gfwlist", Domains: []string{"google.cn", "google.com"}},
+		{Name: "cn", Proxy: "DIRECT", Domains: []string{"cn", "www.google.com"}},
+		{Name: "corp", Proxy: "PROXY corp.example.com:3128", Domains: []string{"corp.example.com"}},
+	})
+	want := Set{Lists: []List{
+		{Name: "gfwlist", Domains: []string{"google.cn", "google.com"}},
+		{Name: "cn", Direct: true, Domains: []string{"cn"}},
+		{Name: "corp", Proxy: "PROXY corp.example.com:3128", Domains: []string{"corp.example.com"}},
+	}}
+	if !reflect.DeepEqual(set, want) {
+		t.Fatalf("NewSet:\nwant %+v\n got %+v", want, set)
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"clash", "  - DOMAIN-SUFFIX,google.com,PROXY\n  - DOMAIN-SUFFIX,cn,DIRECT\n  - DOMAIN-SUFFIX,corp.example.com,corp\n"},
+		{"quantumultx", "HOST-SUFFIX,cn,direct\nHOST-SUFFIX,corp.example.com,corp\n"},
+		{"v2ray", `"outboundTag": "corp"`},
+		{"nginx", ".cn DIRECT;\n.google.cn PROXY;\n.google.com PROXY;\n.corp.example.com corp;\n"},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, set, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), tc.want) {
+			t.Errorf("%s: want %q in\n%s", tc.format, tc.want, got)
+		}
+	}
+
+	for _, format := range []string{"clash-proxy", "surge-proxy", "singbox-proxy", "singbox-proxy-srs", "squid-proxy", "dnsmasq", "unbound", "smartdns"} {
+		if _, err := Render(format, set, Options{}); err == nil || !strings.Contains(err.Error(), "corp") {
+			t.Errorf("%s: expected an error for the corp binding, got %v", format, err)
+		}
+	}
+	// Without corp, a DIRECT cn after gfwlist's google.cn still cannot be
+	// split into a direct set checked first.
+	set.Lists = set.Lists[:2]
+	if _, err := Render("clash-direct", set, Options{}); err == nil || !strings.Contains(err.Error(), "google.cn") {
+		t.Errorf("expected an error for google.cn under the later cn, got %v", err)
+	}
+	if _, err := Render("dnsmasq", set, Options{}); err != nil {
+		t.Errorf("dnsmasq matches the most specific domain and should accept the set: %v", err)
+	}
+	set.Lists = append(set.Lists, List{Name: "a,b", Proxy: "PROXY b:1", Domains: []string{"b.example"}})
+	if _, err := Render("clash", set, Options{}); err == nil {
+		t.Error("expected an error for a source name unusable as a policy")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	opts := Options{PACURL: "https://pac.example.com/proxy.pac"}
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"chrome", []string{`"ProxyMode": "pac_script"`, `"ProxyPacUrl": "https://pac.example.com/proxy.pac"`, `"ProxyBypassList": "direct.example.com,*.direct.example.com"`}},
+		{"firefox", []string{`"policies": {`, `"Mode": "autoConfig"`, `"AutoConfigURL": "https://pac.example.com/proxy.pac"`, `"Passthrough": "direct.example.com"`}},
+		{"mobileconfig", []string{"<string>com.apple.proxy.http.global</string>", "<string>https://pac.example.com/proxy.pac</string>", "<string>Configuration</string>"}},
+		{"windows", []string{"Windows Registry Editor Version 5.00\r\n\r\n", `"AutoConfigURL"="https://pac.example.com/proxy.pac"` + "\r\n", `"ProxyOverride"="direct.example.com;*.direct.example.com"` + "\r\n"}},
+	}
+	for _, tc := range tests {
+		got, err := Render(tc.format, testSet(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(got), want) {
+				t.Errorf("%s: want %q in\n%s", tc.format, want, got)
+			}
+		}
+		if _, err := Render(tc.format, testSet(), Options{}); err == nil {
+			t.Errorf("%s: expected an error without a PAC URL", tc.format)
+		}
+	}
+
+	if got, _ := Render("chrome", NewSet(nil, nil, gfwlist("google.com")), opts); strings.Contains(string(got), "ProxyBypassList") {
+		t.Errorf("empty bypass list written:\n%s", got)
+	}
+	if _, err := Render("chrome", testSet(), Options{PACURL: "file:///proxy.pac"}); err == nil {
+		t.Error("expected an error for a non-HTTP PAC URL")
+	}
+	if a, b := nameUUID("x"), nameUUID("y"); a == b || len(a) != 36 || a[14] != '5' {
+		t.Errorf("bad UUIDs %s %s", a, b)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	if _, err := Render("clash", testSet(), Options{Policy: "a,b"}); err == nil {
+		t.Error("expected an error for a policy name with a comma")
+	}
+	if _, err := Render("pac", testSet(), Options{}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if f, ok := ByFile("clash.yaml"); !ok || f.Name != "clash" {
+		t.Errorf("ByFile(clash.yaml) = %+v, %v", f, ok)
+	}
+}
@@ -0,0 +1,229 @@
+package rules
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+func init() {
+	register(Format{Name: "singbox-direct", File: "singbox-direct.json", ContentType: "application/json", Write: singBoxSource(true)})
+	register(Format{Name: "singbox-proxy", File: "singbox-proxy.json", ContentType: "application/json", Write: singBoxSource(false)})
+	register(Format{Name: "singbox-direct-srs", File: "singbox-direct.srs", ContentType: "application/octet-stream", Write: singBoxBinary(true)})
+	register(Format{Name: "singbox-proxy-srs", File: "singbox-proxy.srs", ContentType: "application/octet-stream", Write: singBoxBinary(false)})
+	register(Format{Name: "v2ray", File: "v2ray.json", ContentType: "application/json", Write: writeV2Ray})
+}
+
+// singBoxRuleSet is a sing-box source rule set. Version 1 is read by every
+// sing-box release that supports rule sets.
+type singBoxRuleSet struct {
+	Version int           `json:"version"`
+	Rules   []singBoxRule `json:"rules"`
+}
+
+type singBoxRule struct {
+	DomainSuffix []string `json:"domain_suffix"`
+}
+
+// singBoxSource writes the domains with one action as a sing-box source
+// rule set. A set without domains has no rules, since a rule without
+// conditions would match every host.
+func singBoxSource(direct bool) func(io.Writer, Set, Options) error {
+	return func(w io.Writer, set Set, _ Options) error {
+		if err := set.split(); err != nil {
+			return err
+		}
+		rs := singBoxRuleSet{Version: 1, Rules: []singBoxRule{}}
+		if domains := set.Domains(direct); len(domains) > 0 {
+			rs.Rules = append(rs.Rules, singBoxRule{DomainSuffix: domains})
+		}
+		return writeJSON(w, rs)
+	}
+}
+
+// v2rayRouting is the routing object of a v2ray or Xray configuration.
+type v2rayRouting struct {
+	DomainStrategy string      `json:"domainStrategy"`
+	Rules          []v2rayRule `json:"rules"`
+}
+
+type v2rayRule struct {
+	Type        string   `json:"type"`
+	Domain      []string `json:"domain"`
+	OutboundTag string   `json:"outboundTag"`
+}
+
+// writeV2Ray writes a v2ray/Xray routing object with one rule per list,
+// in list order, sending hosts to the outbounds tagged "direct" and
+// Options.Policy ("proxy"). Unmatched hosts go to the first outbound of
+// the configuration, which should be the direct one. Sources bound to a
+// proxy of their own go to the outbound tagged with the source name.
+func writeV2Ray(w io.Writer, set Set, opts Options) error {
+	proxy := opts.Policy
+	if proxy == "" {
+		proxy = "proxy"
+	}
+	routing := v2rayRouting{DomainStrategy: "AsIs", Rules: []v2rayRule{}}
+	for _, l := range set.Lists {
+		rule := v2rayRule{Type: "field", OutboundTag: l.policy(proxy), Domain: make([]string, len(l.Domains))}
+		if l.Direct {
+			rule.OutboundTag = "direct"
+		}
+		for i, d := range l.Domains {
+			rule.Domain[i] = "domain:" + d
+		}
+		routing.Rules = append(routing.Rules, rule)
+	}
+	return writeJSON(w, routing)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// sing-box binary rule sets: "SRS", a version byte and a zlib stream with
+// the rule count and the rules.
+const (
+	srsVersion        = 1
+	srsDefaultRule    = 0
+	srsItemDomain     = 2
+	srsItemFinal      = 0xff
+	srsMatcherVersion = 1
+	srsRootLabel      = '\n'
+)
+
+// singBoxBinary writes the domains with one action as a compiled sing-box
+// rule set (.srs).
+func singBoxBinary(direct bool) func(io.Writer, Set, Options) error {
+	return func(w io.Writer, set Set, _ Options) error {
+		if err := set.split(); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'S', 'R', 'S', srsVersion}); err != nil {
+			return err
+		}
+		zw, err := zlib.NewWriterLevel(w, zlib.BestCompression)
+		if err != nil {
+			return err
+		}
+		b := bufio.NewWriter(zw)
+		domains := set.Domains(direct)
+		if len(domains) == 0 {
+			writeUvarint(b, 0)
+		} else {
+			writeUvarint(b, 1)
+			b.WriteByte(srsDefaultRule)
+			b.WriteByte(srsItemDomain)
+			writeDomainMatcher(b, domains)
+			b.WriteByte(srsItemFinal)
+			b.WriteByte(0) // not inverted
+		}
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+}
+
+// writeDomainMatcher writes sing-box's domain matcher: a succinct trie of
+// the reversed domains. Each domain ends in the root label, which matches
+// the domain itself and, before a ".", every subdomain.
+func writeDomainMatcher(b *bufio.Writer, domains []string) {
+	keys := make([]string, len(domains))
+	for i, d := range domains {
+		keys[i] = reverse(d) + string(srsRootLabel)
+	}
+	sort.Strings(keys)
+	keys = dedupSorted(keys)
+
+	set := newSuccinctSet(keys)
+	b.WriteByte(srsMatcherVersion)
+	writeUint64s(b, set.leaves)
+	writeUint64s(b, set.labelBitmap)
+	writeUvarint(b, uint64(len(set.labels)))
+	b.Write(set.labels)
+}
+
+// succinctSet is a trie in LOUDS form, as sing-box reads it: labelBitmap
+// has a 0 for each child label of a node, in breadth-first order, and a 1
+// ending each node; leaves marks the nodes where a key ends.
+type succinctSet struct {
+	leaves, labelBitmap []uint64
+	labels              []byte
+}
+
+// newSuccinctSet builds the set from sorted, unique keys.
+func newSuccinctSet(keys []string) *succinctSet {
+	ss := &succinctSet{}
+	type span struct{ start, end, col int }
+	queue := []span{{0, len(keys), 0}}
+	bit := 0
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+		if node.start < node.end && node.col == len(keys[node.start]) {
+			node.start++
+			setBit(&ss.leaves, i)
+		}
+		for j := node.start; j < node.end; {
+			from := j
+			for j < node.end && keys[j][node.col] == keys[from][node.col] {
+				j++
+			}
+			queue = append(queue, span{from, j, node.col + 1})
+			ss.labels = append(ss.labels, keys[from][node.col])
+			growBits(&ss.labelBitmap, bit)
+			bit++
+		}
+		setBit(&ss.labelBitmap, bit)
+		bit++
+	}
+	return ss
+}
+
+func growBits(bm *[]uint64, i int) {
+	for i>>6 >= len(*bm) {
+		*bm = append(*bm, 0)
+	}
+}
+
+func setBit(bm *[]uint64, i int) {
+	growBits(bm, i)
+	(*bm)[i>>6] |= 1 << uint(i&63)
+}
+
+func reverse(s string) string {
+	b := make([]byte, len(s))
+	for i := range s {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
+
+func dedupSorted(keys []string) []string {
+	out := keys[:0]
+	for i, k := range keys {
+		if i == 0 || k != keys[i-1] {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func writeUvarint(b *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeUint64s(b *bufio.Writer, vs []uint64) {
+	writeUvarint(b, uint64(len(vs)))
+	var buf [8]byte
+	for _, v := range vs {
+		binary.BigEndian.PutUint64(buf[:], v)
+		b.Write(buf[:])
+	}
+}
@@ -0,0 +1,56 @@
+package rules
+
+import (
+	"bufio"
+	"io"
+)
+
+func init() {
+	register(Format{Name: "surge-direct", File: "surge-direct.list", ContentType: "text/plain; charset=utf-8", Write: surgeRuleSet(true)})
+	register(Format{Name: "surge-proxy", File: "surge-proxy.list", ContentType: "text/plain; charset=utf-8", Write: surgeRuleSet(false)})
+	register(Format{Name: "quantumultx", File: "quantumultx.list", ContentType: "text/plain; charset=utf-8", Write: writeQuantumultX})
+}
+
+// surgeRuleSet writes the domains with one action as a Surge RULE-SET,
+// which Shadowrocket reads too. The policy is given where the set is used,
+// so clients must use the direct set before the proxy one.
+func surgeRuleSet(direct bool) func(io.Writer, Set, Options) error {
+	return func(w io.Writer, set Set, _ Options) error {
+		if err := set.split(); err != nil {
+			return err
+		}
+		b := bufio.NewWriter(w)
+		for _, d := range set.Domains(direct) {
+			b.WriteString("DOMAIN-SUFFIX,")
+			b.WriteString(d)
+			b.WriteByte('\n')
+		}
+		return b.Flush()
+	}
+}
+
+// writeQuantumultX writes a Quantumult X filter resource: one HOST-SUFFIX
+// rule per domain with its policy, in list order. The final policy is part
+// of the client's own configuration. Sources bound to a proxy of their own
+// go to the policy named after the source.
+func writeQuantumultX(w io.Writer, set Set, opts Options) error {
+	proxy := opts.Policy
+	if proxy == "" {
+		proxy = "proxy"
+	}
+	b := bufio.NewWriter(w)
+	for _, l := range set.Lists {
+		target := l.policy(proxy)
+		if l.Direct {
+			target = "direct"
+		}
+		for _, d := range l.Domains {
+			b.WriteString("HOST-SUFFIX,")
+			b.WriteString(d)
+			b.WriteByte(',')
+			b.WriteString(target)
+			b.WriteByte('\n')
+		}
+	}
+	return b.Flush()
+}
@@ -0,0 +1,475 @@
+// Package sources loads the domain lists a PAC is generated from: the
+// noproxy and custom domain files, and the ordered proxied sources, which
+// are local files, URLs or the embedded gfwlist. The server and
+// gfwlist2pac both load through it, so they generate the same PAC from the
+// same inputs.
+package sources
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+// EmbeddedGFWList is the gfwlist built into the binary, set by commands
+// that embed one. Embedded sources and fallbacks read it.
+var EmbeddedGFWList []byte
+
+// EmbeddedName is the location reported for the embedded gfwlist.
+const EmbeddedName = "embedded:gfwlist.txt"
+
+// Stdin is the Path of a source read from standard input. It is read
+// once; later loads reuse the content.
+const Stdin = "-"
+
+// DefaultRefresh is how often URL sources are downloaded again unless
+// their Refresh says otherwise.
+const DefaultRefresh = 24 * time.Hour
+
+// MinRefresh keeps a misconfigured source from hammering its server.
+const MinRefresh = time.Minute
+
+// MaxDownload caps the size of a downloaded source, so a misbehaving
+// server cannot exhaust memory. The gfwlist is well under 1 MiB.
+const MaxDownload = 32 << 20
+
+// Source is one proxied domain list: a local file, a URL or the embedded
+// gfwlist. Sources are checked in order after the custom domains, and each
+// sends the hosts it matches to its Proxy.
+type Source struct {
+	Name     string
+	Path     string
+	URL      string
+	Embedded bool
+	// Fallback reads the embedded gfwlist when Path is missing.
+	Fallback bool
+	Format   pacgen.SourceFormat
+	Refresh  time.Duration // URL sources only
+	Enabled  bool
+	Proxy    string // empty means the default proxy
+
+	mu      sync.Mutex
+	content []byte    // last download of URL, or standard input
+	etag    string    // ETag of content, for conditional requests
+	version int       // bumped when a download changes content
+	fetched time.Time // last successful download
+	// loadErr and fetchErr are the errors of the last load and download,
+	// nil once one succeeds.
+	loadErr, fetchErr error
+}
+
+// config is one entry of a sources file.
+type config struct {
+	Name     string `json:"name"`
+	Path     string `json:"path,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Embedded bool   `json:"embedded,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Refresh  string `json:"refresh,omitempty"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+	Proxy    string `json:"proxy,omitempty"`
+}
+
+// reservedNames are the lists sources are checked after.
+var reservedNames = map[string]bool{"noproxy": true, "domains": true, "proxy": true, "custom": true}
+
+// ReadFile reads the ordered sources of a JSON sources file. Relative
+// paths are resolved against the directory of the file.
+func ReadFile(path string) ([]*Source, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sources: %w", err)
+	}
+	var configs []config
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s: no sources", path)
+	}
+
+	var sources []*Source
+	seen := make(map[string]bool)
+	for i, c := range configs {
+		src, err := c.source(filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: source %d: %w", path, i+1, err)
+		}
+		if seen[src.Name] {
+			return nil, fmt.Errorf("%s: source %d: duplicate name %q", path, i+1, src.Name)
+		}
+		seen[src.Name] = true
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func (c config) source(dir string) (*Source, error) {
+	if c.Name == "" || reservedNames[c.Name] {
+		return nil, fmt.Errorf("invalid name %q", c.Name)
+	}
+	set := 0
+	for _, ok := range []bool{c.Path != "", c.URL != "", c.Embedded} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("%s: want exactly one of path, url and embedded", c.Name)
+	}
+
+	src := &Source{Name: c.Name, URL: c.URL, Embedded: c.Embedded, Enabled: true, Proxy: c.Proxy}
+	if c.Enabled != nil {
+		src.Enabled = *c.Enabled
+	}
+	if c.Path != "" {
+		src.Path = c.Path
+		if !filepath.IsAbs(src.Path) {
+			src.Path = filepath.Join(dir, src.Path)
+		}
+	}
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: invalid url %q", c.Name, c.URL)
+		}
+	}
+
+	src.Format = pacgen.FormatAuto
+	if c.Format != "" {
+		format, err := pacgen.ParseSourceFormat(c.Format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		src.Format = format
+	}
+
+	if c.Refresh != "" {
+		if c.URL == "" {
+			return nil, fmt.Errorf("%s: refresh only applies to url sources", c.Name)
+		}
+		d, err := time.ParseDuration(c.Refresh)
+		if err != nil {
+			return nil, fmt.Errorf("%s: refresh: %w", c.Name, err)
+		}
+		if d < MinRefresh {
+			return nil, fmt.Errorf("%s: refresh %s is shorter than %s", c.Name, d, MinRefresh)
+		}
+		src.Refresh = d
+	} else if c.URL != "" {
+		src.Refresh = DefaultRefresh
+	}
+	return src, nil
+}
+
+// Location is where the source is read from, for reports.
+func (src *Source) Location() string {
+	switch {
+	case src.URL != "":
+		return src.URL
+	case src.Embedded:
+		return EmbeddedName
+	}
+	return src.Path
+}
+
+// CacheKey changes whenever the content of the source may have changed.
+func (src *Source) CacheKey() (string, error) {
+	switch {
+	case src.URL != "":
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		return fmt.Sprintf("u:%s:%d", src.URL, src.version), nil
+	case src.Embedded:
+		return fmt.Sprintf("g:embedded:%d", len(EmbeddedGFWList)), nil
+	case src.Path == Stdin:
+		return "stdin", nil
+	}
+	stat, err := os.Stat(src.Path)
+	if err != nil {
+		if src.Fallback && errors.Is(err, os.ErrNotExist) {
+			return fmt.Sprintf("g:embedded:%d", len(EmbeddedGFWList)), nil
+		}
+		return "", err
+	}
+	return fmt.Sprintf("f:%s:%d:%d", src.Path, stat.ModTime().UnixNano(), stat.Size()), nil
+}
+
+// Downloaded reports whether a URL source has content to load.
+func (src *Source) Downloaded() bool {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	return src.content != nil
+}
+
+// read returns the content of the source and where it came from. A URL
+// source must have been downloaded; until it is, read returns the error of
+// the last download.
+func (src *Source) read() ([]byte, string, error) {
+	switch {
+	case src.URL != "":
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		if src.content == nil {
+			if src.fetchErr != nil {
+				return nil, "", src.fetchErr
+			}
+			return nil, "", fmt.Errorf("%s not downloaded", src.URL)
+		}
+		return src.content, src.URL, nil
+	case src.Embedded:
+		if EmbeddedGFWList == nil {
+			return nil, "", errors.New("no embedded gfwlist")
+		}
+		return EmbeddedGFWList, EmbeddedName, nil
+	case src.Path == Stdin:
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		if src.content == nil {
+			content, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, "", fmt.Errorf("read stdin: %w", err)
+			}
+			src.content = content
+		}
+		return src.content, "stdin", nil
+	}
+
+	content, err := os.ReadFile(src.Path)
+	if err != nil {
+		if src.Fallback && EmbeddedGFWList != nil && errors.Is(err, os.ErrNotExist) {
+			return EmbeddedGFWList, "embedded:" + src.Path, nil
+		}
+		return nil, "", fmt.Errorf("read %s: %w", src.Path, err)
+	}
+	return content, src.Path, nil
+}
+
+// Loaded is a parsed source.
+type Loaded struct {
+	Source      *Source
+	Name        string // where it was read from
+	Entries     []pacgen.Entry
+	Diagnostics []pacgen.Diagnostic
+}
+
+// Domains returns the sorted unique domains of the source.
+func (l Loaded) Domains() []string {
+	return pacgen.EntryDomains(l.Entries)
+}
+
+// Load reads and parses the source. The embedded gfwlist is always read as
+// auto, and v2fly include: lines name files next to a local source.
+func (src *Source) Load() (loaded Loaded, err error) {
+	defer func() {
+		src.mu.Lock()
+		src.loadErr = err
+		src.mu.Unlock()
+	}()
+
+	content, name, err := src.read()
+	if err != nil {
+		return Loaded{}, err
+	}
+	format, include := src.Format, pacgen.IncludeFunc(nil)
+	if name == src.Path && src.Path != Stdin {
+		include = pacgen.IncludeDir(filepath.Dir(src.Path))
+	} else if src.URL == "" && src.Path != Stdin {
+		format = pacgen.FormatAuto
+	}
+	entries, diags, err := pacgen.ParseSource(format, content, include)
+	if err != nil {
+		return Loaded{}, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return Loaded{Source: src, Name: name, Entries: entries, Diagnostics: diags}, nil
+}
+
+// Fetch downloads a URL source with client and reports whether its content
+// changed. A failed download keeps the previous content.
+func (src *Source) Fetch(client *http.Client) (changed bool, err error) {
+	defer func() {
+		if err != nil {
+			src.mu.Lock()
+			src.fetchErr = err
+			src.mu.Unlock()
+		}
+	}()
+
+	src.mu.Lock()
+	etag := src.etag
+	src.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, src.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", src.URL, err)
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		src.mu.Lock()
+		src.fetched, src.fetchErr = now, nil
+		src.mu.Unlock()
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("download %s: unexpected status %s", src.URL, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, MaxDownload+1))
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", src.URL, err)
+	}
+	if len(content) > MaxDownload {
+		return false, fmt.Errorf("download %s: larger than %d MiB", src.URL, MaxDownload>>20)
+	}
+
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	changed = !bytes.Equal(content, src.content)
+	if changed {
+		src.content = content
+		src.version++
+	}
+	src.etag = resp.Header.Get("ETag")
+	src.fetched, src.fetchErr = now, nil
+	return changed, nil
+}
+
+// Updated is when the source was last known current: the modification
+// time of a file or the last download of a URL. It is false for the
+// embedded gfwlist, standard input and sources not read yet.
+func (src *Source) Updated() (time.Time, bool) {
+	switch {
+	case src.URL != "":
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		return src.fetched, !src.fetched.IsZero()
+	case src.Embedded, src.Path == Stdin:
+		return time.Time{}, false
+	}
+	st, err := os.Stat(src.Path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return st.ModTime(), true
+}
+
+// Err returns the error of the last load, or else of the last download.
+// A URL source never downloaded reports why the download failed.
+func (src *Source) Err() error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.URL != "" && src.content == nil && src.fetchErr != nil {
+		return src.fetchErr
+	}
+	if src.loadErr != nil {
+		return src.loadErr
+	}
+	return src.fetchErr
+}
+
+// ReadList reads a domains.txt-style file: its sorted unique domains and
+// the lines that yielded none. A missing file, or no path, is empty.
+func ReadList(path string) ([]string, []pacgen.Diagnostic, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	domains, diags := ParseList(content)
+	return domains, diags, nil
+}
+
+// ParseList returns the sorted unique domains of a domains.txt-style list
+// and the lines that yielded none.
+func ParseList(raw []byte) ([]string, []pacgen.Diagnostic) {
+	entries, diags := pacgen.ParseDomainDiagnostics(string(raw))
+	return pacgen.EntryDomains(entries), diags
+}
+
+// Lists are the loaded inputs of a PAC.
+type Lists struct {
+	NoProxy, Custom           []string
+	NoProxyDiags, CustomDiags []pacgen.Diagnostic
+	// Sources are the enabled sources that loaded, in order.
+	Sources []Loaded
+	// Skipped are URL sources left out because they have not been
+	// downloaded or did not parse. Their Err says why.
+	Skipped []*Source
+}
+
+// Load reads the noproxy and custom domain files and the enabled sources.
+// Missing domain files are empty. A URL source that fails is skipped, so a
+// remote outage does not take the PAC down; any other error fails the
+// load.
+func Load(noProxyPath, customPath string, sources []*Source) (Lists, error) {
+	var l Lists
+	var err error
+	if l.NoProxy, l.NoProxyDiags, err = ReadList(noProxyPath); err != nil {
+		return Lists{}, err
+	}
+	if l.Custom, l.CustomDiags, err = ReadList(customPath); err != nil {
+		return Lists{}, err
+	}
+	for _, src := range sources {
+		if !src.Enabled {
+			continue
+		}
+		loaded, err := src.Load()
+		if err != nil {
+			if src.URL != "" {
+				l.Skipped = append(l.Skipped, src)
+				continue
+			}
+			return Lists{}, err
+		}
+		l.Sources = append(l.Sources, loaded)
+	}
+	return l, nil
+}
+
+// PACSources returns the sources as GenerateSources takes them.
+func (l Lists) PACSources() []pacgen.Source {
+	sources := make([]pacgen.Source, len(l.Sources))
+	for i, s := range l.Sources {
+		sources[i] = pacgen.Source{Name: s.Source.Name, Proxy: s.Source.Proxy, Domains: s.Domains()}
+	}
+	return sources
+}
+
+// Domains returns the sorted unique domains of all sources.
+func (l Lists) Domains() []string {
+	var all []pacgen.Entry
+	for _, s := range l.Sources {
+		all = append(all, s.Entries...)
+	}
+	return pacgen.EntryDomains(all)
+}
+
+// Generate generates the PAC of the lists.
+func (l Lists) Generate(opts pacgen.Options) (string, pacgen.PruneStats, error) {
+	return pacgen.GenerateSources(l.NoProxy, l.Custom, l.PACSources(), opts)
+}
@@ -0,0 +1,140 @@
+package sources
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "sources.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	srcs, err := ReadFile(write(`[
+		{"name": "geosite", "path": "lists/geosite", "format": "v2fly", "proxy": "SOCKS5 127.0.0.1:1080"},
+		{"name": "gfwlist", "url": "https://example.com/gfwlist.txt", "format": "gfwlist", "refresh": "6h"},
+		{"name": "builtin", "embedded": true, "enabled": false}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srcs) != 3 {
+		t.Fatalf("got %d sources, want 3", len(srcs))
+	}
+	if want := filepath.Join(dir, "lists", "geosite"); srcs[0].Path != want || srcs[0].Format != pacgen.FormatV2Fly {
+		t.Fatalf("unexpected first source %+v", srcs[0])
+	}
+	if srcs[1].Refresh != 6*time.Hour || srcs[1].Format != pacgen.FormatGFWList {
+		t.Fatalf("unexpected second source %+v", srcs[1])
+	}
+	if srcs[2].Enabled || srcs[2].Format != pacgen.FormatAuto {
+		t.Fatalf("unexpected third source %+v", srcs[2])
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`[{"name": "a"}]`,
+		`[{"name": "a", "path": "x", "url": "https://example.com/"}]`,
+		`[{"name": "noproxy", "path": "x"}]`,
+		`[{"name": "a", "path": "x"}, {"name": "a", "path": "y"}]`,
+		`[{"name": "a", "url": "ftp://example.com/"}]`,
+		`[{"name": "a", "url": "https://example.com/", "refresh": "1s"}]`,
+		`[{"name": "a", "path": "x", "refresh": "1h"}]`,
+		`[{"name": "a", "path": "x", "format": "yaml"}]`,
+		`[{"name": "a", "path": "x", "typo": true}]`,
+	} {
+		if _, err := ReadFile(write(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "streaming.txt")
+	if err := os.WriteFile(local, []byte("netflix.com\n*.bad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	remote := &Source{Name: "remote", URL: srv.URL, Format: pacgen.FormatAuto, Enabled: true}
+	if _, err := remote.Fetch(srv.Client()); err == nil {
+		t.Fatal("expected a failed download")
+	}
+	srcs := []*Source{
+		{Name: "streaming", Path: local, Format: pacgen.FormatPlain, Enabled: true, Proxy: "SOCKS5 127.0.0.1:1080"},
+		remote,
+		{Name: "off", Path: filepath.Join(dir, "missing.txt"), Format: pacgen.FormatAuto},
+	}
+	lists, err := Load(filepath.Join(dir, "noproxy.txt"), "", srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lists.NoProxy != nil || lists.Custom != nil {
+		t.Fatalf("missing domain files should be empty: %v %v", lists.NoProxy, lists.Custom)
+	}
+	if len(lists.Sources) != 1 || lists.Sources[0].Name != local || len(lists.Sources[0].Diagnostics) != 1 {
+		t.Fatalf("unexpected sources %+v", lists.Sources)
+	}
+	if len(lists.Skipped) != 1 || lists.Skipped[0] != remote || !strings.Contains(remote.Err().Error(), "502") {
+		t.Fatalf("want the remote source skipped with its download error, got %v", lists.Skipped)
+	}
+	if got := lists.PACSources(); len(got) != 1 || got[0].Proxy != "SOCKS5 127.0.0.1:1080" || strings.Join(got[0].Domains, ",") != "netflix.com" {
+		t.Fatalf("unexpected PAC sources %+v", got)
+	}
+
+	srcs[0].Path = filepath.Join(dir, "gone.txt")
+	if _, err := Load("", "", srcs); err == nil {
+		t.Fatal("a missing local source should fail the load")
+	}
+}
+
+func TestCacheKeyEmbeddedFallback(t *testing.T) {
+	src := &Source{Name: "gfwlist", Path: filepath.Join(t.TempDir(), "gfwlist.txt"), Fallback: true, Enabled: true}
+	key, err := src.CacheKey()
+	if err != nil || !strings.HasPrefix(key, "g:embedded:") {
+		t.Fatalf("want the embedded key for a missing fallback file, got %q, %v", key, err)
+	}
+	src.Fallback = false
+	if _, err := src.CacheKey(); err == nil {
+		t.Fatal("expected an error for a missing file without fallback")
+	}
+}
+
+func TestReadListNotExist(t *testing.T) {
+	domains, diags, err := ReadList(filepath.Join(t.TempDir(), "domains.txt"))
+	if err != nil || domains != nil || diags != nil {
+		t.Fatalf("want nothing for a missing list, got %v, %v, %v", domains, diags, err)
+	}
+}
+
+func TestFetchRejectsOversizedDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(w, strings.NewReader(strings.Repeat("a.example.com\n", MaxDownload/14+1)), MaxDownload+1)
+	}))
+	defer srv.Close()
+
+	src := &Source{Name: "big", URL: srv.URL, Enabled: true}
+	if _, err := src.Fetch(srv.Client()); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("want an error for a download over MaxDownload, got %v", err)
+	}
+	if src.Downloaded() {
+		t.Fatal("an oversized download must not be kept")
+	}
+}
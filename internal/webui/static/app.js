@@ -0,0 +1,234 @@
+'use strict';
+
+// Entries rendered per list; use the filter box to find the rest.
+const MAX_SHOWN = 1000;
+const TOKEN_KEY = 'pac-server-admin-token';
+
+const state = { lists: {} };
+
+function endpoint(path) {
+  // The page is served under /ui/, the API from the server root.
+  return new URL('../' + path, window.location.href).toString();
+}
+
+async function api(method, path, body) {
+  const headers = {};
+  const token = localStorage.getItem(TOKEN_KEY);
+  if (token) {
+    headers['Authorization'] = 'Bearer ' + token;
+  }
+  if (body !== undefined) {
+    headers['Content-Type'] = 'application/json';
+  }
+  const resp = await fetch(endpoint(path), {
+    method: method,
+    headers: headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const data = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    throw new Error(data.error || resp.status + ' ' + resp.statusText);
+  }
+  return data;
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function showMessage(text, isError) {
+  const box = document.getElementById('message');
+  box.textContent = text;
+  box.className = isError ? 'message error' : 'message';
+  box.hidden = !text;
+}
+
+function splitEntries(text) {
+  return text.split(/[\s,]+/).map((s) => s.trim()).filter((s) => s !== '');
+}
+
+async function loadInfo() {
+  try {
+    const info = await api('GET', 'info');
+    const parts = ['version ' + info.version];
+    if (info.build_date) {
+      parts.push('built ' + info.build_date);
+    }
+    if (info.etag) {
+      parts.push('ETag ' + info.etag);
+    }
+    document.getElementById('server-info').textContent = parts.join(' · ');
+  } catch (err) {
+    document.getElementById('server-info').textContent = 'info unavailable: ' + err.message;
+  }
+}
+
+function renderList(container) {
+  const name = container.dataset.list;
+  const data = state.lists[name];
+  const ul = container.querySelector('ul');
+  ul.replaceChildren();
+  if (!data) {
+    return;
+  }
+
+  container.querySelector('.count').textContent = '(' + data.count + ')';
+  container.querySelector('.path').textContent = data.path;
+
+  const filter = container.querySelector('.filter').value.trim().toLowerCase();
+  const matches = data.domains.filter((d) => filter === '' || d.includes(filter));
+  const editable = container.dataset.editable === 'true';
+
+  for (const domain of matches.slice(0, MAX_SHOWN)) {
+    const li = el('li');
+    li.appendChild(el('span', domain));
+    if (editable) {
+      const remove = el('button', '✕');
+      remove.title = 'Remove ' + domain;
+      remove.addEventListener('click', () => editList(name, 'DELETE', [domain]));
+      li.appendChild(remove);
+    }
+    ul.appendChild(li);
+  }
+  if (matches.length > MAX_SHOWN) {
+    ul.appendChild(el('li', (matches.length - MAX_SHOWN) + ' more, use the filter', 'muted'));
+  }
+}
+
+async function loadLists() {
+  for (const container of document.querySelectorAll('.list')) {
+    const name = container.dataset.list;
+    try {
+      state.lists[name] = await api('GET', 'api/v1/lists/' + name);
+    } catch (err) {
+      state.lists[name] = null;
+      showMessage('Loading ' + name + ' failed: ' + err.message, true);
+    }
+    renderList(container);
+  }
+}
+
+async function editList(name, method, domains) {
+  try {
+    const data = await api(method, 'api/v1/lists/' + name, { domains: domains });
+    state.lists[name] = data;
+    renderList(document.querySelector('.list[data-list="' + name + '"]'));
+    showMessage((method === 'DELETE' ? 'Removed ' : 'Added ') + domains.join(', ') + (method === 'DELETE' ? ' from ' : ' to ') + name + '.', false);
+    await Promise.all([loadInfo(), loadReloads()]);
+    return true;
+  } catch (err) {
+    showMessage(err.message, true);
+    return false;
+  }
+}
+
+async function loadReloads() {
+  const tbody = document.querySelector('#reloads tbody');
+  try {
+    const data = await api('GET', 'api/v1/reloads');
+    tbody.replaceChildren();
+    for (const ev of data.reloads) {
+      const tr = el('tr');
+      tr.appendChild(el('td', new Date(ev.time).toLocaleString()));
+      if (ev.error) {
+        const td = el('td', ev.error, 'error');
+        td.colSpan = 7;
+        tr.appendChild(td);
+      } else {
+        tr.appendChild(el('td', ev.etag));
+        tr.appendChild(el('td', String(ev.noproxy)));
+        tr.appendChild(el('td', String(ev.domains)));
+        tr.appendChild(el('td', String(ev.gfwlist)));
+        tr.appendChild(el('td', String(ev.pruned)));
+        tr.appendChild(el('td', (ev.bytes / 1024).toFixed(1) + ' KiB'));
+        tr.appendChild(el('td', ev.duration_ms.toFixed(1) + ' ms'));
+      }
+      tbody.appendChild(tr);
+    }
+  } catch (err) {
+    tbody.replaceChildren();
+    const tr = el('tr');
+    const td = el('td', 'Loading reload history failed: ' + err.message, 'error');
+    td.colSpan = 8;
+    tr.appendChild(td);
+    tbody.appendChild(tr);
+  }
+}
+
+function describeMatch(m) {
+  return m.rule + ' in ' + m.list + ' (' + m.source + ':' + m.line + ')';
+}
+
+async function testURL(url) {
+  const box = document.getElementById('test-result');
+  box.hidden = false;
+  box.replaceChildren();
+  try {
+    const r = await api('GET', 'api/v1/explain?url=' + encodeURIComponent(url));
+    const reason = r.match ? 'matched ' + describeMatch(r.match) : 'no rule matched';
+    box.appendChild(el('div', r.host + ' → ' + r.result + ' (' + reason + ')'));
+    if (r.custom_js) {
+      box.appendChild(el('div', 'custom JavaScript ' + r.custom_js));
+    }
+    for (const m of r.shadowed) {
+      box.appendChild(el('div', 'shadowed: ' + describeMatch(m) + ' → ' + m.result, 'muted'));
+    }
+    box.className = 'result';
+  } catch (err) {
+    box.textContent = err.message;
+    box.className = 'result error';
+  }
+}
+
+function init() {
+  const tokenInput = document.getElementById('token');
+  tokenInput.value = localStorage.getItem(TOKEN_KEY) || '';
+  document.getElementById('token-form').addEventListener('submit', (e) => {
+    e.preventDefault();
+    if (tokenInput.value) {
+      localStorage.setItem(TOKEN_KEY, tokenInput.value);
+    } else {
+      localStorage.removeItem(TOKEN_KEY);
+    }
+    showMessage('', false);
+    loadLists();
+    loadReloads();
+  });
+
+  document.getElementById('test-form').addEventListener('submit', (e) => {
+    e.preventDefault();
+    testURL(document.getElementById('test-url').value.trim());
+  });
+
+  for (const container of document.querySelectorAll('.list')) {
+    container.querySelector('.filter').addEventListener('input', () => renderList(container));
+    const add = container.querySelector('form.add');
+    if (add) {
+      add.addEventListener('submit', (e) => {
+        e.preventDefault();
+        const input = add.querySelector('input');
+        const domains = splitEntries(input.value);
+        if (domains.length > 0) {
+          editList(container.dataset.list, 'POST', domains).then((ok) => {
+            if (ok) {
+              input.value = '';
+            }
+          });
+        }
+      });
+    }
+  }
+
+  loadInfo();
+  loadLists();
+  loadReloads();
+}
+
+init();
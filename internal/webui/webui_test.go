@@ -0,0 +1,30 @@
+package webui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServesPage(t *testing.T) {
+	h := http.StripPrefix("/ui", Handler())
+
+	for path, want := range map[string]string{
+		"/ui/":          "<title>pac-server</title>",
+		"/ui/app.js":    "api/v1/lists/",
+		"/ui/style.css": ".lists",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("%s: body missing %q", path, want)
+		}
+		if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+			t.Fatalf("%s: unexpected Content-Security-Policy %q", path, csp)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// lintIssue is one finding in a list file.
+type lintIssue struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (i lintIssue) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, i.Severity, i.Message)
+}
+
+// lintLine is one line of a list file as the parser reads it.
+type lintLine struct {
+	text    string
+	domains []string
+	comment bool
+
+	// problem explains why the line is not honored as written.
+	problem  string
+	severity string
+}
+
+// classifyLine checks that every token on a line is honored by the parser
+// exactly as written.
+func classifyLine(text string) lintLine {
+	trimmed := strings.TrimSpace(text)
+	l := lintLine{text: text}
+	for _, e := range pacgen.ParseDomainEntries(trimmed) {
+		l.domains = append(l.domains, e.Domain)
+	}
+
+	switch {
+	case trimmed == "" || strings.HasPrefix(trimmed, "!") || strings.HasPrefix(trimmed, "["):
+		l.comment = true
+	case strings.HasPrefix(trimmed, "#"):
+		if len(l.domains) == 0 {
+			l.comment = true
+			break
+		}
+		l.severity = severityError
+		l.problem = fmt.Sprintf("# does not start a comment, this line adds %s; use ! instead", strings.Join(l.domains, ", "))
+	case strings.HasPrefix(trimmed, "@@"):
+		l.severity = severityWarning
+		l.problem = "exception rules (@@) are not supported, line ignored"
+	case strings.HasPrefix(trimmed, "/") && strings.HasSuffix(trimmed, "/"):
+		l.severity = severityWarning
+		l.problem = "regular expression rules are not supported, line ignored"
+	case len(l.domains) == 0:
+		l.severity = severityError
+		l.problem = fmt.Sprintf("%q is not a valid domain, line ignored", trimmed)
+	default:
+		for _, tok := range strings.Fields(trimmed) {
+			domains := pacgen.ParseDomains(tok)
+			if len(domains) == 0 {
+				l.severity = severityError
+				l.problem = fmt.Sprintf("%q is not a valid domain and is ignored", tok)
+				break
+			}
+			if _, err := parseListEntry(tok); err == nil {
+				continue
+			}
+			if !embedsDomains(strings.ToLower(tok), domains) {
+				l.severity = severityError
+				l.problem = fmt.Sprintf("%q is read as %s", tok, strings.Join(domains, ", "))
+				break
+			}
+		}
+	}
+	return l
+}
+
+// embedsDomains reports whether every domain appears in tok as a whole
+// name, as in "||example.com^" or "*.example.com", rather than as the tail
+// of a longer invalid name such as "my_host.example.com".
+func embedsDomains(tok string, domains []string) bool {
+	for _, d := range domains {
+		i := strings.Index(tok, d)
+		if i < 0 {
+			return false
+		}
+		if i > 0 && !strings.ContainsRune("|/.@", rune(tok[i-1])) {
+			return false
+		}
+		if rest := tok[i+len(d):]; rest != "" && !strings.ContainsRune("/:^|.", rune(rest[0])) {
+			return false
+		}
+	}
+	return true
+}
+
+// lintContext holds the other lists a proxy list is checked against.
+type lintContext struct {
+	noproxyPath  string
+	noproxy      *pacgen.Matcher
+	noproxyLines map[string]int
+	sources      *pacgen.Matcher
+}
+
+// lintFile reports problems in the lines of a list file. ctx is nil for the
+// noproxy list itself.
+func lintFile(path string, lines []string, ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+	report := func(line int, severity, format string, args ...any) {
+		issues = append(issues, lintIssue{File: path, Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var all []string
+	first := make(map[string]int)
+	parsed := make([]lintLine, len(lines))
+	for i, text := range lines {
+		parsed[i] = classifyLine(text)
+		for _, d := range parsed[i].domains {
+			if _, ok := first[d]; !ok {
+				first[d] = i + 1
+				all = append(all, d)
+			}
+		}
+	}
+	own := pacgen.NewMatcher(nil, nil, all, "")
+
+	for i, l := range parsed {
+		lineNo := i + 1
+		if l.problem != "" {
+			report(lineNo, l.severity, "%s", l.problem)
+		}
+		for _, d := range l.domains {
+			entry := canonicalEntry(d)
+			if first[d] != lineNo {
+				report(lineNo, severityWarning, "%s duplicates line %d", entry, first[d])
+				continue
+			}
+			if parent, ok := coveringParent(own, d); ok {
+				report(lineNo, severityWarning, "%s is covered by %s on line %d", entry, canonicalEntry(parent), first[parent])
+			}
+			if ctx == nil {
+				continue
+			}
+			if m, ok := ctx.noproxy.Match(d); ok {
+				report(lineNo, severityError, "%s always goes DIRECT because of %s (%s:%d)", entry, canonicalEntry(m.Domain), ctx.noproxyPath, ctx.noproxyLines[m.Domain])
+			} else if m, ok := ctx.sources.Match(d); ok && m.Result != "DIRECT" {
+				report(lineNo, severityInfo, "%s is already proxied by %s entry %s", entry, m.List, canonicalEntry(m.Domain))
+			}
+		}
+	}
+	return issues
+}
+
+// coveringParent returns the closest proper parent of d matched by m.
+func coveringParent(m *pacgen.Matcher, d string) (string, bool) {
+	i := strings.IndexByte(d, '.')
+	if i < 0 {
+		return "", false
+	}
+	match, ok := m.Match(d[i+1:])
+	return match.Domain, ok
+}
+
+// fixLines rewrites a list in canonical form: comment lines, blank lines
+// and lines with problems stay where they are, and each run of entries
+// between them is sorted in place, so section comments keep their
+// entries. Entries that duplicate an earlier one or are covered by a
+// parent anywhere in the list are dropped.
+func fixLines(lines []string) []string {
+	parsed := make([]lintLine, len(lines))
+	var all []string
+	for i, text := range lines {
+		parsed[i] = classifyLine(text)
+		all = append(all, parsed[i].domains...)
+	}
+	covering := pacgen.NewMatcher(nil, nil, all, "")
+
+	seen := make(map[string]bool)
+	for _, l := range parsed {
+		if l.comment || l.problem != "" {
+			for _, d := range l.domains {
+				seen[d] = true
+			}
+		}
+	}
+
+	var out, block []string
+	flush := func() {
+		sort.Strings(block)
+		out = append(out, block...)
+		block = nil
+	}
+	for _, l := range parsed {
+		if l.comment || l.problem != "" {
+			flush()
+			out = append(out, l.text)
+			continue
+		}
+		for _, d := range l.domains {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			if _, covered := coveringParent(covering, d); !covered {
+				block = append(block, canonicalEntry(d))
+			}
+		}
+	}
+	flush()
+	for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+func readLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	s := bufio.NewScanner(strings.NewReader(string(content)))
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
+
+// lint lints the noproxy and domains files of the service, optionally
+// fixing them first. Missing files are skipped. Entries of the domains file
+// are checked against the sources in order: only one whose first match is
+// a source bound to a proxy is reported as already proxied.
+func (s *pacService) lint(fix bool) ([]lintIssue, error) {
+	var issues []lintIssue
+	lint := func(path string, ctx *lintContext) ([]string, error) {
+		lines, err := readLines(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		if fix {
+			if err := editListFile(path, fixLines); err != nil {
+				return nil, err
+			}
+			if lines, err = readLines(path); err != nil {
+				return nil, fmt.Errorf("read %s: %w", path, err)
+			}
+		}
+		issues = append(issues, lintFile(path, lines, ctx)...)
+		return lines, nil
+	}
+
+	noproxyLines, err := lint(s.noproxy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &lintContext{noproxyPath: s.noproxy, noproxyLines: make(map[string]int)}
+	var noproxyDomains []string
+	for i, text := range noproxyLines {
+		for _, d := range classifyLine(text).domains {
+			if _, ok := ctx.noproxyLines[d]; !ok {
+				ctx.noproxyLines[d] = i + 1
+				noproxyDomains = append(noproxyDomains, d)
+			}
+		}
+	}
+	ctx.noproxy = pacgen.NewMatcher(nil, nil, noproxyDomains, "")
+	lists, err := s.loadLists()
+	if err != nil {
+		return nil, err
+	}
+	ctx.sources = pacgen.NewSourceMatcher(nil, nil, lists.PACSources(), s.proxy)
+
+	if _, err := lint(s.domains, ctx); err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
+// runLint implements `pac-server lint [-fix] [flags]`.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fix := fs.Bool("fix", false, "Rewrite the lists in canonical form: entries are sorted within each section between comments, dropping duplicates and entries covered by a parent. Comments and lines with errors stay in place.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: pac-server lint [-fix] [flags]")
+		return 2
+	}
+
+	service, err := flagService()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	service.fetchSources()
+	issues, err := service.lint(*fix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return printLintIssues(os.Stdout, issues)
+}
+
+// printLintIssues writes issues and returns the exit status: 1 when any
+// issue is an error.
+func printLintIssues(w io.Writer, issues []lintIssue) int {
+	counts := make(map[string]int)
+	for _, i := range issues {
+		fmt.Fprintln(w, i)
+		counts[i.Severity]++
+	}
+	if len(issues) > 0 {
+		fmt.Fprintf(w, "%d errors, %d warnings, %d info\n", counts[severityError], counts[severityWarning], counts[severityInfo])
+	}
+	if counts[severityError] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,27 +1,65 @@
 package main
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gsmlg-ci/pac-server/internal/pac"
 	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/rotate"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+	"github.com/gsmlg-ci/pac-server/internal/webui"
 )
 
 var (
 	host        string
 	proxyServer string
+	pacLayout   string
+	pacTemplate string
+	customJS    string
+	customJSPos string
+	publicURL   string
+	minifyPAC   bool
+	maxPACSize  int
 	printHosts  bool
+	verbose     bool
 	gfwlistPath string
+	gfwlistFmt  string
+	sourcesPath string
 	domainsPath string
 	noproxyPath string
+
+	shutdownTimeout time.Duration
+	handoff         bool
+	gfwlistMaxAge   time.Duration
+
+	logFormat          string
+	logLevel           string
+	accessLogPath      string
+	accessLogMaxSize   int
+	accessLogMaxBackup int
+
+	clientsPath      string
+	clientsRetention time.Duration
+
+	adminToken    string
+	adminClientCA string
+	tlsCert       string
+	tlsKey        string
 )
 
 const defaultGFWListPath = "gfwlist.txt"
@@ -32,90 +70,308 @@ const defaultNoproxyPath = "noproxy.txt"
 var embeddedGFWList []byte
 
 func init() {
+	sources.EmbeddedGFWList = embeddedGFWList
+
 	flag.StringVar(&host, "h", ":1080", "Set pac server listen address, default is ':1080'.")
 	flag.StringVar(&proxyServer, "s", "PROXY 127.0.0.1:3128", "Set proxy server address, default is 'PROXY 127.0.0.1:3128'.")
+	flag.StringVar(&pacLayout, "pac-layout", string(pacgen.LayoutList), "How the PAC stores domain lists: list (arrays) or trie (nested objects by label, much smaller for large lists).")
+	flag.StringVar(&pacTemplate, "pac-template", "", "Render the PAC with this text/template file instead of the built-in template. Reloaded when it changes.")
+	flag.StringVar(&customJS, "custom-js", "", "Run the JavaScript in this file inside FindProxyForURL, where url, host and the lowercased host h are in scope; a return decides the result. Syntax-checked, and reloaded when it changes.")
+	flag.StringVar(&customJSPos, "custom-js-position", string(pacgen.HookBefore), "Where -custom-js runs: before the domain lists are checked, or after none matched.")
+	flag.StringVar(&publicURL, "pac-url", "", "PAC URL the browser and OS policy exports under /rules/ point at. Defaults to /proxy.pac on the host of the request.")
+	flag.BoolVar(&minifyPAC, "minify", false, "Strip white space from the PAC and shorten its internal names.")
+	flag.IntVar(&maxPACSize, "max-pac-size", 0, "Fail generation and keep serving the previous PAC when the PAC exceeds this many kilobytes. 0 disables the limit.")
 	flag.BoolVar(&printHosts, "p", false, "Print parsed hosts and exit.")
+	flag.BoolVar(&verbose, "v", false, "With -p, also print the source lines the parser ignored, and why, to stderr.")
 	flag.StringVar(&gfwlistPath, "g", defaultGFWListPath, "Path to gfwlist.txt (base64 or plain text). If missing and default path is used, embedded gfwlist is used.")
+	flag.StringVar(&gfwlistFmt, "g-format", string(pacgen.FormatAuto), "Format of -g: auto (gfwlist, base64 or not), gfwlist, plain, hosts, clash, surge, dnsmasq or v2fly.")
+	flag.StringVar(&sourcesPath, "sources", "", "JSON file listing the proxied sources in order, each a path, url or the embedded gfwlist with its format, refresh, enabled flag and proxy. Replaces -g.")
 	flag.StringVar(&domainsPath, "d", defaultDomainsPath, "Path to extra domains file (one domain per line). Skipped if file does not exist.")
 	flag.StringVar(&noproxyPath, "n", defaultNoproxyPath, "Path to noproxy domains file (one domain per line). Matched domains always go DIRECT. Skipped if file does not exist.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "Time to wait for in-flight requests to finish on SIGINT/SIGTERM.")
+	flag.DurationVar(&gfwlistMaxAge, "gfwlist-max-age", 0, "Report not ready on /readyz when the gfwlist file is older than this. 0 disables the check.")
+	flag.BoolVar(&handoff, "handoff", false, "On SIGUSR2, re-exec the binary and hand it the listening socket before draining (unix only).")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format: text or json.")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum log level: debug, info, warn or error. Probe and metrics requests are logged at debug.")
+	flag.StringVar(&accessLogPath, "access-log", "", "Write access logs to this file instead of stderr. Rotated by size.")
+	flag.IntVar(&accessLogMaxSize, "access-log-max-size", 100, "Rotate the access log file after this many megabytes. 0 disables rotation.")
+	flag.IntVar(&accessLogMaxBackup, "access-log-max-backups", 5, "Number of rotated access log files to keep.")
+	flag.StringVar(&clientsPath, "clients-file", "", "Persist the client inventory to this JSON file. Kept in memory only when empty.")
+	flag.DurationVar(&clientsRetention, "clients-retention", 30*24*time.Hour, "Forget clients that have not fetched the PAC for this long. 0 keeps them forever.")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("PAC_SERVER_ADMIN_TOKEN"), "Bearer token for the /api/v1 admin API. Defaults to $PAC_SERVER_ADMIN_TOKEN.")
+	flag.StringVar(&adminClientCA, "admin-client-ca", "", "PEM CA bundle; TLS clients presenting a certificate signed by it may use the admin API. Requires -tls-cert.")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve over HTTPS using this PEM certificate (requires -tls-key).")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key for -tls-cert.")
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n")
+		fmt.Fprintf(out, "  pac-server [flags]                 serve the PAC\n")
+		fmt.Fprintf(out, "  pac-server explain [flags] URL...  show which rule decides the proxy for URL\n")
+		fmt.Fprintf(out, "  pac-server lint [-fix] [flags]     check domains and noproxy files for problems\n\n")
+		fmt.Fprintf(out, "Flags:\n")
+		flag.PrintDefaults()
+	}
 }
 
 type pacService struct {
 	proxy   string
-	gfwlist string
+	layout  pacgen.Layout
+	minify  bool
+	maxSize int // bytes, 0 for no limit
+	// template is a PAC template file replacing the built-in one for
+	// layout, reloaded when it changes.
+	template string
+	// customJS is a JavaScript file run inside FindProxyForURL at
+	// customJSPos, reloaded when it changes.
+	customJS    string
+	customJSPos pacgen.HookPosition
+	// pacURL is the public PAC URL for policy exports, empty to derive it
+	// from the request.
+	pacURL string
+	// sources are the proxied lists in order, from -sources or else the
+	// -g file.
+	sources []*sources.Source
 	domains string
 	noproxy string
+	maxAge  time.Duration
+	clients *clientInventory
+	admin   adminAuth
+	adminMu sync.Mutex
 	mu      sync.RWMutex
 	cached  *cachedPAC
+	lastErr error
+	// failedKey is the cache key of sources whose PAC failed to generate,
+	// with its error, so requests do not regenerate it until they change.
+	failedKey string
+	failedErr error
+	reloads   []reloadEvent
 }
 
+// cachedPAC is an immutable snapshot of a generated PAC together with the
+// inputs it was built from. It is replaced, never modified, on reload.
 type cachedPAC struct {
-	key  string
-	body []byte
+	key       string
+	body      []byte
+	etag      string
+	generated time.Time
+	duration  time.Duration
+	noproxy   []string
+	custom    []string
+	gfwlist   []string // all sources
+	sources   []pacgen.Source
+	// sourceDomains counts the domains of each loaded source by name.
+	sourceDomains map[string]int
+	pruned        pacgen.PruneStats
+	reports       []parseReport
+}
+
+// parseReport lists the lines of one source that contributed no domain.
+type parseReport struct {
+	list        string
+	source      string
+	diagnostics []pacgen.Diagnostic
 }
 
 func (s *pacService) loadPAC() ([]byte, error) {
+	snap, err := s.snapshot()
+	if snap == nil {
+		return nil, err
+	}
+	return append([]byte(nil), snap.body...), nil
+}
+
+// snapshot returns the current PAC snapshot, regenerating it when any of the
+// source files changed since it was built. When the PAC of the current
+// sources failed to generate, it returns that error together with the
+// previous snapshot, if any, which stays in service.
+func (s *pacService) snapshot() (*cachedPAC, error) {
 	key, err := s.cacheKey()
 	if err != nil {
+		s.setLastErr(err)
 		return nil, err
 	}
 
 	s.mu.RLock()
-	if s.cached != nil && s.cached.key == key {
-		body := append([]byte(nil), s.cached.body...)
-		s.mu.RUnlock()
-		return body, nil
-	}
+	cached, failedKey, failedErr := s.cached, s.failedKey, s.failedErr
 	s.mu.RUnlock()
+	if cached != nil && cached.key == key {
+		return cached, nil
+	}
+	if failedKey == key {
+		return cached, failedErr
+	}
+
+	return s.reload(key)
+}
 
-	noproxyDomains, err := s.loadDomainsFile(s.noproxy)
+// reload regenerates the PAC from the sources and stores it as the current
+// snapshot. A PAC that fails to generate, whether it is over the size
+// budget or a template or custom JavaScript is broken, is rejected; the
+// previous one, if any, is returned with the error and stays in service
+// until the sources change again.
+func (s *pacService) reload(key string) (*cachedPAC, error) {
+	snap, err := s.generate(key)
+	s.setLastErr(err)
+	recordReload(snap, err)
+	s.recordReloadEvent(snap, err)
 	if err != nil {
-		return nil, err
+		s.mu.Lock()
+		prev := s.cached
+		s.failedKey, s.failedErr = key, err
+		s.mu.Unlock()
+		if prev == nil {
+			slog.Error("PAC generation failed", "err", err)
+			return nil, err
+		}
+		slog.Warn("keeping previous PAC", "err", err, "etag", prev.etag)
+		return prev, err
 	}
-	customDomains, err := s.loadDomainsFile(s.domains)
+
+	s.mu.Lock()
+	s.cached = snap
+	s.failedKey, s.failedErr = "", nil
+	s.mu.Unlock()
+
+	logParseReports(snap.reports)
+	return snap, nil
+}
+
+// logParseReports logs how many lines each source lost to the parser, and
+// every such line at debug level.
+func logParseReports(reports []parseReport) {
+	for _, r := range reports {
+		if len(r.diagnostics) == 0 {
+			continue
+		}
+		slog.Info("source lines ignored", "list", r.list, "source", r.source,
+			"lines", len(r.diagnostics), "reasons", formatReasonCounts(r.diagnostics))
+		for _, d := range r.diagnostics {
+			slog.Debug("source line ignored", "list", r.list, "source", r.source,
+				"line", d.Line, "reason", string(d.Reason), "text", d.Raw)
+		}
+	}
+}
+
+func reasonCounts(diags []pacgen.Diagnostic) map[pacgen.Reason]int {
+	counts := make(map[pacgen.Reason]int)
+	for _, d := range diags {
+		counts[d.Reason]++
+	}
+	return counts
+}
+
+// formatReasonCounts summarizes diagnostics as "regex=1, wildcard=2".
+func formatReasonCounts(diags []pacgen.Diagnostic) string {
+	var parts []string
+	for reason, n := range reasonCounts(diags) {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func (s *pacService) generate(key string) (*cachedPAC, error) {
+	start := time.Now()
+
+	lists, err := s.loadLists()
 	if err != nil {
 		return nil, err
 	}
-	gfwDomains, err := s.loadDomains()
+	sourceDomains := make(map[string]int, len(lists.Sources))
+	reports := []parseReport{
+		{list: "noproxy", source: s.noproxy, diagnostics: lists.NoProxyDiags},
+		{list: "domains", source: s.domains, diagnostics: lists.CustomDiags},
+	}
+	for _, l := range lists.Sources {
+		sourceDomains[l.Source.Name] = len(l.Domains())
+		reports = append(reports, parseReport{list: l.Source.Name, source: l.Name, diagnostics: l.Diagnostics})
+	}
+
+	var tmpl *pac.Template
+	if s.template != "" {
+		if tmpl, err = pac.ParseTemplateFile(s.template); err != nil {
+			return nil, err
+		}
+	}
+
+	var js string
+	if s.customJS != "" {
+		if js, err = readCustomJS(s.customJS); err != nil {
+			return nil, err
+		}
+	}
+
+	body, pruned, err := lists.Generate(pacgen.Options{
+		Proxy:            s.proxy,
+		Layout:           s.layout,
+		Template:         tmpl,
+		Minify:           s.minify,
+		MaxSize:          s.maxSize,
+		CustomJS:         js,
+		CustomJSPosition: s.customJSPos,
+	})
 	if err != nil {
 		return nil, err
 	}
+	pac := []byte(body)
+	sum := sha256.Sum256(pac)
+
+	return &cachedPAC{
+		key:           key,
+		body:          pac,
+		etag:          fmt.Sprintf("%q", hex.EncodeToString(sum[:16])),
+		generated:     time.Now(),
+		duration:      time.Since(start),
+		noproxy:       lists.NoProxy,
+		custom:        lists.Custom,
+		gfwlist:       lists.Domains(),
+		sources:       lists.PACSources(),
+		sourceDomains: sourceDomains,
+		pruned:        pruned,
+		reports:       reports,
+	}, nil
+}
 
-	pac := []byte(pacgen.GeneratePAC(noproxyDomains, customDomains, gfwDomains, s.proxy))
+// readCustomJS reads and syntax-checks a -custom-js file.
+func readCustomJS(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read custom JavaScript: %w", err)
+	}
+	if err := pacgen.CheckCustomJS(string(content)); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return string(content), nil
+}
 
+func (s *pacService) setLastErr(err error) {
 	s.mu.Lock()
-	if s.cached == nil {
-		s.cached = &cachedPAC{}
-	}
-	s.cached.key = key
-	s.cached.body = append([]byte(nil), pac...)
+	s.lastErr = err
 	s.mu.Unlock()
-
-	return pac, nil
 }
 
+// loadDomains returns the domains of all enabled sources.
 func (s *pacService) loadDomains() ([]string, error) {
-	return parseDomainsFromFile(s.gfwlist, true)
-}
-
-func (s *pacService) loadDomainsFile(path string) ([]string, error) {
-	content, err := os.ReadFile(path)
+	lists, err := s.loadLists()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("read %s: %w", path, err)
+		return nil, err
 	}
-	return pacgen.ParseDomains(string(content)), nil
+	return lists.Domains(), nil
 }
 
 func (s *pacService) cacheKey() (string, error) {
-	gfwKey, err := sourceCacheKey(s.gfwlist, true)
-	if err != nil {
-		return "", err
+	var gfwKeys []string
+	for _, src := range s.enabledSources() {
+		k, err := src.CacheKey()
+		if err != nil {
+			return "", err
+		}
+		gfwKeys = append(gfwKeys, k)
 	}
+	gfwKey := strings.Join(gfwKeys, ",")
 
-	domainsKey, err := sourceCacheKey(s.domains, false)
+	domainsKey, err := sourceCacheKey(s.domains)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			domainsKey = ""
@@ -124,7 +380,7 @@ func (s *pacService) cacheKey() (string, error) {
 		}
 	}
 
-	noproxyKey, err := sourceCacheKey(s.noproxy, false)
+	noproxyKey, err := sourceCacheKey(s.noproxy)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			noproxyKey = ""
@@ -133,68 +389,85 @@ func (s *pacService) cacheKey() (string, error) {
 		}
 	}
 
-	return fmt.Sprintf("%s|%s|%s", gfwKey, domainsKey, noproxyKey), nil
+	key := fmt.Sprintf("%s|%s|%s", gfwKey, domainsKey, noproxyKey)
+	if s.template != "" {
+		templateKey, err := sourceCacheKey(s.template)
+		if err != nil {
+			return "", err
+		}
+		key += "|" + templateKey
+	}
+	if s.customJS != "" {
+		customJSKey, err := sourceCacheKey(s.customJS)
+		if err != nil {
+			return "", err
+		}
+		key += "|js:" + customJSKey
+	}
+	return key, nil
 }
 
-func sourceCacheKey(path string, allowEmbeddedFallback bool) (string, error) {
+func sourceCacheKey(path string) (string, error) {
 	stat, err := os.Stat(path)
 	if err != nil {
-		if allowEmbeddedFallback && errors.Is(err, os.ErrNotExist) && path == defaultGFWListPath {
-			return fmt.Sprintf("g:embedded:%d", len(embeddedGFWList)), nil
-		}
 		return "", err
 	}
 
 	return fmt.Sprintf("f:%s:%d:%d", path, stat.ModTime().UnixNano(), stat.Size()), nil
 }
 
-func parseDomainsFromFile(path string, allowEmbeddedFallback bool) ([]string, error) {
-	content, err := os.ReadFile(path)
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
 	if err != nil {
-		if allowEmbeddedFallback && errors.Is(err, os.ErrNotExist) && path == defaultGFWListPath {
-			content = embeddedGFWList
-		} else {
-			return nil, fmt.Errorf("read %s: %w", path, err)
-		}
+		return err
 	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
 
-	raw, err := pacgen.DecodeMaybeBase64(content)
-	if err != nil {
-		return nil, fmt.Errorf("decode %s: %w", path, err)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
 	}
-
-	return pacgen.ParseDomains(string(raw)), nil
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
 }
 
 func (s *pacService) showHosts() error {
-	if noproxyDomains, err := s.loadDomainsFile(s.noproxy); err != nil {
+	lists, err := s.loadLists()
+	if err != nil {
 		return err
-	} else if len(noproxyDomains) > 0 {
-		sort.Strings(noproxyDomains)
+	}
+	if len(lists.NoProxy) > 0 {
 		fmt.Println("# noproxy (DIRECT):")
-		for _, h := range noproxyDomains {
+		for _, h := range lists.NoProxy {
 			fmt.Println(h)
 		}
 		fmt.Println()
 	}
 
-	var domains []string
-
-	if customDomains, err := s.loadDomainsFile(s.domains); err != nil {
-		return err
-	} else if len(customDomains) > 0 {
-		domains = append(domains, customDomains...)
+	all := append(lists.Custom, lists.Domains()...)
+	reports := []parseReport{
+		{list: "noproxy", source: s.noproxy, diagnostics: lists.NoProxyDiags},
+		{list: "domains", source: s.domains, diagnostics: lists.CustomDiags},
 	}
-
-	if gfwDomains, err := s.loadDomains(); err != nil {
-		return err
-	} else {
-		domains = append(domains, gfwDomains...)
+	for _, l := range lists.Sources {
+		reports = append(reports, parseReport{list: l.Source.Name, source: l.Name, diagnostics: l.Diagnostics})
 	}
 
 	seen := make(map[string]bool)
 	var unique []string
-	for _, d := range domains {
+	for _, d := range all {
 		if !seen[d] {
 			seen[d] = true
 			unique = append(unique, d)
@@ -206,31 +479,79 @@ func (s *pacService) showHosts() error {
 	for _, h := range unique {
 		fmt.Println(h)
 	}
+
+	if verbose {
+		printDiagnostics(os.Stderr, reports)
+	}
 	return nil
 }
 
-func (s *pacService) handler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("request from %s", r.RemoteAddr)
+// printDiagnostics writes one line per ignored source line and a summary
+// per source.
+func printDiagnostics(w io.Writer, reports []parseReport) {
+	for _, r := range reports {
+		for _, d := range r.diagnostics {
+			fmt.Fprintf(w, "%s:%d: %s: %s\n", r.source, d.Line, d.Reason, d.Raw)
+		}
+		if len(r.diagnostics) > 0 {
+			fmt.Fprintf(w, "%s: %d lines ignored (%s)\n", r.source, len(r.diagnostics), formatReasonCounts(r.diagnostics))
+		}
+	}
+}
 
-	pac, err := s.loadPAC()
-	if err != nil {
+func (s *pacService) handler(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.snapshot()
+	if snap == nil {
 		http.Error(w, fmt.Sprintf("failed to generate PAC: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	setProfile(r, defaultProfile)
+	if s.clients != nil {
+		s.clients.record(clientIP(r), r.UserAgent(), snap.etag, time.Now())
+	}
+	w.Header().Set("ETag", snap.etag)
+	if etagMatch(r.Header.Get("If-None-Match"), snap.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(pac)))
-	_, _ = w.Write(pac)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(snap.body)))
+	_, _ = w.Write(snap.body)
 }
 
-func (s *pacService) watchDomains(done <-chan struct{}) {
-	prevDomainsMod := int64(-1)
-	if st, err := os.Stat(s.domains); err == nil {
-		prevDomainsMod = st.ModTime().UnixNano()
+// etagMatch reports whether an If-None-Match header value matches etag.
+func etagMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
 	}
-	prevNoproxyMod := int64(-1)
-	if st, err := os.Stat(s.noproxy); err == nil {
-		prevNoproxyMod = st.ModTime().UnixNano()
+	return false
+}
+
+// watchedFiles are the local files watchDomains polls for changes.
+func (s *pacService) watchedFiles() []string {
+	files := []string{s.domains, s.noproxy}
+	if s.template != "" {
+		files = append(files, s.template)
+	}
+	if s.customJS != "" {
+		files = append(files, s.customJS)
+	}
+	return files
+}
+
+func (s *pacService) watchDomains(done <-chan struct{}) {
+	files := s.watchedFiles()
+	prevMod := make([]int64, len(files))
+	for i, path := range files {
+		prevMod[i] = -1
+		if st, err := os.Stat(path); err == nil {
+			prevMod[i] = st.ModTime().UnixNano()
+		}
 	}
 
 	ticker := time.NewTicker(2 * time.Second)
@@ -243,34 +564,76 @@ func (s *pacService) watchDomains(done <-chan struct{}) {
 		case <-ticker.C:
 			changed := false
 
-			if st, err := os.Stat(s.domains); err == nil {
-				if mod := st.ModTime().UnixNano(); mod != prevDomainsMod {
-					prevDomainsMod = mod
-					changed = true
-					log.Printf("domains.txt changed, cache invalidated")
-				}
-			}
-
-			if st, err := os.Stat(s.noproxy); err == nil {
-				if mod := st.ModTime().UnixNano(); mod != prevNoproxyMod {
-					prevNoproxyMod = mod
-					changed = true
-					log.Printf("noproxy.txt changed, cache invalidated")
+			for i, path := range files {
+				if st, err := os.Stat(path); err == nil {
+					if mod := st.ModTime().UnixNano(); mod != prevMod[i] {
+						prevMod[i] = mod
+						changed = true
+						log.Printf("%s changed, cache invalidated", filepath.Base(path))
+					}
 				}
 			}
 
 			if changed {
-				s.mu.Lock()
-				s.cached = nil
-				s.mu.Unlock()
+				if _, err := s.snapshot(); err != nil {
+					log.Printf("reload failed: %v", err)
+				}
 			}
 		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			os.Exit(runExplain(os.Args[2:]))
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
+	level, err := parseLogLevel(logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := newLogger(os.Stderr, logFormat, level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	layout, err := pacgen.ParseLayout(pacLayout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pacTemplate != "" {
+		if _, err := pac.ParseTemplateFile(pacTemplate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	customJSPosition, err := pacgen.ParseHookPosition(customJSPos)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gfwlistFormat, err := pacgen.ParseSourceFormat(gfwlistFmt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if customJS != "" {
+		if _, err := readCustomJS(customJS); err != nil {
+			log.Fatal(err)
+		}
+	}
+	configured := []*sources.Source{gfwlistSource(gfwlistPath, gfwlistFormat)}
+	if sourcesPath != "" {
+		if configured, err = sources.ReadFile(sourcesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	domainsExist := true
 	if _, err := os.Stat(domainsPath); err != nil && errors.Is(err, os.ErrNotExist) {
 		domainsExist = false
@@ -281,12 +644,22 @@ func main() {
 	}
 
 	service := &pacService{
-		proxy:   proxyServer,
-		gfwlist: gfwlistPath,
-		domains: domainsPath,
-		noproxy: noproxyPath,
+		proxy:       proxyServer,
+		layout:      layout,
+		minify:      minifyPAC,
+		maxSize:     maxPACSize << 10,
+		template:    pacTemplate,
+		customJS:    customJS,
+		customJSPos: customJSPosition,
+		pacURL:      publicURL,
+		sources:     configured,
+		domains:     domainsPath,
+		noproxy:     noproxyPath,
+		maxAge:      gfwlistMaxAge,
 	}
 
+	service.fetchSources()
+
 	if printHosts {
 		if err := service.showHosts(); err != nil {
 			log.Fatal(err)
@@ -294,23 +667,89 @@ func main() {
 		os.Exit(0)
 	}
 
+	accessLogger := logger
+	if accessLogPath != "" {
+		f, err := rotate.Open(accessLogPath, int64(accessLogMaxSize)<<20, accessLogMaxBackup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if accessLogger, err = newLogger(f, logFormat, level); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	clients, err := newClientInventory(clientsPath, clientsRetention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.clients = clients
+	service.registerClientMetrics(registry)
+
+	tlsConfig, err := loadTLSConfig(tlsCert, tlsKey, adminClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.admin = adminAuth{token: adminToken, clientCertOK: adminClientCA != ""}
+
+	ln, inherited, err := listen(host)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", service.healthz)
+	mux.HandleFunc("GET /readyz", service.readyz)
+	mux.HandleFunc("GET /info", service.info)
+	mux.Handle("GET /metrics", registry.Handler())
+	mux.HandleFunc("GET /api/v1/clients", service.requireAdmin(service.clientsHandler))
+	mux.HandleFunc("/api/v1/lists/{list}", service.requireAdmin(service.listHandler))
+	mux.HandleFunc("GET /api/v1/reloads", service.requireAdmin(service.reloadsHandler))
+	mux.HandleFunc("GET /api/v1/explain", service.requireAdmin(service.explainHandler))
+	mux.HandleFunc("GET /rules/{file}", service.rulesHandler)
+	mux.Handle("GET /ui/", http.StripPrefix("/ui", webui.Handler()))
+	mux.HandleFunc("/", service.handler)
+
 	s := &http.Server{
 		Addr:           host,
-		Handler:        http.HandlerFunc(service.handler),
+		Handler:        instrument(accessLogger, mux),
+		TLSConfig:      tlsConfig,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	done := make(chan struct{})
-	defer close(done)
+	buildInfo.Set(1, version, buildDateString())
+	if _, err := service.snapshot(); err != nil {
+		log.Printf("initial PAC generation failed: %v", err)
+	}
 
+	done := make(chan struct{})
 	go service.watchDomains(done)
-
-	log.Printf("PAC server start at %s", host)
-	log.Printf("gfwlist source: %s", gfwlistPath)
-	if _, err := os.Stat(gfwlistPath); err != nil && errors.Is(err, os.ErrNotExist) && gfwlistPath == defaultGFWListPath {
-		log.Printf("gfwlist source file not found, using embedded gfwlist")
+	go service.refreshSources(done)
+	clientsDone := make(chan struct{})
+	go func() {
+		clients.run(done, time.Minute)
+		close(clientsDone)
+	}()
+
+	if inherited {
+		log.Printf("PAC server start at %s (listener inherited from parent process)", ln.Addr())
+	} else {
+		log.Printf("PAC server start at %s", ln.Addr())
+	}
+	for _, src := range service.sources {
+		switch {
+		case !src.Enabled:
+			log.Printf("%s source: %s (disabled)", src.Name, src.Location())
+		case src.URL != "":
+			log.Printf("%s source: %s (refreshed every %s)", src.Name, src.Location(), src.Refresh)
+		default:
+			log.Printf("%s source: %s", src.Name, src.Location())
+		}
+		if _, ok := sourceModTime(src.Path); src.Enabled && src.Fallback && !ok {
+			log.Printf("%s source file not found, using embedded gfwlist", src.Name)
+		}
 	}
 	if domainsExist {
 		log.Printf("domains source: %s (auto-reload enabled)", domainsPath)
@@ -323,5 +762,11 @@ func main() {
 		log.Printf("noproxy source: %s (file not found, skipped)", noproxyPath)
 	}
 
-	log.Fatal(s.ListenAndServe())
+	err = serve(s, ln, shutdownTimeout, handoff)
+	close(done)
+	<-clientsDone
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("PAC server stopped")
 }
@@ -1,29 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
-)
 
-func TestSourceCacheKey_EmbeddedFallback(t *testing.T) {
-	// When file doesn't exist and is the default gfwlist path, return embedded key
-	key, err := sourceCacheKey("gfwlist.txt", true)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if key == "" {
-		t.Fatal("expected non-empty key for embedded fallback")
-	}
-	if filepath.Join(key[:7], key[7:]) == "embedded" {
-		// Should contain "embedded" marker
-	}
-}
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+)
 
 func TestSourceCacheKey_NonExistent(t *testing.T) {
 	// When file doesn't exist and not the default gfwlist path, return error
-	_, err := sourceCacheKey("nonexistent.txt", false)
+	_, err := sourceCacheKey("nonexistent.txt")
 	if err == nil {
 		t.Fatal("expected error for non-existent file")
 	}
@@ -44,7 +42,7 @@ func TestSourceCacheKey_FileBased(t *testing.T) {
 	tmpfile.Close()
 
 	// Get initial key
-	key1, err := sourceCacheKey(tmpfile.Name(), false)
+	key1, err := sourceCacheKey(tmpfile.Name())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -56,7 +54,7 @@ func TestSourceCacheKey_FileBased(t *testing.T) {
 	}
 
 	// Get new key
-	key2, err := sourceCacheKey(tmpfile.Name(), false)
+	key2, err := sourceCacheKey(tmpfile.Name())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -82,7 +80,7 @@ func TestCacheKey_MultipleSources(t *testing.T) {
 
 	service := &pacService{
 		proxy:   "PROXY 127.0.0.1:3128",
-		gfwlist: gfwlist.Name(),
+		sources: []*sources.Source{gfwlistSource(gfwlist.Name(), "")},
 		domains: domains.Name(),
 	}
 
@@ -117,7 +115,7 @@ func TestWatchDomains_CacheInvalidation(t *testing.T) {
 
 	service := &pacService{
 		proxy:   "PROXY 127.0.0.1:3128",
-		gfwlist: "gfwlist.txt",
+		sources: []*sources.Source{gfwlistSource("gfwlist.txt", "")},
 		domains: tmpfile.Name(),
 	}
 
@@ -166,18 +164,1040 @@ func TestWatchDomains_CacheInvalidation(t *testing.T) {
 	}
 }
 
-func TestLoadDomainsFile_NotExist(t *testing.T) {
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	ln, inherited, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inherited {
+		t.Fatal("expected a freshly bound listener")
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("done"))
+		}),
+	}
+	go func() { _ = srv.Serve(ln) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		resCh <- result{body: string(b), err: err}
+	}()
+
+	<-started
+	if err := shutdown(srv, 5*time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Fatalf("unexpected body %q", res.body)
+	}
+}
+
+func TestHandler_ETagNotModified(t *testing.T) {
 	service := &pacService{
 		proxy:   "PROXY 127.0.0.1:3128",
-		gfwlist: "gfwlist.txt",
+		sources: []*sources.Source{gfwlistSource("gfwlist.txt", "")},
 		domains: "/nonexistent/domains.txt",
+		noproxy: "/nonexistent/noproxy.txt",
+	}
+
+	rec := httptest.NewRecorder()
+	service.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
 	}
 
-	domains, err := service.loadDomainsFile(service.domains)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	service.handler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected empty body for 304, got %d bytes", rec.Body.Len())
+	}
+}
+
+func TestRulesHandler(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	noproxy := filepath.Join(dir, "noproxy.txt")
+	if err := os.WriteFile(gfwlist, []byte("||google.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(noproxy, []byte("maps.google.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: noproxy,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rules/{file}", service.rulesHandler)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rules/clash.yaml?policy=Proxies", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	want := "rules:\n  - DOMAIN-SUFFIX,maps.google.com,DIRECT\n  - DOMAIN-SUFFIX,google.com,Proxies\n  - MATCH,DIRECT\n"
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("unexpected rules:\n%s", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rules/clash.yaml?policy=Proxies", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://pac.lan:1080/rules/chrome-policy.json", nil))
+	if !strings.Contains(rec.Body.String(), `"ProxyPacUrl": "http://pac.lan:1080/proxy.pac"`) {
+		t.Fatalf("policy does not point at the request host:\n%s", rec.Body)
+	}
+
+	for path, code := range map[string]int{
+		"/rules/clash.yaml?policy=a,b": http.StatusBadRequest,
+		"/rules/unknown.txt":           http.StatusNotFound,
+	} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, rec.Code)
+		}
+	}
+
+	cn := filepath.Join(dir, "cn.txt")
+	if err := os.WriteFile(cn, []byte("baidu.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service = &pacService{
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: filepath.Join(dir, "none.txt"),
+		sources: []*sources.Source{
+			{Name: "cn", Path: cn, Format: pacgen.FormatPlain, Enabled: true, Proxy: "DIRECT"},
+			{Name: "streaming", Path: gfwlist, Enabled: true, Proxy: "SOCKS5 127.0.0.1:1080"},
+		},
+	}
+	mux = http.NewServeMux()
+	mux.HandleFunc("GET /rules/{file}", service.rulesHandler)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rules/clash.yaml", nil))
+	want = "rules:\n  - DOMAIN-SUFFIX,baidu.com,DIRECT\n  - DOMAIN-SUFFIX,google.com,streaming\n  - MATCH,DIRECT\n"
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("sources not exported with their bindings:\n%s", got)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rules/clash-proxy.yaml", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "streaming") {
+		t.Fatalf("expected 400 for a binding clash-proxy cannot express, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	gfwlist := filepath.Join(t.TempDir(), "gfwlist.txt")
+	if err := os.WriteFile(gfwlist, []byte("||example.com\n||example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains: "/nonexistent/domains.txt",
+		noproxy: "/nonexistent/noproxy.txt",
+		maxAge:  time.Hour,
+	}
+
+	rec := httptest.NewRecorder()
+	service.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before first generation, got %d", rec.Code)
+	}
+
+	if _, err := service.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	service.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after generation, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(gfwlist, old, old); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	service.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for stale gfwlist, got %d", rec.Code)
+	}
+}
+
+func TestSnapshot_KeepsPreviousPACOverSizeBudget(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	domains := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(gfwlist, []byte("||example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		minify:  true,
+		maxSize: 1024,
+		sources: []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains: domains,
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+	}
+	first, err := service.snapshot()
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
+	}
+	if strings.Contains(string(first.body), "\n    ") {
+		t.Fatalf("PAC is not minified:\n%s", first.body)
+	}
+
+	var big strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&big, "host%d.example.net\n", i)
+	}
+	if err := os.WriteFile(domains, []byte(big.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		snap, err := service.snapshot()
+		if !errors.Is(err, pacgen.ErrTooLarge) {
+			t.Fatalf("want ErrTooLarge with the previous PAC, got %v", err)
+		}
+		if snap == nil || snap.etag != first.etag {
+			t.Fatal("expected the previous PAC to stay in service")
+		}
+	}
+	if service.lastErr == nil || !errors.Is(service.lastErr, pacgen.ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge as last error, got %v", service.lastErr)
+	}
+	if err := service.ready(); err != nil {
+		t.Fatalf("expected ready while the previous PAC is served: %v", err)
+	}
+	if n := len(service.reloads); n != 2 {
+		t.Fatalf("expected one success and one failure in the reload history, got %d events", n)
+	}
+
+	if err := os.WriteFile(domains, []byte("example.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.etag == first.etag || service.lastErr != nil {
+		t.Fatalf("expected a new PAC once the sources fit the budget, last error %v", service.lastErr)
+	}
+}
+
+func TestSnapshot_ReloadsTemplate(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	tmpl := filepath.Join(dir, "pac.tmpl")
+	if err := os.WriteFile(gfwlist, []byte("||example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpl, []byte("// v1 {{len .Lists}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:    "PROXY 127.0.0.1:3128",
+		template: tmpl,
+		sources:  []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains:  filepath.Join(dir, "domains.txt"),
+		noproxy:  filepath.Join(dir, "noproxy.txt"),
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(snap.body); got != "// v1 1\n" {
+		t.Fatalf("unexpected PAC %q", got)
+	}
+
+	if err := os.WriteFile(tmpl, []byte("// version 2 {{.Meta.Domains}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err = service.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(snap.body); got != "// version 2 1\n" {
+		t.Fatalf("template change not picked up: %q", got)
+	}
+
+	if err := os.WriteFile(tmpl, []byte("{{.Unknown}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := snap
+	if snap, err = service.snapshot(); err == nil {
+		t.Fatal("expected the template error with the previous PAC")
+	}
+	if snap == nil || snap.etag != prev.etag || service.lastErr == nil {
+		t.Fatalf("expected the previous PAC and a failed reload, last error %v", service.lastErr)
+	}
+}
+
+func TestSnapshot_GFWListFormat(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "geosite")
+	if err := os.WriteFile(gfwlist, []byte("include:google @-cn\nregexp:^x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "google"), []byte("google.com\ngoogle.cn @cn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource(gfwlist, pacgen.FormatV2Fly)},
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(snap.gfwlist, ",") != "google.com" {
+		t.Fatalf("gfwlist domains = %v, want [google.com]", snap.gfwlist)
+	}
+	if diags := snap.reports[2].diagnostics; len(diags) != 1 || diags[0].Reason != pacgen.ReasonRegex {
+		t.Fatalf("unexpected gfwlist diagnostics: %+v", diags)
+	}
+}
+
+// TestSnapshot_MatchesOfflineGeneration checks that gfwlist2pac, which
+// loads and generates through the sources package, builds the PAC the
+// server serves for the same inputs.
+func TestSnapshot_MatchesOfflineGeneration(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"gfwlist.txt":   "||google.com\n||twitter.com\n",
+		"streaming.txt": "netflix.com\n",
+		"domains.txt":   "example.com\n",
+		"noproxy.txt":   "maps.google.com\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcs := []*sources.Source{
+		{Name: "streaming", Path: filepath.Join(dir, "streaming.txt"), Format: pacgen.FormatPlain, Enabled: true, Proxy: "SOCKS5 127.0.0.1:1080"},
+		gfwlistSource(filepath.Join(dir, "gfwlist.txt"), pacgen.FormatAuto),
+	}
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		layout:  pacgen.LayoutTrie,
+		minify:  true,
+		sources: srcs,
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lists, err := sources.Load(service.noproxy, service.domains, srcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := lists.Generate(pacgen.Options{Proxy: service.proxy, Layout: pacgen.LayoutTrie, Minify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != string(snap.body) {
+		t.Fatalf("offline PAC differs from the served one:\n%s\n---\n%s", body, snap.body)
+	}
+}
+
+func TestSnapshot_ReloadsCustomJS(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	customJS := filepath.Join(dir, "custom.js")
+	if err := os.WriteFile(gfwlist, []byte("||example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(customJS, []byte("if (h === 'a.test') return 'DIRECT';\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:       "PROXY 127.0.0.1:3128",
+		customJS:    customJS,
+		customJSPos: pacgen.HookBefore,
+		sources:     []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains:     filepath.Join(dir, "domains.txt"),
+		noproxy:     filepath.Join(dir, "noproxy.txt"),
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(snap.body), "'a.test'") {
+		t.Fatalf("custom JavaScript missing from PAC:\n%s", snap.body)
+	}
+
+	if err := os.WriteFile(customJS, []byte("if (h === 'changed.test') return 'DIRECT';\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(next.body), "'changed.test'") || next.etag == snap.etag {
+		t.Fatalf("custom JavaScript change not picked up (etag %s):\n%s", next.etag, next.body)
+	}
+
+	if err := os.WriteFile(customJS, []byte("if (h === ) return 'DIRECT';\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		kept, err := service.snapshot()
+		if err == nil {
+			t.Fatal("expected the syntax error with the previous PAC")
+		}
+		if kept == nil || kept.etag != next.etag || string(kept.body) != string(next.body) {
+			t.Fatalf("expected the previous PAC to stay in service:\n%s", kept.body)
+		}
+	}
+	if service.lastErr == nil || !strings.Contains(service.lastErr.Error(), "custom.js: line 1:") {
+		t.Fatalf("want a syntax error naming the file, got %v", service.lastErr)
+	}
+	if n := len(service.reloads); n != 3 {
+		t.Fatalf("the broken file should be generated once, got %d reload events", n)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	gfwlist := filepath.Join(t.TempDir(), "gfwlist.txt")
+	if err := os.WriteFile(gfwlist, []byte("||example.com\n||example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains: "/nonexistent/domains.txt",
+		noproxy: "/nonexistent/noproxy.txt",
+	}
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	service.info(rec, httptest.NewRequest(http.MethodGet, "/info", nil))
+
+	var info serviceInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decode /info: %v", err)
+	}
+	if info.ETag != snap.etag {
+		t.Fatalf("expected etag %s, got %s", snap.etag, info.ETag)
+	}
+	if got := info.Sources["gfwlist"].Domains; got != 2 {
+		t.Fatalf("expected 2 gfwlist domains, got %d", got)
+	}
+	if info.Sources["domains"].Exists {
+		t.Fatal("expected domains source to be reported missing")
+	}
+	if info.LastReload == nil {
+		t.Fatal("expected last_reload to be set")
+	}
+}
+
+func TestSources_BindingsAndInfo(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "streaming.txt")
+	if err := os.WriteFile(local, []byte("netflix.com\nyoutube.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var remote atomic.Value
+	var fail atomic.Bool
+	remote.Store("||youtube.com\n||google.com\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		_, _ = io.WriteString(w, remote.Load().(string))
+	}))
+	defer srv.Close()
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+		sources: []*sources.Source{
+			{Name: "streaming", Path: local, Format: pacgen.FormatPlain, Enabled: true, Proxy: "SOCKS5 127.0.0.1:1080"},
+			{Name: "gfwlist", URL: srv.URL, Format: pacgen.FormatAuto, Refresh: time.Hour, Enabled: true},
+			{Name: "off", Embedded: true, Format: pacgen.FormatAuto},
+		},
+	}
+	service.fetchSources()
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pacgen.NewSourceMatcher(nil, nil, []pacgen.Source{
+		{Name: "streaming", Proxy: "SOCKS5 127.0.0.1:1080", Domains: []string{"netflix.com", "youtube.com"}},
+		{Name: "gfwlist", Domains: []string{"google.com", "youtube.com"}},
+	}, service.proxy)
+	for _, host := range []string{"www.youtube.com", "google.com", "netflix.com", "example.com"} {
+		want := m.FindProxyForURL("", host)
+		if host == "www.youtube.com" && want != "SOCKS5 127.0.0.1:1080" {
+			t.Fatalf("earlier source should win for %s, got %s", host, want)
+		}
+		if !strings.Contains(string(snap.body), want) {
+			t.Fatalf("PAC lacks %q:\n%s", want, snap.body)
+		}
+	}
+	if strings.Join(snap.gfwlist, ",") != "google.com,netflix.com,youtube.com" {
+		t.Fatalf("unexpected merged domains %v", snap.gfwlist)
+	}
+
+	// A changed download regenerates the PAC; a failed one keeps the last
+	// content and is reported.
+	remote.Store("||google.com\n||twitter.com\n||x.com\n")
+	if changed, err := fetchSource(service.sources[1]); err != nil || !changed {
+		t.Fatalf("fetch: changed %v, err %v", changed, err)
+	}
+	if snap, err = service.snapshot(); err != nil || snap.sourceDomains["gfwlist"] != 3 {
+		t.Fatalf("download not picked up: %v %v", snap.sourceDomains, err)
+	}
+	fail.Store(true)
+	if _, err := fetchSource(service.sources[1]); err == nil {
+		t.Fatal("expected a failed download")
+	}
+
+	rec := httptest.NewRecorder()
+	service.info(rec, httptest.NewRequest(http.MethodGet, "/info", nil))
+	var info serviceInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decode /info: %v", err)
+	}
+	streaming, gfwlist, off := info.Sources["streaming"], info.Sources["gfwlist"], info.Sources["off"]
+	if streaming.Precedence != 3 || streaming.Domains != 2 || streaming.Proxy != "SOCKS5 127.0.0.1:1080" || streaming.LastUpdate == nil {
+		t.Fatalf("unexpected streaming info %+v", streaming)
+	}
+	if gfwlist.Precedence != 4 || gfwlist.Domains != 3 || gfwlist.URL != srv.URL || gfwlist.Error == "" || gfwlist.LastUpdate == nil {
+		t.Fatalf("unexpected gfwlist info %+v", gfwlist)
+	}
+	if !off.Disabled || off.Precedence != 0 || off.Domains != 0 {
+		t.Fatalf("unexpected disabled source info %+v", off)
+	}
+}
+
+func TestSources_RemoteOutageAtStartup(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		domains: filepath.Join(dir, "domains.txt"),
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+		sources: []*sources.Source{{Name: "remote", URL: srv.URL, Format: pacgen.FormatAuto, Refresh: time.Hour, Enabled: true}},
+	}
+	if _, err := service.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("generating the PAC downloaded the source %d times", n)
+	}
+
+	service.fetchSources()
+	snap, err := service.snapshot()
+	if err != nil {
+		t.Fatalf("an unreachable source should not fail the PAC: %v", err)
+	}
+	if len(snap.gfwlist) != 0 {
+		t.Fatalf("unexpected domains %v", snap.gfwlist)
+	}
+	if err := service.sources[0].Err(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("want the download error recorded, got %v", err)
+	}
+}
+
+func TestInstrument_RecordsRouteAndProfile(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", (&pacService{}).healthz)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		setProfile(r, defaultProfile)
+		_, _ = w.Write([]byte("pac"))
+	})
+	h := instrument(nil, mux)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/some/random/path.pac", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	checks := []string{
+		`pac_server_http_requests_total{path="/",status="200",profile="default"}`,
+		`pac_server_http_requests_total{path="/healthz",status="200",profile=""}`,
+		`pac_server_http_response_bytes_total{path="/",profile="default"}`,
+	}
+	for _, c := range checks {
+		if !strings.Contains(out, c) {
+			t.Fatalf("metrics output missing %q:\n%s", c, out)
+		}
+	}
+	if strings.Contains(out, "/some/random/path.pac") {
+		t.Fatal("raw request paths should not be used as metric labels")
+	}
+}
+
+func TestInstrument_AccessLog(t *testing.T) {
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource("gfwlist.txt", "")},
+		domains: "/nonexistent/domains.txt",
+		noproxy: "/nonexistent/noproxy.txt",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", service.healthz)
+	mux.HandleFunc("/", service.handler)
+
+	var buf strings.Builder
+	logger, err := newLogger(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := instrument(logger, mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	req.Header.Set("User-Agent", "test-agent/1.0")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one access log record (healthz is debug), got %d:\n%s", len(lines), buf.String())
+	}
+
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("decode access log: %v", err)
+	}
+	for key, want := range map[string]any{
+		"path":       "/proxy.pac",
+		"status":     float64(200),
+		"user_agent": "test-agent/1.0",
+		"profile":    defaultProfile,
+	} {
+		if rec[key] != want {
+			t.Fatalf("access log %s: want %v, got %v", key, want, rec[key])
+		}
+	}
+	if etag, _ := rec["etag"].(string); etag == "" {
+		t.Fatal("expected etag in access log record")
+	}
+}
+
+func TestClientInventory_TracksVersionsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.json")
+	inv, err := newClientInventory(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource("gfwlist.txt", "")},
+		domains: "/nonexistent/domains.txt",
+		noproxy: "/nonexistent/noproxy.txt",
+		clients: inv,
+	}
+
+	now := time.Now()
+	inv.record("10.0.0.2", "old-laptop", `"stale-etag"`, now.Add(-time.Minute))
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("User-Agent", "new-laptop")
+	service.handler(httptest.NewRecorder(), req)
+	service.handler(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	service.clientsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/clients", nil))
+	var resp clientsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode clients: %v", err)
+	}
+	if resp.Total != 2 || resp.Current != 1 || resp.Stale != 1 {
+		t.Fatalf("unexpected counts: total=%d current=%d stale=%d", resp.Total, resp.Current, resp.Stale)
+	}
+	first := resp.Clients[0]
+	if first.IP != "10.0.0.1" || first.UserAgent != "new-laptop" || first.Fetches != 2 || !first.Current {
+		t.Fatalf("unexpected client record: %+v", first)
+	}
+
+	if err := inv.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	reloaded, err := newClientInventory(path, time.Hour)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := len(reloaded.list()); got != 2 {
+		t.Fatalf("expected 2 persisted clients, got %d", got)
+	}
+
+	reloaded.prune(now.Add(time.Hour - 30*time.Second))
+	if got := len(reloaded.list()); got != 1 {
+		t.Fatalf("expected retention to drop the old client, got %d clients", got)
+	}
+}
+
+func TestClientInventory_EvictsLeastRecentlySeen(t *testing.T) {
+	inv, err := newClientInventory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < maxClients; i++ {
+		inv.record(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), "ua", `"v1"`, start.Add(time.Duration(i)))
+	}
+	inv.record("10.0.0.0", "ua", `"v2"`, start.Add(maxClients))
+	inv.record("192.0.2.1", "ua", `"v2"`, start.Add(maxClients+1))
+
+	if got := len(inv.clients); got != maxClients {
+		t.Fatalf("expected the inventory to stay at %d clients, got %d", maxClients, got)
+	}
+	if _, ok := inv.clients[clientKey{ip: "10.0.0.1", ua: "ua"}]; ok {
+		t.Fatal("expected the least recently seen client to be evicted")
+	}
+	if _, ok := inv.clients[clientKey{ip: "10.0.0.0", ua: "ua"}]; !ok {
+		t.Fatal("a client seen again must not be evicted")
+	}
+}
+
+func TestListHandler_EditsDomainsFile(t *testing.T) {
+	dir := t.TempDir()
+	domains := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(domains, []byte("! managed by ops\ngoogle.com\ngithub.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource("gfwlist.txt", "")},
+		domains: domains,
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+		admin:   adminAuth{token: "secret"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/lists/{list}", service.requireAdmin(service.listHandler))
+
+	do := func(method, list, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/lists/"+list, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "proxy", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "proxy", "", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodPost, "proxy", `{"domains":["Example.COM",".ai","github.com"]}`, "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("POST: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, "proxy", `{"domains":["google.com"]}`, "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	content, err := os.ReadFile(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "! managed by ops\ngithub.com\nexample.com\n.ai\n"; string(content) != want {
+		t.Fatalf("domains file mismatch\nwant: %q\n got: %q", want, content)
+	}
+	if st, err := os.Stat(domains); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("expected file mode to be preserved, got %v (%v)", st.Mode().Perm(), err)
+	}
+
+	rec := do(http.MethodPut, "noproxy", `{"domains":["intranet.example.com","corp.example.com"]}`, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp listResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(resp.Domains, ","); got != "corp.example.com,intranet.example.com" {
+		t.Fatalf("unexpected noproxy list: %s", got)
+	}
+	if resp.ETag == "" {
+		t.Fatal("expected PAC to be regenerated after PUT")
+	}
+
+	rec = do(http.MethodPost, "proxy", `{"domains":["foo_bar.example.com","*","127.0.0.1"]}`, "secret")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid domains, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "gfwlist", `{"domains":["example.com"]}`, "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for editing gfwlist, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "unknown", "", "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown list, got %d", rec.Code)
+	}
+
+	served, err := service.loadPAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.maxSize = len(served)
+	rec = do(http.MethodPost, "proxy", `{"domains":["a-much-longer-domain.example.net"]}`, "secret")
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "PAC generation failed") {
+		t.Fatalf("expected 500 when the edit breaks generation, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body, err := service.loadPAC(); err != nil || string(body) != string(served) {
+		t.Fatalf("expected the previous PAC to stay in service: %v", err)
+	}
+}
+
+func TestRequireAdmin_DisabledWithoutCredentials(t *testing.T) {
+	service := &pacService{}
+	rec := httptest.NewRecorder()
+	service.requireAdmin(service.clientsHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/clients", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 when no admin credentials are configured, got %d", rec.Code)
+	}
+}
+
+func TestExplainHandler_ReportsMatchingRule(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	domains := filepath.Join(dir, "domains.txt")
+	noproxy := filepath.Join(dir, "noproxy.txt")
+	if err := os.WriteFile(gfwlist, []byte("! gfwlist\n||example.com\n||www.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(domains, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(noproxy, []byte("internal.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{
+		proxy:   "PROXY 127.0.0.1:3128",
+		sources: []*sources.Source{gfwlistSource(gfwlist, "")},
+		domains: domains,
+		noproxy: noproxy,
+	}
+	if _, err := service.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	explainURL := func(u string) explanation {
+		rec := httptest.NewRecorder()
+		service.explainHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/explain?url="+u, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", u, rec.Code, rec.Body.String())
+		}
+		var e explanation
+		if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+			t.Fatalf("%s: decode: %v", u, err)
+		}
+		return e
+	}
+
+	e := explainURL("https://www.example.com/path")
+	if e.Host != "www.example.com" || e.Result != "PROXY 127.0.0.1:3128" {
+		t.Fatalf("unexpected explanation: %+v", e)
+	}
+	if e.Match == nil || e.Match.List != "custom" || e.Match.Rule != "example.com" || e.Match.Source != domains || e.Match.Line != 1 {
+		t.Fatalf("unexpected match: %+v", e.Match)
+	}
+	var shadowed []string
+	for _, m := range e.Shadowed {
+		shadowed = append(shadowed, fmt.Sprintf("%s:%s:%d", m.List, m.Rule, m.Line))
+	}
+	if got, want := strings.Join(shadowed, ","), "gfwlist:www.example.com:3,gfwlist:example.com:2"; got != want {
+		t.Fatalf("shadowed mismatch\nwant: %s\n got: %s", want, got)
+	}
+
+	e = explainURL("a.internal.example.com")
+	if e.Result != "DIRECT" || e.Match == nil || e.Match.List != "noproxy" || len(e.Shadowed) != 2 {
+		t.Fatalf("expected noproxy to win over example.com rules: %+v", e)
+	}
+
+	e = explainURL("http://notexample.com:8080/")
+	if e.Host != "notexample.com" || e.Result != "DIRECT" || e.Match != nil {
+		t.Fatalf("expected no rule to match: %+v", e)
+	}
+
+	rec := httptest.NewRecorder()
+	service.reloadsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/reloads", nil))
+	var history struct {
+		Reloads []reloadEvent `json:"reloads"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Reloads) != 1 || history.Reloads[0].GFWList != 2 || history.Reloads[0].Noproxy != 1 {
+		t.Fatalf("unexpected reload history: %+v", history.Reloads)
+	}
+	if e.CustomJS != "" {
+		t.Fatalf("no custom JavaScript configured, got %q", e.CustomJS)
+	}
+
+	service.customJS = filepath.Join(dir, "custom.js")
+	if e = explainURL("www.example.com"); !strings.Contains(e.CustomJS, "before the lists") {
+		t.Fatalf("expected a note that custom JavaScript runs first: %+v", e)
+	}
+	service.customJSPos = pacgen.HookAfter
+	if e = explainURL("www.example.com"); e.CustomJS != "" {
+		t.Fatalf("an after hook cannot override a list match: %+v", e)
+	}
+	if e = explainURL("notexample.com"); !strings.Contains(e.CustomJS, "no list matched") {
+		t.Fatalf("expected a note that custom JavaScript decides unmatched hosts: %+v", e)
+	}
+}
+
+func TestLint_ReportsAndFixes(t *testing.T) {
+	dir := t.TempDir()
+	gfwlist := filepath.Join(dir, "gfwlist.txt")
+	domains := filepath.Join(dir, "domains.txt")
+	noproxy := filepath.Join(dir, "noproxy.txt")
+	if err := os.WriteFile(gfwlist, []byte("||example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(noproxy, []byte("corp.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join([]string{
+		"! proxied domains",
+		"github.com",
+		"gist.github.com",
+		"GitHub.com",
+		"my_host.example.net",
+		"wiki.corp.example.com",
+		"www.example.org",
+		".ai",
+		"",
+	}, "\n")
+	if err := os.WriteFile(domains, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &pacService{sources: []*sources.Source{gfwlistSource(gfwlist, "")}, domains: domains, noproxy: noproxy}
+	issues, err := service.lint(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, i := range issues {
+		got = append(got, fmt.Sprintf("%d:%s", i.Line, i.Severity))
+	}
+	want := "3:warning,4:warning,5:error,6:error,7:info"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("issues mismatch\nwant: %s\n got: %s\n%v", want, strings.Join(got, ","), issues)
+	}
+	if status := printLintIssues(io.Discard, issues); status != 1 {
+		t.Fatalf("expected exit status 1 with errors, got %d", status)
+	}
+
+	if _, err := service.lint(true); err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := os.ReadFile(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFixed := "! proxied domains\ngithub.com\nmy_host.example.net\n.ai\nwiki.corp.example.com\nwww.example.org\n"
+	if string(fixed) != wantFixed {
+		t.Fatalf("fixed file mismatch\nwant: %q\n got: %q", wantFixed, fixed)
+	}
+	if st, err := os.Stat(domains); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("expected permissions to be kept: %v %v", st.Mode(), err)
+	}
+
+	sections := []string{"! streaming", "youtube.com", "netflix.com", "", "! social", "twitter.com", "www.netflix.com", "facebook.com", "youtube.com", ""}
+	wantSections := "! streaming\nnetflix.com\nyoutube.com\n\n! social\nfacebook.com\ntwitter.com"
+	if got := strings.Join(fixLines(sections), "\n"); got != wantSections {
+		t.Fatalf("sections not sorted in place\nwant: %q\n got: %q", wantSections, got)
+	}
+}
+
+func TestLint_ChecksConfiguredSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cn := write("cn.txt", "example.cn\n")
+	extra := write("extra.txt", "example.cn\nexample.net\n")
+	domains := write("domains.txt", "example.cn\nexample.net\n")
+	service := &pacService{
+		domains: domains,
+		noproxy: filepath.Join(dir, "noproxy.txt"),
+		sources: []*sources.Source{
+			{Name: "cn", Path: cn, Format: pacgen.FormatPlain, Enabled: true, Proxy: "DIRECT"},
+			{Name: "extra", Path: extra, Format: pacgen.FormatPlain, Enabled: true},
+		},
+	}
+	issues, err := service.lint(false)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if domains != nil {
-		t.Fatalf("expected nil domains for non-existent file, got %v", domains)
+	if len(issues) != 1 || issues[0].Line != 2 || issues[0].Message != "example.net is already proxied by extra entry example.net" {
+		t.Fatalf("expected only example.net to be reported as proxied by extra: %v", issues)
 	}
 }
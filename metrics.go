@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/gsmlg-ci/pac-server/internal/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	buildInfo = registry.NewGaugeVec("pac_server_build_info",
+		"Build information, always 1.", "version", "build_date")
+	httpRequests = registry.NewCounterVec("pac_server_http_requests_total",
+		"HTTP requests served, by route, status code and PAC profile.", "path", "status", "profile")
+	httpResponseBytes = registry.NewCounterVec("pac_server_http_response_bytes_total",
+		"Response body bytes written, by route and PAC profile.", "path", "profile")
+	pacGenerationSeconds = registry.NewHistogram("pac_server_pac_generation_duration_seconds",
+		"Time spent loading sources and generating the PAC.", metrics.DefBuckets)
+	sourceDomains = registry.NewGaugeVec("pac_server_source_domains",
+		"Domains parsed from each source in the current PAC.", "source")
+	pacBytes = registry.NewGaugeVec("pac_server_pac_bytes",
+		"Size of the current PAC in bytes.")
+	lastReloadSuccess = registry.NewGaugeVec("pac_server_last_reload_success_timestamp_seconds",
+		"Unix time of the last successful PAC generation.")
+	reloadFailures = registry.NewCounterVec("pac_server_reload_failures_total",
+		"PAC generations that failed.")
+	prunedDomains = registry.NewGaugeVec("pac_server_pruned_domains",
+		"Entries left out of the current PAC as redundant: covered by a parent in the same list, or shadowed by noproxy.", "reason")
+	sourceIgnoredLines = registry.NewGaugeVec("pac_server_source_ignored_lines",
+		"Lines of each source in the current PAC that the parser ignored, by reason.", "source", "reason")
+	remoteFetchFailures = registry.NewCounterVec("pac_server_remote_fetch_failures_total",
+		"Failed downloads of remote sources.", "source")
+)
+
+// recordReload updates the source metrics after a PAC generation attempt.
+func recordReload(snap *cachedPAC, err error) {
+	if err != nil {
+		reloadFailures.Inc()
+		return
+	}
+
+	pacGenerationSeconds.Observe(snap.duration.Seconds())
+	sourceDomains.Reset()
+	sourceDomains.Set(float64(len(snap.noproxy)), "noproxy")
+	sourceDomains.Set(float64(len(snap.custom)), "domains")
+	for name, n := range snap.sourceDomains {
+		sourceDomains.Set(float64(n), name)
+	}
+	prunedDomains.Set(float64(snap.pruned.Covered), "covered")
+	prunedDomains.Set(float64(snap.pruned.Shadowed), "shadowed")
+	sourceIgnoredLines.Reset()
+	for _, r := range snap.reports {
+		for reason, n := range reasonCounts(r.diagnostics) {
+			sourceIgnoredLines.Set(float64(n), r.list, string(reason))
+		}
+	}
+	pacBytes.Set(float64(len(snap.body)))
+	lastReloadSuccess.Set(float64(snap.generated.UnixNano()) / 1e9)
+}
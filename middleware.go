@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultProfile names the PAC variant served by the server. Requests that
+// do not serve a PAC are recorded with an empty profile.
+const defaultProfile = "default"
+
+type requestMetaKey struct{}
+
+// requestMeta carries per-request details set by handlers back to the
+// middleware that records them.
+type requestMeta struct {
+	profile string
+}
+
+func setProfile(r *http.Request, profile string) {
+	if meta, ok := r.Context().Value(requestMetaKey{}).(*requestMeta); ok {
+		meta.profile = profile
+	}
+}
+
+// responseRecorder captures the status code and body size written by the
+// wrapped handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// instrument records request metrics for every request handled by next and,
+// when accessLog is non-nil, writes one access-log record per request.
+func instrument(accessLog *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		meta := &requestMeta{}
+		r = r.WithContext(context.WithValue(r.Context(), requestMetaKey{}, meta))
+		rec := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		path := routeLabel(r)
+		httpRequests.Inc(path, strconv.Itoa(rec.status), meta.profile)
+		httpResponseBytes.Add(float64(rec.bytes), path, meta.profile)
+
+		if accessLog != nil {
+			logAccess(accessLog, r, rec, meta, time.Since(start))
+		}
+	})
+}
+
+func logAccess(logger *slog.Logger, r *http.Request, rec *responseRecorder, meta *requestMeta, elapsed time.Duration) {
+	level := slog.LevelInfo
+	switch {
+	case rec.status >= 500:
+		level = slog.LevelError
+	case meta.profile == "":
+		// Probes and scrapes are frequent and rarely interesting.
+		level = slog.LevelDebug
+	}
+
+	ctx := r.Context()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("client", clientIP(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Duration("duration", elapsed),
+		slog.String("user_agent", r.UserAgent()),
+	}
+	if meta.profile != "" {
+		attrs = append(attrs, slog.String("profile", meta.profile))
+	}
+	if etag := rec.Header().Get("ETag"); etag != "" {
+		attrs = append(attrs, slog.String("etag", etag))
+	}
+	logger.LogAttrs(ctx, level, "request", attrs...)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// routeLabel returns the ServeMux pattern that handled r, without the
+// method, so arbitrary request paths don't create new metric series.
+func routeLabel(r *http.Request) string {
+	pattern := r.Pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
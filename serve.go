@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Environment variables used to pass an inherited listener (and a pipe used
+// to report readiness) from a parent process to its re-exec'd child.
+const (
+	envListenFD = "PAC_SERVER_LISTEN_FD"
+	envReadyFD  = "PAC_SERVER_READY_FD"
+)
+
+const handoffReadyTimeout = 30 * time.Second
+
+// listen returns the listener inherited from a parent process when one was
+// handed off, or a freshly bound TCP listener otherwise.
+func listen(addr string) (net.Listener, bool, error) {
+	ln, err := inheritedListener()
+	if err != nil {
+		return nil, false, err
+	}
+	if ln != nil {
+		return ln, true, nil
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return ln, false, nil
+}
+
+// serve runs srv on ln until it receives SIGINT or SIGTERM, then drains
+// in-flight requests for up to drainTimeout. Connections are served over TLS
+// when srv.TLSConfig is set. When handoff is enabled, the upgrade signal
+// (SIGUSR2 on unix) re-execs the binary with the listening socket before
+// draining, so the new process keeps accepting connections.
+func serve(srv *http.Server, ln net.Listener, drainTimeout time.Duration, handoff bool) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.Serve(tls.NewListener(ln, srv.TLSConfig))
+			return
+		}
+		errCh <- srv.Serve(ln)
+	}()
+
+	if err := notifyParentReady(); err != nil {
+		log.Printf("notify parent process: %v", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, upgradeSignals...)...)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case err := <-errCh:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		case sig := <-sigs:
+			if isUpgradeSignal(sig) {
+				if !handoff {
+					log.Printf("received %s, socket handoff disabled (see -handoff)", sig)
+					continue
+				}
+				if err := handoffListener(ln); err != nil {
+					log.Printf("socket handoff failed, continuing to serve: %v", err)
+					continue
+				}
+				log.Printf("listener handed off to new process, draining connections")
+			} else {
+				log.Printf("received %s, draining connections", sig)
+			}
+			return shutdown(srv, drainTimeout)
+		}
+	}
+}
+
+// shutdown stops accepting new connections and waits up to timeout for
+// in-flight requests to finish before closing the remaining ones.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		_ = srv.Close()
+		return err
+	}
+	return nil
+}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	for _, s := range upgradeSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTLSConfig returns nil when TLS is not configured. With clientCA set,
+// client certificates are requested and verified when presented; the admin
+// API accepts verified certificates in place of a bearer token.
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("-admin-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS key pair: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", clientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gsmlg-ci/pac-server/internal/pacgen"
+	"github.com/gsmlg-ci/pac-server/internal/sources"
+)
+
+// sourceClient downloads URL sources.
+var sourceClient = &http.Client{Timeout: 30 * time.Second}
+
+// gfwlistSource is the source -g describes.
+func gfwlistSource(path string, format pacgen.SourceFormat) *sources.Source {
+	return &sources.Source{
+		Name:     "gfwlist",
+		Path:     path,
+		Fallback: path == defaultGFWListPath,
+		Format:   format,
+		Enabled:  true,
+	}
+}
+
+// enabledSources returns the sources that feed the PAC, in order.
+func (s *pacService) enabledSources() []*sources.Source {
+	var enabled []*sources.Source
+	for _, src := range s.sources {
+		if src.Enabled {
+			enabled = append(enabled, src)
+		}
+	}
+	return enabled
+}
+
+// fetchSource downloads a URL source. Failures are counted in
+// pac_server_remote_fetch_failures_total and the previous content is kept.
+func fetchSource(src *sources.Source) (bool, error) {
+	changed, err := src.Fetch(sourceClient)
+	if err != nil {
+		remoteFetchFailures.Inc(src.Name)
+	}
+	return changed, err
+}
+
+// fetchSources downloads the enabled URL sources at startup, all at once.
+// Later downloads are left to refreshSources.
+func (s *pacService) fetchSources() {
+	var wg sync.WaitGroup
+	for _, src := range s.enabledSources() {
+		if src.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(src *sources.Source) {
+			defer wg.Done()
+			if _, err := fetchSource(src); err != nil {
+				slog.Warn("source download failed", "source", src.Name, "err", err)
+			}
+		}(src)
+	}
+	wg.Wait()
+}
+
+// loadLists loads the inputs of the PAC. It never downloads: a URL source
+// that has not been downloaded, or cannot be loaded, is left out, so a
+// remote outage neither takes the PAC down nor blocks requests; its error
+// shows in /info.
+func (s *pacService) loadLists() (sources.Lists, error) {
+	lists, err := sources.Load(s.noproxy, s.domains, s.sources)
+	if err != nil {
+		return sources.Lists{}, err
+	}
+	for _, src := range lists.Skipped {
+		slog.Warn("source skipped", "source", src.Name, "err", src.Err())
+	}
+	return lists, nil
+}
+
+// refreshSources downloads each enabled URL source at its refresh interval
+// and regenerates the PAC when one changed. After a failed download it
+// tries again every sources.MinRefresh.
+func (s *pacService) refreshSources(done <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, src := range s.enabledSources() {
+		if src.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(src *sources.Source) {
+			defer wg.Done()
+			wait := src.Refresh
+			if src.Err() != nil {
+				wait = sources.MinRefresh
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C:
+				}
+				changed, err := fetchSource(src)
+				if err != nil {
+					slog.Warn("source download failed", "source", src.Name, "err", err)
+					timer.Reset(sources.MinRefresh)
+					continue
+				}
+				timer.Reset(src.Refresh)
+				if changed {
+					slog.Info("source changed", "source", src.Name, "url", src.URL)
+					if _, err := s.snapshot(); err != nil {
+						slog.Error("reload failed", "err", err)
+					}
+				}
+			}
+		}(src)
+	}
+	wg.Wait()
+}